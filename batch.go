@@ -2,9 +2,13 @@ package bitcask
 
 import (
 	"bitcask/data"
+	"bitcask/index"
+	"context"
 	"encoding/binary"
+	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // 非事务操作
@@ -23,10 +27,6 @@ type WriteBatch struct {
 // NewWriteBatch 初始化WriteBatch方法
 // NewWriteBatch creates a new WriteBatch object with the given WriteBatchConfig.
 func (db *DB) NewWriteBatch(cfg WriteBatchConfig) *WriteBatch {
-	// b+树时且事务序列号文件不存在且不是第一次加载
-	if db.cfg.IndexType == BPTree && !db.seqNoFileExist && !db.isInitiated {
-		panic("cannot use write batch,seq NO file not exist")
-	}
 	return &WriteBatch{
 		cfg:           cfg,
 		mu:            new(sync.Mutex),
@@ -36,11 +36,14 @@ func (db *DB) NewWriteBatch(cfg WriteBatchConfig) *WriteBatch {
 }
 
 // Put adds a key-value pair to the write batch.
-// It returns an error if the key is empty.
+// It returns an error if the key is empty or the database is closed.
 func (wb *WriteBatch) Put(key, value []byte) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	if wb.db.closed.Load() {
+		return ErrDBClosed
+	}
 
 	// Create a log record with the given key and value.
 	logRecord := &data.LogRecord{
@@ -57,7 +60,7 @@ func (wb *WriteBatch) Put(key, value []byte) error {
 }
 
 // Delete 从 WriteBatch 中删除指定的键。
-// 如果键为空，则返回 ErrKeyIsEmpty 错误。
+// 如果键为空，则返回 ErrKeyIsEmpty 错误；数据库已经关闭时返回 ErrDBClosed。
 // 键对应的值存在时，会创建一个 LogRecord 并将其添加到 pendingWrites 映射中。
 func (wb *WriteBatch) Delete(key []byte) error {
 	if len(key) == 0 {
@@ -65,9 +68,27 @@ func (wb *WriteBatch) Delete(key []byte) error {
 	}
 	wb.mu.Lock()
 	defer wb.mu.Unlock()
+	// 持有读锁查找索引，关闭数据库时索引不会被同时关闭
+	wb.db.mu.RLock()
+	defer wb.db.mu.RUnlock()
+	if wb.db.closed.Load() {
+		return ErrDBClosed
+	}
+
+	// 后台加载完成之前索引中没有的 key 可能还在数据文件中，总是记录删除
+	if wb.db.loadingIndex() != nil {
+		wb.pendingWrites[string(key)] = &data.LogRecord{
+			Key:  key,
+			Type: data.LogRecordDeleted,
+		}
+		return nil
+	}
 
 	// 获取键对应的值
-	get := wb.db.index.Get(key)
+	get, err := wb.db.index.Get(key)
+	if err != nil {
+		return err
+	}
 	if get == nil {
 		// 数据不存在，直接返回
 		if wb.pendingWrites[string(key)] != nil {
@@ -87,6 +108,19 @@ func (wb *WriteBatch) Delete(key []byte) error {
 
 // Commit 提交事务，将暂存的数据写入到数据文件，更新内存索引
 func (wb *WriteBatch) Commit() error {
+	return wb.CommitContext(context.Background())
+}
+
+// CommitContext 提交事务，ctx 取消或者超时之后不再等待获取锁
+// 开始写入数据之后不会再被取消，保证事务完整提交
+func (wb *WriteBatch) CommitContext(ctx context.Context) error {
+	defer wb.db.metrics.commitLatency.observeSince(time.Now())
+	if wb.db.readOnly {
+		return ErrReadOnly
+	}
+	if wb.db.closed.Load() {
+		return ErrDBClosed
+	}
 	wb.mu.Lock()
 	defer wb.mu.Unlock()
 
@@ -96,9 +130,18 @@ func (wb *WriteBatch) Commit() error {
 	if uint(len(wb.pendingWrites)) > wb.cfg.MaxBatchNum {
 		return ErrExceedMaxBatchNum
 	}
+	// 后台加载完成之前不知道数据文件中最大的事务序列号
+	if err := wb.db.WaitReady(ctx); err != nil {
+		return err
+	}
 
-	wb.db.mu.Lock()
+	if err := wb.db.lockContext(ctx); err != nil {
+		return err
+	}
 	defer wb.db.mu.Unlock()
+	if wb.db.closed.Load() {
+		return ErrDBClosed
+	}
 	//更新事务的序列号
 	seqNo := atomic.AddUint64(&wb.db.seqNo, 1)
 	// 开始写数据到数据文件中
@@ -119,27 +162,46 @@ func (wb *WriteBatch) Commit() error {
 		Key:  logRecordKeyWriteWithSeq(txnFinKey, seqNo),
 		Type: data.LogRecordTxnFinished,
 	}
-	_, err := wb.db.appendLogRecord(finished)
+	finishedPos, err := wb.db.appendLogRecord(finished)
 	if err != nil {
 		return err
 	}
+	wb.db.markDead(finishedPos)
 	// 进行持久化
 	if wb.cfg.SyncWrites && wb.db.activeFile != nil {
-		if err := wb.db.activeFile.Sync(); err != nil {
+		if err := wb.db.syncActiveFile(); err != nil {
 			return err
 		}
 	}
-	//更新内存索引
-	for _, record := range wb.pendingWrites {
-
-		pos := position[string(record.Key)]
-		if record.Type == data.LogRecordNormal {
-			wb.db.index.Put(record.Key, pos)
-		}
-		if record.Type == data.LogRecordDeleted {
-			wb.db.index.Delete(record.Key)
+	//更新内存索引，b+树索引在一个事务中完成所有修改
+	// 先等待之前的写入更新完索引，事务中的 key 不会再被更早的位置覆盖
+	wb.db.waitIndexUpdates()
+	err = index.Batch(wb.db.index, func(w index.BatchWriter) error {
+		for _, record := range wb.pendingWrites {
+			pos := position[string(record.Key)]
+			oldPos, err := w.Get(record.Key)
+			if err != nil {
+				return err
+			}
+			wb.db.markDead(oldPos)
+			if record.Type == data.LogRecordNormal {
+				err = w.Put(record.Key, pos)
+			}
+			if record.Type == data.LogRecordDeleted {
+				wb.db.markDead(pos)
+				_, err = w.Delete(record.Key)
+			}
+			if err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+	// 事务已经提交，重启之后可以从数据文件中恢复索引
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrIndexUpdateFailed, err)
 	}
+	wb.db.maybeCheckpointIndex()
 	//将暂存数据清空
 	wb.pendingWrites = make(map[string]*data.LogRecord)
 	return nil
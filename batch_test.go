@@ -1,10 +1,13 @@
 package bitcask
 
 import (
+	"bitcask/index"
 	"bitcask/utils"
+	"context"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"testing"
+	"time"
 )
 
 // TestDB_NewWriteBatch is a unit test for the NewWriteBatch function.
@@ -144,3 +147,87 @@ func TestWriteBatch_2(t *testing.T) {
 //	assert.Nil(t, err)
 //
 //}
+
+// TestWriteBatch_CommitContext verifies that a commit gives up waiting for the lock after the deadline.
+func TestWriteBatch_CommitContext(t *testing.T) {
+	cfg := DefaultConfig
+	dir, err := os.MkdirTemp("", "bitcask-test-batch-context")
+	assert.Nil(t, err)
+	cfg.DirPath = dir
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	wb := db.NewWriteBatch(DefaultWriteBatchConfig)
+	assert.Nil(t, wb.Put(utils.GetTestKey(1), utils.GetTestValue(10)))
+
+	db.mu.RLock()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, wb.CommitContext(ctx), context.DeadlineExceeded)
+	db.mu.RUnlock()
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 暂存的数据没有丢失，可以再次提交
+	assert.Nil(t, wb.CommitContext(context.Background()))
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+}
+
+// batchCountingIndex 记录批量操作次数的索引
+type batchCountingIndex struct {
+	*index.BTree
+	batches *int
+}
+
+func (idx batchCountingIndex) Batch(fn func(w index.BatchWriter) error) error {
+	*idx.batches++
+	return fn(idx.BTree)
+}
+
+// TestWriteBatch_IndexBatch 提交、merge 和加载 hint 文件时批量更新索引
+func TestWriteBatch_IndexBatch(t *testing.T) {
+	var batches int
+	cfg := DefaultConfig
+	dir, err := os.MkdirTemp("", "bitcask-test-batch-index")
+	assert.Nil(t, err)
+	cfg.DirPath = dir
+	cfg.DataFileSize = 256 * 1024
+	cfg.IndexFactory = func(string, bool) (index.Indexer, error) {
+		return batchCountingIndex{BTree: index.NewBTree(), batches: &batches}, nil
+	}
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	wb := db.NewWriteBatch(WriteBatchConfig{MaxBatchNum: 15000})
+	for i := 0; i < 15000; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.GetTestValue(16)))
+	}
+	assert.Nil(t, wb.Commit())
+	assert.Equal(t, 1, batches)
+
+	// hint 文件中的 15000 条记录分两批更新
+	assert.Nil(t, db.Merge())
+	assert.Equal(t, 3, batches)
+	assert.Nil(t, db.Close())
+	removeIndexSnapshot(t, dir)
+	batches = 0
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, batches)
+	assert.Equal(t, 15000, len(listKeys(t, db)))
+
+	// 数据文件中的记录每 loadChunkRecords 条在一次批量操作中更新，b+树索引重放时每批只需要一个事务
+	for i := 0; i <= loadChunkRecords; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(16)))
+	}
+	assert.Nil(t, db.Close())
+	removeIndexSnapshot(t, dir)
+	batches = 0
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, batches)
+	assert.Equal(t, 15000, len(listKeys(t, db)))
+}
@@ -60,3 +60,93 @@ func Benchmark_Delete(b *testing.B) {
 		assert.Nil(b, err)
 	}
 }
+
+// openMixedDB opens a DB with small data files so that writers rotate files during the benchmark.
+func openMixedDB(b *testing.B) *bitcask.DB {
+	cfg := bitcask.DefaultConfig
+	dir, err := os.MkdirTemp("", "bitcask-bench-mixed")
+	assert.Nil(b, err)
+	cfg.DirPath = dir
+	cfg.IndexType = bitcask.Btree
+	cfg.DataFileSize = 4 * 1024 * 1024
+	mixedDB, err := bitcask.Open(cfg)
+	assert.Nil(b, err)
+	for i := 0; i < 10000; i++ {
+		assert.Nil(b, mixedDB.Put(utils.GetTestKey(i), utils.GetTestValue(1024)))
+	}
+	b.Cleanup(func() {
+		_ = mixedDB.Close()
+		_ = os.RemoveAll(dir)
+	})
+	return mixedDB
+}
+
+// Benchmark_MixedReadWrite runs parallel readers with one write in every ten operations.
+// Reads from sealed files do not take the database lock, so they do not wait for writers.
+func Benchmark_MixedReadWrite(b *testing.B) {
+	mixedDB := openMixedDB(b)
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for i := 0; pb.Next(); i++ {
+			key := utils.GetTestKey(rnd.Intn(10000))
+			if i%10 == 0 {
+				if err := mixedDB.Put(key, utils.GetTestValue(1024)); err != nil {
+					b.Fatal(err)
+				}
+				continue
+			}
+			if _, err := mixedDB.Get(key); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// Benchmark_GetDuringMerge measures parallel reads while merges replace the data files.
+func Benchmark_GetDuringMerge(b *testing.B) {
+	mixedDB := openMixedDB(b)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := mixedDB.Merge(); err != nil && !errors.Is(err, bitcask.ErrMergeIsProgress) {
+				b.Error(err)
+				return
+			}
+		}
+	}()
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for pb.Next() {
+			if _, err := mixedDB.Get(utils.GetTestKey(rnd.Intn(10000))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
+
+// Benchmark_WriteBatch commits 1000 keys per batch, the b+tree index applies them in one transaction.
+func Benchmark_WriteBatch(b *testing.B) {
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		wb := db.NewWriteBatch(bitcask.WriteBatchConfig{MaxBatchNum: 1000})
+		for j := 0; j < 1000; j++ {
+			assert.Nil(b, wb.Put(utils.GetTestKey(i*1000+j), utils.GetTestValue(128)))
+		}
+		assert.Nil(b, wb.Commit())
+	}
+}
@@ -0,0 +1,151 @@
+package bitcask
+
+import (
+	"bitcask/data"
+	"bitcask/index"
+	"sync/atomic"
+)
+
+// checkpointIndex 持久化活跃文件和 b+树索引，并把活跃文件的写入位置记录为检查点，需要持有锁
+// 先等待已经写入数据文件的记录都更新到索引中，clean 只在关闭数据库时使用
+func (db *DB) checkpointIndex(clean bool) error {
+	checkpointer, ok := db.index.(index.Checkpointer)
+	if !ok || !db.isBPTreeIndex() || db.activeFile == nil {
+		return nil
+	}
+	db.waitIndexUpdates()
+	if err := db.syncActiveFile(); err != nil {
+		return err
+	}
+	cp := &index.Checkpoint{
+		Pos:   &data.LogRecordPos{Fid: db.activeFile.FileID, Offset: db.activeFile.WriteOff},
+		SeqNo: atomic.LoadUint64(&db.seqNo),
+		Clean: clean,
+	}
+	if err := checkpointer.SaveCheckpoint(cp); err != nil {
+		return err
+	}
+	if err := db.syncIndex(); err != nil {
+		return err
+	}
+	db.needCheckpoint = false
+	return nil
+}
+
+// maybeCheckpointIndex 切换活跃文件之后记录新的检查点，需要持有锁
+// 检查点只影响重新打开时需要重放的数据量，失败时在下一次写入时重试
+func (db *DB) maybeCheckpointIndex() {
+	if db.needCheckpoint {
+		_ = db.checkpointIndex(false)
+	}
+}
+
+// recoverIndex 从检查点开始重放数据文件，恢复崩溃时没有持久化到 b+树索引中的修改
+// 检查点失效或者索引中有指向数据文件末尾之后的位置时，清空索引并从全部数据文件中重新构建
+// 事务序列号从检查点中恢复，重放的数据中有更大的序列号时使用更大的
+func (db *DB) recoverIndex() error {
+	checkpointer, ok := db.index.(index.Checkpointer)
+	if !ok {
+		return nil
+	}
+	cp, err := checkpointer.Checkpoint()
+	if err != nil {
+		return err
+	}
+	var checkpoint *data.LogRecordPos
+	if cp != nil {
+		checkpoint = cp.Pos
+		// 检查点失效时也保留其中的序列号，merge 之后的数据文件中不再有之前事务的序列号
+		if cp.SeqNo > db.seqNo {
+			db.seqNo = cp.SeqNo
+		}
+	}
+	if db.activeFile == nil {
+		if checkpoint == nil {
+			return nil
+		}
+		return db.rebuildIndex(checkpointer)
+	}
+	size, err := db.activeFile.IoManager.Size()
+	if err != nil {
+		return err
+	}
+	// 上一次正常关闭，索引是完整的，之后的修改在崩溃时需要按照普通的检查点恢复
+	// 只比较位置是不够的，数据文件可能恰好丢失了检查点之后写入的全部数据
+	if cp != nil && cp.Clean && checkpoint.Fid == db.activeFile.FileID && checkpoint.Offset == size {
+		db.activeFile.WriteOff = size
+		return db.checkpointIndex(false)
+	}
+	// 没有检查点的旧版本索引，或者检查点指向的文件已经被 merge 替换
+	if !db.isValidCheckpoint(checkpoint) {
+		return db.rebuildIndex(checkpointer)
+	}
+
+	db.txnRecords = make(map[uint64][]*data.TransactionRecord)
+	loads := db.fileLoadsFrom(checkpoint.Fid, checkpoint.Offset)
+	err = db.loadIndexFromFileLoads(loads, func(load fileLoad, end int64, err error) error {
+		load.dataFile.WriteOff = end
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	db.txnRecords = nil
+
+	// 崩溃时丢失了数据文件末尾的数据，索引中可能已经持久化了指向这些数据的位置
+	lost, err := db.hasPositionAfterEnd()
+	if err != nil {
+		return err
+	}
+	if lost {
+		return db.rebuildIndex(checkpointer)
+	}
+	return db.checkpointIndex(false)
+}
+
+// isValidCheckpoint 检查点是否指向当前的数据文件
+func (db *DB) isValidCheckpoint(checkpoint *data.LogRecordPos) bool {
+	if checkpoint == nil || checkpoint.Fid < db.manifest.NonMergeFileID || checkpoint.Fid > db.activeFile.FileID {
+		return false
+	}
+	dataFile := db.oldFile[checkpoint.Fid]
+	if checkpoint.Fid == db.activeFile.FileID {
+		dataFile = db.activeFile
+	}
+	if dataFile == nil {
+		return false
+	}
+	size, err := dataFile.IoManager.Size()
+	return err == nil && checkpoint.Offset <= size
+}
+
+// hasPositionAfterEnd 索引中是否有指向活跃文件写入位置之后的数据
+func (db *DB) hasPositionAfterEnd() (bool, error) {
+	iter, err := db.index.Iterator(false)
+	if err != nil {
+		return false, err
+	}
+	defer iter.Close()
+	activeFileID, end := db.activeFile.FileID, db.activeFile.WriteOff
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		pos := iter.Value()
+		if pos.Fid > activeFileID || (pos.Fid == activeFileID && pos.Offset >= end) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// rebuildIndex 清空 b+树索引，从 hint 文件和全部数据文件中重新构建
+func (db *DB) rebuildIndex(checkpointer index.Checkpointer) error {
+	if err := checkpointer.Reset(); err != nil {
+		return err
+	}
+	if err := db.loadIndexFromHintFile(); err != nil {
+		return err
+	}
+	if err := db.loadIndexFromFiles(); err != nil {
+		return err
+	}
+	return db.checkpointIndex(false)
+}
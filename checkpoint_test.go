@@ -0,0 +1,248 @@
+package bitcask
+
+import (
+	"bitcask/data"
+	"bitcask/index"
+	"bitcask/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// crashDB 模拟进程崩溃，不保存序列号和检查点，直接释放索引和数据文件
+func crashDB(db *DB) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.closed.Store(true)
+	_ = db.closeResources()
+}
+
+// copyFile 复制文件，用于保存崩溃之前某一时刻已经持久化的内容
+func copyFile(t *testing.T, src, dst string) {
+	content, err := os.ReadFile(src)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(dst, content, 0644))
+}
+
+// TestDB_RecoverIndex_MissingRecords 索引丢失了检查点之后的修改，重新打开时从数据文件中重放
+func TestDB_RecoverIndex_MissingRecords(t *testing.T) {
+	db, cfg := openMergeTestDB(t, BPTree)
+	values := make(map[string][]byte)
+	for i := 0; i < 300; i++ {
+		key := utils.GetTestKey(i)
+		values[string(key)] = utils.GetTestValue(64)
+		assert.Nil(t, db.Put(key, values[string(key)]))
+	}
+	assert.Nil(t, db.Sync())
+	indexPath := filepath.Join(cfg.DirPath, "bptree-index")
+	copyFile(t, indexPath, indexPath+".bak")
+
+	// 检查点之后的普通写入、删除和事务
+	for i := 200; i < 600; i++ {
+		key := utils.GetTestKey(i)
+		values[string(key)] = utils.GetTestValue(64)
+		assert.Nil(t, db.Put(key, values[string(key)]))
+	}
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		delete(values, string(utils.GetTestKey(i)))
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchConfig)
+	for i := 600; i < 700; i++ {
+		key := utils.GetTestKey(i)
+		values[string(key)] = utils.GetTestValue(64)
+		assert.Nil(t, wb.Put(key, values[string(key)]))
+	}
+	assert.Nil(t, wb.Delete(utils.GetTestKey(50)))
+	delete(values, string(utils.GetTestKey(50)))
+	assert.Nil(t, wb.Commit())
+	// 没有提交的事务不会被恢复
+	_, err := db.appendLogRecordWithLock(&data.LogRecord{
+		Key:   logRecordKeyWriteWithSeq(utils.GetTestKey(1000), db.seqNo+1),
+		Value: utils.GetTestValue(64),
+	})
+	assert.Nil(t, err)
+
+	// 崩溃之后索引文件只保留了检查点时的内容
+	crashDB(db)
+	assert.Nil(t, os.Rename(indexPath+".bak", indexPath))
+
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+	assert.Equal(t, len(values), len(listKeys(t, db)))
+	for key, value := range values {
+		val, err := db.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+	_, err = db.Get(utils.GetTestKey(1000))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 恢复之后记录了新的检查点，正常关闭之后重新打开不需要重放
+	checkpoint, err := db.index.(*index.BPlusTree).Checkpoint()
+	assert.Nil(t, err)
+	assert.False(t, checkpoint.Clean)
+	assert.Equal(t, db.activeFile.FileID, checkpoint.Pos.Fid)
+	assert.Equal(t, db.activeFile.WriteOff, checkpoint.Pos.Offset)
+	assert.Nil(t, db.Put(utils.GetTestKey(1), utils.GetTestValue(64)))
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, len(values)+1, len(listKeys(t, db)))
+	// 正常打开之后清除了关闭标记，之后崩溃时不会跳过恢复
+	checkpoint, err = db.index.(*index.BPlusTree).Checkpoint()
+	assert.Nil(t, err)
+	assert.False(t, checkpoint.Clean)
+}
+
+// TestDB_RecoverIndex_TruncatedFile 数据文件丢失了末尾的数据，索引中指向这些数据的位置被回滚
+func TestDB_RecoverIndex_TruncatedFile(t *testing.T) {
+	db, cfg := openMergeTestDB(t, BPTree)
+	values := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		key := utils.GetTestKey(i)
+		values[string(key)] = utils.GetTestValue(64)
+		assert.Nil(t, db.Put(key, values[string(key)]))
+	}
+	// 正常关闭之后重新打开，数据文件恰好回滚到关闭时的位置
+	assert.Nil(t, db.Close())
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	activePath := data.GetDataFileName(cfg.DirPath, db.activeFile.FileID)
+	syncedSize := db.activeFile.WriteOff
+
+	// 索引已经持久化了覆盖写入的位置，但是数据文件没有
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+		assert.Nil(t, db.Put(utils.GetTestKey(100+i), utils.GetTestValue(64)))
+	}
+	crashDB(db)
+	assert.Nil(t, os.Truncate(activePath, syncedSize))
+
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.Equal(t, len(values), len(listKeys(t, db)))
+	for key, value := range values {
+		val, err := db.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+	_, err = db.Get(utils.GetTestKey(100))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+// TestDB_RecoverIndex_MissingCheckpoint 旧版本的索引文件中没有检查点，重新构建索引
+func TestDB_RecoverIndex_MissingCheckpoint(t *testing.T) {
+	db, cfg := openMergeTestDB(t, BPTree)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	assert.Nil(t, db.Merge())
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	crashDB(db)
+	// 只保留索引文件，清空其中的数据和检查点
+	tree, err := index.NewBPlusTree(cfg.DirPath, false)
+	assert.Nil(t, err)
+	assert.Nil(t, tree.Reset())
+	assert.Nil(t, tree.Put(utils.GetTestKey(1000), &data.LogRecordPos{Fid: 1000}))
+	assert.Nil(t, tree.Close())
+
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.Equal(t, 400, len(listKeys(t, db)))
+	for i := 100; i < 500; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+}
+
+// commitTestBatch 提交一个写入 key 的事务
+func commitTestBatch(t *testing.T, db *DB, key []byte) {
+	wb := db.NewWriteBatch(DefaultWriteBatchConfig)
+	assert.Nil(t, wb.Put(key, utils.GetTestValue(64)))
+	assert.Nil(t, wb.Commit())
+}
+
+// TestDB_RecoverSeqNo 事务序列号在多次重启和崩溃之后都不会回退
+func TestDB_RecoverSeqNo(t *testing.T) {
+	db, cfg := openMergeTestDB(t, BPTree)
+	for i := 0; i < 3; i++ {
+		commitTestBatch(t, db, utils.GetTestKey(i))
+	}
+	assert.Nil(t, db.Close())
+
+	// 多次正常重启
+	for round := 1; round <= 2; round++ {
+		var err error
+		db, err = Open(cfg)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(3*round), db.seqNo)
+		for i := 0; i < 3; i++ {
+			commitTestBatch(t, db, utils.GetTestKey(i))
+		}
+		assert.Nil(t, db.Close())
+	}
+
+	// merge 之后数据文件中不再有事务的序列号，崩溃时从检查点恢复
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(9), db.seqNo)
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	assert.Nil(t, db.Merge())
+	commitTestBatch(t, db, utils.GetTestKey(1))
+	crashDB(db)
+
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10), db.seqNo)
+	commitTestBatch(t, db, utils.GetTestKey(2))
+	assert.Equal(t, uint64(11), db.seqNo)
+	crashDB(db)
+
+	// 崩溃之后没有序列号文件，仍然可以使用事务
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.Equal(t, uint64(11), db.seqNo)
+	commitTestBatch(t, db, utils.GetTestKey(3))
+	_, err = os.Stat(filepath.Join(cfg.DirPath, data.SeqNoFileName))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// TestDB_LoadLegacySeqNo 旧版本每次关闭都会在序列号文件中追加一条记录，使用最后一条
+func TestDB_LoadLegacySeqNo(t *testing.T) {
+	db, cfg := openMergeTestDB(t, BPTree)
+	commitTestBatch(t, db, utils.GetTestKey(0))
+	crashDB(db)
+	// 旧版本的索引中没有检查点
+	tree, err := index.NewBPlusTree(cfg.DirPath, false)
+	assert.Nil(t, err)
+	assert.Nil(t, tree.Reset())
+	assert.Nil(t, tree.Close())
+	seqNoFile, err := data.OpenSeqNoFile(cfg.DirPath)
+	assert.Nil(t, err)
+	for _, seq := range []string{"5", "9"} {
+		record, _ := data.EncodeLogRecord(&data.LogRecord{Key: []byte(seqNoKey), Value: []byte(seq)})
+		assert.Nil(t, seqNoFile.Write(record))
+	}
+	assert.Nil(t, seqNoFile.Close())
+
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.Equal(t, uint64(9), db.seqNo)
+	// 序列号已经保存到检查点中
+	_, err = os.Stat(filepath.Join(cfg.DirPath, data.SeqNoFileName))
+	assert.True(t, os.IsNotExist(err))
+	checkpoint, err := db.index.(*index.BPlusTree).Checkpoint()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(9), checkpoint.SeqNo)
+}
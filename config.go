@@ -1,6 +1,9 @@
 package bitcask
 
-import "os"
+import (
+	"bitcask/index"
+	"os"
+)
 
 type DBConfig struct {
 	// 数据库数据目录
@@ -12,6 +15,19 @@ type DBConfig struct {
 	SyncWrite bool
 	//索引类型
 	IndexType IndexerType
+	// 自定义索引实现，不为空时忽略 IndexType，可以使用 index.Lookup 取出已经注册的实现
+	// 自定义索引和内存索引一样在打开时从数据文件中重新构建
+	IndexFactory index.Factory
+	// 同时打开的数据文件数量上限，0 表示不限制
+	// 超出上限时关闭最近最少使用的旧数据文件，读取时重新打开
+	MaxOpenFiles int
+	// 打开时同时读取的数据文件数量，0 表示使用 CPU 核数，1 表示依次读取
+	// 读取出来的记录仍然按照文件的顺序更新到索引中
+	LoadConcurrency int
+	// 打开时在后台加载内存索引，Open 立即返回，使用 WaitReady 等待加载完成，b+树索引不使用
+	// 加载完成之前 Get 从新到旧读取数据文件查找 key，Put 和 Delete 直接写入；
+	// 事务提交、遍历、merge 和保存索引快照等待加载完成
+	BackgroundLoad bool
 }
 type IndexerType = int8
 
@@ -21,6 +37,15 @@ const (
 	// ART 自适应基数树索引
 	ART
 	BPTree //B+树索引，将索引存储到磁盘上
+	// Sharded 按 key 的哈希分成多个独立加锁的 BTree，适合大量并发写入
+	Sharded
+	// Hash 哈希索引，适合只有点查询的场景，key 连续保存在一块内存中，每个 key 额外占用一个 32 字节的槽位
+	// 写入 20 万个 21 字节的 key 时每个 key 约占用 56 字节，BTree 约 100~112 字节，ART 约 211 字节
+	// 遍历时需要复制全部数据并排序
+	Hash
+	// Arena 有序索引，key 和位置信息保存在大块内存中，GC 几乎不需要扫描，适合上亿个 key 的场景
+	// MemoryUsage 返回的是精确的内存占用
+	Arena
 )
 
 // IteratorConfig 索引迭代器配置项
@@ -29,6 +54,10 @@ type IteratorConfig struct {
 	Prefix []byte
 	// 是否反向遍历，默认 false 是正向
 	Reverse bool
+	// 遍历范围的下界（包含），默认为空表示没有下界
+	LowerBound []byte
+	// 遍历范围的上界（不包含），默认为空表示没有上界
+	UpperBound []byte
 }
 
 // WriteBatchConfig represents the configuration for a write batch.
@@ -39,12 +68,33 @@ type WriteBatchConfig struct {
 	SyncWrites bool
 }
 
+// MergeOptions represents the options for a merge.
+type MergeOptions struct {
+	// Progress is called after each data file has been merged, every 4 MB read within a data file,
+	// and once more when the merge finishes.
+	Progress func(MergeProgress)
+	// BytesPerSecond limits the bytes read and written by the merge, 0 means no limit.
+	BytesPerSecond int64
+}
+
+// MergeProgress reports the progress of a running merge.
+type MergeProgress struct {
+	FilesDone     int   // 已经处理完的数据文件数量
+	FilesTotal    int   // 需要 merge 的数据文件数量
+	BytesRead     int64 // 从旧数据文件中读取的字节数
+	BytesWritten  int64 // 写入 merge 文件和 hint 文件的字节数
+	KeysRewritten int64 // 重写的有效 key 数量
+}
+
 // DefaultConfig is the default configuration for the DB.
 var DefaultConfig = DBConfig{
-	DirPath:      os.TempDir(),      // Set the directory path to the temporary directory.
-	DataFileSize: 512 * 1024 * 1024, // Set the data file size to 512 MB.
-	SyncWrite:    false,             // Disable synchronous write.
-	IndexType:    BPTree,            // Use Btree/ART/BPTree index type.
+	DirPath:         os.TempDir(),      // Set the directory path to the temporary directory.
+	DataFileSize:    512 * 1024 * 1024, // Set the data file size to 512 MB.
+	SyncWrite:       false,             // Disable synchronous write.
+	IndexType:       BPTree,            // Use Btree/ART/BPTree index type.
+	MaxOpenFiles:    0,                 // Do not limit the number of open data files.
+	LoadConcurrency: 0,                 // Read data files with one goroutine per CPU when opening.
+	BackgroundLoad:  false,             // Load the index before Open returns.
 }
 var DefaultIteratorConfig = IteratorConfig{
 	Prefix:  nil,
@@ -54,3 +104,7 @@ var DefaultWriteBatchConfig = WriteBatchConfig{
 	MaxBatchNum: 10000,
 	SyncWrites:  true,
 }
+var DefaultMergeOptions = MergeOptions{
+	Progress:       nil,
+	BytesPerSecond: 0,
+}
@@ -34,12 +34,41 @@ func OpenDataFile(dirPath string, fileID uint32) (*DataFile, error) {
 
 }
 
+// OpenCachedDataFile 打开数据文件，文件描述符由 cache 管理，被关闭之后读写时重新打开
+func OpenCachedDataFile(dirPath string, fileID uint32, cache *fio.FileCache) (*DataFile, error) {
+	manager, err := cache.Open(GetDataFileName(dirPath, fileID))
+	if err != nil {
+		return nil, err
+	}
+	return &DataFile{FileID: fileID, IoManager: manager}, nil
+}
+
+// Pin 保持数据文件一直打开，只对 OpenCachedDataFile 打开的文件有效
+func (df *DataFile) Pin() error {
+	if cf, ok := df.IoManager.(*fio.CachedFileIO); ok {
+		return cf.Pin()
+	}
+	return nil
+}
+
+// Unpin 取消 Pin，之后文件描述符可以被 cache 关闭
+func (df *DataFile) Unpin() {
+	if cf, ok := df.IoManager.(*fio.CachedFileIO); ok {
+		cf.Unpin()
+	}
+}
+
 // OpenHintFile 打开hint索引文件
 func OpenHintFile(dirPath string) (*DataFile, error) {
 	fileName := filepath.Join(dirPath, HintFileName)
 	return newDataFile(fileName, 0)
 }
 
+// OpenHintFileReadOnly 以只读方式打开已经存在的hint索引文件
+func OpenHintFileReadOnly(dirPath string) (*DataFile, error) {
+	return newReadOnlyDataFile(filepath.Join(dirPath, HintFileName), 0)
+}
+
 // newDataFile函数用于创建一个新的DataFile对象。
 // 参数fileName为文件名，fileID为文件ID。
 // 返回一个指向DataFile对象的指针和一个错误对象。
@@ -57,6 +86,15 @@ func newDataFile(fileName string, fileID uint32) (*DataFile, error) {
 	}, nil
 }
 
+// newReadOnlyDataFile 以只读方式打开已经存在的文件
+func newReadOnlyDataFile(fileName string, fileID uint32) (*DataFile, error) {
+	manager, err := fio.NewReadOnlyFileIOManager(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return &DataFile{FileID: fileID, IoManager: manager}, nil
+}
+
 // WriteHintRecord 写入索引信息到hint文件
 func (df *DataFile) WriteHintRecord(key []byte, pos *LogRecordPos) error {
 	record := &LogRecord{
@@ -89,11 +127,14 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	if err != nil {
 		return nil, 0, err
 	}
-	header, headerSize := decodeLogRecordHeader(headerBuf)
+	header, headerSize, err := decodeLogRecordHeader(headerBuf)
 	//读取到了文件末尾，返回EOF
-	if (header == nil) || (header.crc == 0 && header.keySize == 0 && header.valueSize == 0) {
+	if err == errShortBuffer || (err == nil && header.crc == 0 && header.keySize == 0 && header.valueSize == 0) {
 		return nil, 0, io.EOF
 	}
+	if err != nil {
+		return nil, 0, err
+	}
 	//取出key和value的长度
 	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
 	//总长度
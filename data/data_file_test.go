@@ -2,6 +2,7 @@ package data
 
 import (
 	"github.com/stretchr/testify/assert"
+	"io"
 	"os"
 	"testing"
 )
@@ -111,3 +112,71 @@ func TestGetDataFileName(t *testing.T) {
 	fileID := 103
 	assert.Greater(t, len(GetDataFileName(dirPath, uint32(fileID))), 0)
 }
+
+// readHints 依次读取 hint 文件中的全部记录
+func readHints(dir string, fileID uint32, dataSize int64) ([]*LogRecord, []*LogRecordPos, error) {
+	hr, ok := OpenHintReader(dir, fileID, dataSize)
+	if !ok {
+		return nil, nil, os.ErrNotExist
+	}
+	defer hr.Close()
+	var records []*LogRecord
+	var positions []*LogRecordPos
+	for {
+		record, pos, err := hr.Next()
+		if err == io.EOF {
+			return records, positions, nil
+		}
+		if err != nil {
+			return records, positions, err
+		}
+		records = append(records, record)
+		positions = append(positions, pos)
+	}
+}
+
+func TestHintFile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-hint")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, ok := OpenHintReader(dir, 1, 0)
+	assert.False(t, ok)
+
+	var hints []byte
+	hints = append(hints, EncodeHintRecord([]byte("key-a"), LogRecordNormal, &LogRecordPos{Fid: 1, Offset: 0, Size: 20})...)
+	hints = append(hints, EncodeHintRecord([]byte("key-b"), LogRecordDeleted, &LogRecordPos{Fid: 1, Offset: 20, Size: 15})...)
+	assert.Nil(t, WriteHintFile(dir, 1, hints, 35))
+
+	records, positions, err := readHints(dir, 1, 35)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, []byte("key-b"), records[1].Key)
+	assert.Equal(t, LogRecordDeleted, records[1].Type)
+	assert.Equal(t, &LogRecordPos{Fid: 1, Offset: 20, Size: 15}, positions[1])
+
+	// 数据文件大小不一致
+	_, ok = OpenHintReader(dir, 1, 36)
+	assert.False(t, ok)
+	// 没有结束标识
+	assert.Nil(t, os.WriteFile(GetHintFileName(dir, 1), hints, 0644))
+	_, ok = OpenHintReader(dir, 1, 35)
+	assert.False(t, ok)
+	// 记录不完整，之前的记录仍然可以读取
+	trailer := encodeHintTrailer(35)
+	assert.Nil(t, os.WriteFile(GetHintFileName(dir, 1), append(hints[:len(hints)-1:len(hints)-1], trailer...), 0644))
+	records, _, err = readHints(dir, 1, 35)
+	assert.Equal(t, ErrInvalidHintFile, err)
+	assert.Equal(t, 1, len(records))
+	// 记录和数据文件不连续
+	gap := EncodeHintRecord([]byte("key-b"), LogRecordNormal, &LogRecordPos{Fid: 1, Offset: 21, Size: 14})
+	assert.Nil(t, os.WriteFile(GetHintFileName(dir, 1), append(append(hints[:len(hints)-len(gap):len(hints)-len(gap)], gap...), trailer...), 0644))
+	records, _, err = readHints(dir, 1, 35)
+	assert.Equal(t, ErrInvalidHintFile, err)
+	assert.Equal(t, 1, len(records))
+	// 没有覆盖整个数据文件
+	assert.Nil(t, os.WriteFile(GetHintFileName(dir, 1), append(hints[:len(hints)-len(gap):len(hints)-len(gap)], trailer...), 0644))
+	records, _, err = readHints(dir, 1, 35)
+	assert.Equal(t, ErrInvalidHintFile, err)
+	assert.Equal(t, 1, len(records))
+}
@@ -0,0 +1,121 @@
+package data
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+const (
+	DeadBytesFileName = "dead-bytes"
+	deadBytesKey      = "dead-bytes"
+)
+
+var (
+	ErrInvalidDeadBytes = errors.New("invalid dead bytes file, the file maybe corrupted")
+)
+
+// DeadBytes 关闭数据库时保存的每个数据文件中的无效数据量
+// 重新打开时数据文件和保存时一致才能使用，否则需要遍历索引重新统计
+type DeadBytes struct {
+	Generation uint64           // 保存时的 merge 代数
+	Fid        uint32           // 保存时的活跃文件
+	Offset     int64            // 保存时活跃文件的写入位置
+	Files      map[uint32]int64 // 每个数据文件中的无效数据量
+}
+
+// EncodeDeadBytes 对 DeadBytes 进行编码
+//
+//	+-------------+-------+--------+-------+---------------------------+
+//	| generation  |  fid  | offset | count | (fid, dead bytes) ...     |
+//	+-------------+-------+--------+-------+---------------------------+
+//	  按文件编号从小到大排列，全部使用变长编码
+func EncodeDeadBytes(d *DeadBytes) []byte {
+	fileIDs := make([]uint32, 0, len(d.Files))
+	for fid := range d.Files {
+		fileIDs = append(fileIDs, fid)
+	}
+	sort.Slice(fileIDs, func(i, j int) bool { return fileIDs[i] < fileIDs[j] })
+
+	buf := make([]byte, 0, binary.MaxVarintLen64*4+(binary.MaxVarintLen32+binary.MaxVarintLen64)*len(fileIDs))
+	buf = binary.AppendUvarint(buf, d.Generation)
+	buf = binary.AppendUvarint(buf, uint64(d.Fid))
+	buf = binary.AppendVarint(buf, d.Offset)
+	buf = binary.AppendUvarint(buf, uint64(len(fileIDs)))
+	for _, fid := range fileIDs {
+		buf = binary.AppendUvarint(buf, uint64(fid))
+		buf = binary.AppendVarint(buf, d.Files[fid])
+	}
+	return buf
+}
+
+// DecodeDeadBytes 解码 DeadBytes
+func DecodeDeadBytes(buf []byte) (*DeadBytes, error) {
+	readUvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return 0, ErrInvalidDeadBytes
+		}
+		buf = buf[n:]
+		return v, nil
+	}
+	readVarint := func() (int64, error) {
+		v, n := binary.Varint(buf)
+		if n <= 0 {
+			return 0, ErrInvalidDeadBytes
+		}
+		buf = buf[n:]
+		return v, nil
+	}
+	generation, err := readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	fid, err := readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	offset, err := readVarint()
+	if err != nil {
+		return nil, err
+	}
+	count, err := readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	d := &DeadBytes{
+		Generation: generation,
+		Fid:        uint32(fid),
+		Offset:     offset,
+		Files:      make(map[uint32]int64),
+	}
+	for i := uint64(0); i < count; i++ {
+		fileID, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		dead, err := readVarint()
+		if err != nil {
+			return nil, err
+		}
+		d.Files[uint32(fileID)] = dead
+	}
+	if len(buf) != 0 {
+		return nil, ErrInvalidDeadBytes
+	}
+	return d, nil
+}
+
+// ReadDeadBytes 读取目录中保存的无效数据量，文件不存在时返回 nil
+func ReadDeadBytes(dirPath string) (*DeadBytes, error) {
+	value, err := readRecordFile(dirPath, DeadBytesFileName, deadBytesKey, ErrInvalidDeadBytes)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	return DecodeDeadBytes(value)
+}
+
+// WriteDeadBytes 原子地替换目录中保存的无效数据量
+func WriteDeadBytes(dirPath string, d *DeadBytes) error {
+	return writeRecordFile(dirPath, DeadBytesFileName, deadBytesKey, EncodeDeadBytes(d))
+}
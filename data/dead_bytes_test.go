@@ -0,0 +1,41 @@
+package data
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestEncodeDeadBytes(t *testing.T) {
+	d := &DeadBytes{
+		Generation: 2,
+		Fid:        7,
+		Offset:     4096,
+		Files:      map[uint32]int64{3: 100, 5: 2048, 7: 1},
+	}
+	res, err := DecodeDeadBytes(EncodeDeadBytes(d))
+	assert.Nil(t, err)
+	assert.Equal(t, d, res)
+
+	buf := EncodeDeadBytes(d)
+	_, err = DecodeDeadBytes(buf[:len(buf)-1])
+	assert.Equal(t, ErrInvalidDeadBytes, err)
+	_, err = DecodeDeadBytes(append(buf, 0))
+	assert.Equal(t, ErrInvalidDeadBytes, err)
+}
+
+func TestWriteDeadBytes(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-dead-bytes")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	d, err := ReadDeadBytes(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, d)
+
+	d = &DeadBytes{Generation: 1, Fid: 2, Offset: 10, Files: map[uint32]int64{1: 20}}
+	assert.Nil(t, WriteDeadBytes(dir, d))
+	res, err := ReadDeadBytes(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, d, res)
+}
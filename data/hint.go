@@ -0,0 +1,160 @@
+package data
+
+import (
+	"bitcask/fio"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// HintFileNameSuffix 数据文件对应的 hint 文件后缀
+// hint 文件按顺序记录数据文件中每条记录的 key、位置和类型，打开数据库时不需要读取 value
+// 最后一条记录的 key 为空，value 为数据文件的大小，用来判断 hint 文件是否完整
+const HintFileNameSuffix = ".hint"
+
+// GetHintFileName 数据文件对应的 hint 文件名称
+func GetHintFileName(dirPath string, fileID uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileID)+HintFileNameSuffix)
+}
+
+// EncodeHintRecord 编码数据文件中一条记录的 hint，key 为数据文件中记录的 key
+func EncodeHintRecord(key []byte, recordType LogRecordType, pos *LogRecordPos) []byte {
+	encRecord, _ := EncodeLogRecord(&LogRecord{
+		Key:   key,
+		Value: EncodeLogRecordPos(pos),
+		Type:  recordType,
+	})
+	return encRecord
+}
+
+// WriteHintFile 写入数据文件的 hint 文件，hints 为依次编码的 hint 记录，dataSize 为数据文件的大小
+// 先写入临时文件再重命名，hint 文件不持久化，崩溃之后不完整的 hint 文件在读取时会被忽略
+func WriteHintFile(dirPath string, fileID uint32, hints []byte, dataSize int64) error {
+	trailer := encodeHintTrailer(dataSize)
+	fileName := GetHintFileName(dirPath, fileID)
+	tmpName := fileName + ".tmp"
+	if err := os.WriteFile(tmpName, append(hints, trailer...), fio.DataFilePerm); err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+	return os.Rename(tmpName, fileName)
+}
+
+// ErrInvalidHintFile hint 文件中的记录不完整、校验失败或者和数据文件不一致
+var ErrInvalidHintFile = errors.New("invalid hint file, the file maybe corrupted")
+
+// encodeHintTrailer 编码 hint 文件最后的结束标识，key 为空，value 为数据文件的大小
+func encodeHintTrailer(dataSize int64) []byte {
+	trailer, _ := EncodeLogRecord(&LogRecord{
+		Value: binary.AppendUvarint(nil, uint64(dataSize)),
+	})
+	return trailer
+}
+
+// HintReader 依次读取 hint 文件中的记录，每次只读取一条记录，内存占用和 hint 文件的大小无关
+type HintReader struct {
+	file     *os.File
+	reader   *bufio.Reader
+	fileID   uint32
+	dataSize int64
+	remain   int64 // 结束标识之前还没有读取的字节数
+	offset   int64 // 下一条记录在数据文件中的位置
+}
+
+// OpenHintReader 打开数据文件的 hint 文件，打开时只检查文件末尾的结束标识
+// hint 文件不存在、没有结束标识或者和大小为 dataSize 的数据文件不一致时返回 false，需要读取数据文件
+func OpenHintReader(dirPath string, fileID uint32, dataSize int64) (*HintReader, bool) {
+	file, err := os.Open(GetHintFileName(dirPath, fileID))
+	if err != nil {
+		return nil, false
+	}
+	trailer := encodeHintTrailer(dataSize)
+	if stat, err := file.Stat(); err == nil && stat.Size() >= int64(len(trailer)) {
+		tail := make([]byte, len(trailer))
+		if _, err := file.ReadAt(tail, stat.Size()-int64(len(tail))); err == nil && bytes.Equal(tail, trailer) {
+			return &HintReader{
+				file:     file,
+				reader:   bufio.NewReader(file),
+				fileID:   fileID,
+				dataSize: dataSize,
+				remain:   stat.Size() - int64(len(trailer)),
+			}, true
+		}
+	}
+	_ = file.Close()
+	return nil, false
+}
+
+// Next 读取下一条记录，返回数据文件中记录的 key、类型和位置，全部读取完成时返回 io.EOF
+// 记录不完整、校验失败或者和数据文件中的记录不连续时返回 ErrInvalidHintFile，之前读取的记录仍然有效
+func (hr *HintReader) Next() (*LogRecord, *LogRecordPos, error) {
+	if hr.remain == 0 {
+		if hr.offset != hr.dataSize {
+			return nil, nil, ErrInvalidHintFile
+		}
+		return nil, nil, io.EOF
+	}
+	// 最后一条记录之后是结束标识，header 不完整时 Peek 返回的数据更少，解码失败
+	headerBuf, _ := hr.reader.Peek(maxLogRecordHeaderSize)
+	header, headerSize, err := decodeLogRecordHeader(headerBuf)
+	if err != nil {
+		return nil, nil, ErrInvalidHintFile
+	}
+	size := headerSize + int64(header.keySize) + int64(header.valueSize)
+	if size > hr.remain {
+		return nil, nil, ErrInvalidHintFile
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(hr.reader, buf); err != nil {
+		return nil, nil, err
+	}
+	hr.remain -= size
+	record, _, err := decodeLogRecord(buf)
+	if err != nil || len(record.Key) == 0 {
+		return nil, nil, ErrInvalidHintFile
+	}
+	pos := DecodeLogRecordPos(record.Value)
+	if pos.Fid != hr.fileID || pos.Offset != hr.offset {
+		return nil, nil, ErrInvalidHintFile
+	}
+	hr.offset += int64(pos.Size)
+	return record, pos, nil
+}
+
+// Close 关闭 hint 文件
+func (hr *HintReader) Close() error {
+	return hr.file.Close()
+}
+
+// errShortBuffer buf 中没有完整的记录
+var errShortBuffer = errors.New("short buffer")
+
+// decodeLogRecord 从 buf 的开头解码一条完整的记录
+// 数据不完整时返回 errShortBuffer，校验失败时返回 ErrInvalidCRC
+func decodeLogRecord(buf []byte) (*LogRecord, int64, error) {
+	header, headerSize, err := decodeLogRecordHeader(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
+	if int64(len(buf))-headerSize < keySize+valueSize {
+		return nil, 0, errShortBuffer
+	}
+	keyEnd := headerSize + keySize
+	end := keyEnd + valueSize
+	record := &LogRecord{
+		Key:   buf[headerSize:keyEnd:keyEnd],
+		Value: buf[keyEnd:end:end],
+		Type:  header.recordType,
+	}
+	if getLogRecordCRC(record, buf[crc32.Size:headerSize]) != header.crc {
+		return nil, 0, ErrInvalidCRC
+	}
+	return record, end, nil
+}
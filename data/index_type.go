@@ -0,0 +1,23 @@
+package data
+
+import "errors"
+
+const (
+	IndexTypeFileName = "index-type"
+	indexTypeKey      = "index-type"
+)
+
+var (
+	ErrInvalidIndexType = errors.New("invalid index type file, the file maybe corrupted")
+)
+
+// ReadIndexType 读取数据目录使用的索引类型名称，旧版本的数据目录中没有记录时返回空字符串
+func ReadIndexType(dirPath string) (string, error) {
+	value, err := readRecordFile(dirPath, IndexTypeFileName, indexTypeKey, ErrInvalidIndexType)
+	return string(value), err
+}
+
+// WriteIndexType 原子地记录数据目录使用的索引类型名称
+func WriteIndexType(dirPath string, name string) error {
+	return writeRecordFile(dirPath, IndexTypeFileName, indexTypeKey, []byte(name))
+}
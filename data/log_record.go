@@ -3,6 +3,7 @@ package data
 import (
 	"encoding/binary"
 	"hash/crc32"
+	"math"
 )
 
 type LogRecordType = byte
@@ -22,6 +23,7 @@ const (
 type LogRecordPos struct {
 	Fid    uint32 // 文件 id，表示将数据存储到了哪个文件当中
 	Offset int64  // 偏移，表示将数据存储到了数据文件中的哪个位置
+	Size   uint32 // 标识数据在磁盘上的大小
 }
 
 // LogRecord 写入到数据文件的记录
@@ -88,25 +90,33 @@ func EncodeLogRecord(record *LogRecord) ([]byte, int64) {
 // decodeLogRecordHeader函数用于解码LogRecord的头部信息。
 // 参数buf为待解码的字节切片。
 // 返回解码后的logRecordHeader对象和解码后的字节切片的下一个索引。
-func decodeLogRecordHeader(buf []byte) (*logRecordHeader, int64) {
+// buf 在 header 中间结束时返回 errShortBuffer，key/value 长度无效时返回 ErrInvalidCRC
+func decodeLogRecordHeader(buf []byte) (*logRecordHeader, int64, error) {
 	if len(buf) <= 4 {
-		return nil, 0
+		return nil, 0, errShortBuffer
 	}
 	header := &logRecordHeader{
 		crc:        binary.LittleEndian.Uint32(buf[:4]),
 		recordType: buf[4],
 	}
 	var index = 5
-	// 读出key size
-	keySize, n := binary.Varint(buf[index:])
-	header.keySize = uint32(keySize)
-	index += n
-	// 读出value size
-	valueSize, n := binary.Varint(buf[index:])
-	index += n
-	header.valueSize = uint32(valueSize)
+	// 依次读出key size和value size
+	var sizes [2]int64
+	for i := range sizes {
+		size, n := binary.Varint(buf[index:])
+		if n == 0 {
+			return nil, 0, errShortBuffer
+		}
+		if n < 0 || size < 0 || size > math.MaxUint32 {
+			return nil, 0, ErrInvalidCRC
+		}
+		sizes[i] = size
+		index += n
+	}
+	header.keySize = uint32(sizes[0])
+	header.valueSize = uint32(sizes[1])
 
-	return header, int64(index)
+	return header, int64(index), nil
 }
 
 // getLogRecordCRC函数用于计算LogRecord对象的CRC校验码。
@@ -132,10 +142,11 @@ func getLogRecordCRC(lr *LogRecord, header []byte) uint32 {
 // 参数pos为要编码的LogRecordPos对象。
 // 返回编码后的字节数组。
 func EncodeLogRecordPos(pos *LogRecordPos) []byte {
-	buf := make([]byte, binary.MaxVarintLen32+binary.MaxVarintLen64)
+	buf := make([]byte, binary.MaxVarintLen32*2+binary.MaxVarintLen64)
 	var index = 0
 	index += binary.PutVarint(buf[index:], int64(pos.Fid))
 	index += binary.PutVarint(buf[index:], pos.Offset)
+	index += binary.PutVarint(buf[index:], int64(pos.Size))
 	return buf[:index]
 }
 
@@ -145,8 +156,15 @@ func DecodeLogRecordPos(buf []byte) *LogRecordPos {
 	fid, n := binary.Varint(buf[index:])
 	index += n
 	offset, n := binary.Varint(buf[index:])
+	index += n
+	// 旧版本的位置信息中没有记录大小
+	var size int64
+	if index < len(buf) {
+		size, _ = binary.Varint(buf[index:])
+	}
 	return &LogRecordPos{
 		Fid:    uint32(fid),
 		Offset: offset,
+		Size:   uint32(size),
 	}
 }
@@ -37,7 +37,8 @@ func TestEncodeLogRecord(t *testing.T) {
 func TestDecodeLogRecordHeader(t *testing.T) {
 
 	headerBuf := []byte{186, 103, 192, 80, 0, 6, 10}
-	res, n := decodeLogRecordHeader(headerBuf)
+	res, n, err := decodeLogRecordHeader(headerBuf)
+	assert.Nil(t, err)
 	assert.NotNil(t, res)
 	assert.Greater(t, n, int64(5))
 	assert.Equal(t, res, res, headerBuf)
@@ -47,7 +48,8 @@ func TestDecodeLogRecordHeader(t *testing.T) {
 	assert.Equal(t, res.valueSize, uint32(5))
 
 	headerBuf = []byte{184, 38, 83, 75, 0, 6, 0}
-	res, n = decodeLogRecordHeader(headerBuf)
+	res, n, err = decodeLogRecordHeader(headerBuf)
+	assert.Nil(t, err)
 	assert.NotNil(t, res)
 	assert.Greater(t, n, int64(5))
 	assert.Equal(t, res, res, headerBuf)
@@ -57,7 +59,8 @@ func TestDecodeLogRecordHeader(t *testing.T) {
 	assert.Equal(t, res.valueSize, uint32(0))
 
 	headerBuf = []byte{190, 90, 126, 234, 1, 18, 22}
-	res, n = decodeLogRecordHeader(headerBuf)
+	res, n, err = decodeLogRecordHeader(headerBuf)
+	assert.Nil(t, err)
 	assert.NotNil(t, res)
 	assert.Greater(t, n, int64(5))
 	assert.Equal(t, res, res, headerBuf)
@@ -66,6 +69,14 @@ func TestDecodeLogRecordHeader(t *testing.T) {
 	assert.Equal(t, res.keySize, uint32(9))
 	assert.Equal(t, res.valueSize, uint32(11))
 
+	// 数据在 header 中间结束
+	_, _, err = decodeLogRecordHeader(headerBuf[:4])
+	assert.Equal(t, errShortBuffer, err)
+	_, _, err = decodeLogRecordHeader([]byte{190, 90, 126, 234, 1, 0x80})
+	assert.Equal(t, errShortBuffer, err)
+	// key 长度为负数
+	_, _, err = decodeLogRecordHeader([]byte{190, 90, 126, 234, 1, 1, 22})
+	assert.Equal(t, ErrInvalidCRC, err)
 }
 func TestGetLogRecordCRC(t *testing.T) {
 	rec := &LogRecord{
@@ -95,3 +106,16 @@ func TestGetLogRecordCRC(t *testing.T) {
 	assert.Equal(t, crc, uint32(3934149310))
 
 }
+
+func TestEncodeLogRecordPos(t *testing.T) {
+	pos := &LogRecordPos{Fid: 12, Offset: 102400, Size: 1024}
+	res := DecodeLogRecordPos(EncodeLogRecordPos(pos))
+	assert.Equal(t, pos, res)
+
+	// 旧版本的位置信息中没有大小
+	buf := []byte{24, 128, 128, 12}
+	res = DecodeLogRecordPos(buf)
+	assert.Equal(t, uint32(12), res.Fid)
+	assert.Equal(t, int64(98304), res.Offset)
+	assert.Equal(t, uint32(0), res.Size)
+}
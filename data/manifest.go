@@ -0,0 +1,162 @@
+package data
+
+import (
+	"bitcask/utils"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	ManifestFileName = "MANIFEST"
+	manifestKey      = "manifest"
+)
+
+var (
+	ErrInvalidManifest = errors.New("invalid manifest, the file maybe corrupted")
+)
+
+// Manifest 记录当前有效的数据文件集合
+// 有效的数据文件包括 merge 生成的文件，以及编号不小于 NonMergeFileID 的文件
+// 其他的数据文件都已经被 merge 替换，打开数据库时不会再被读取
+type Manifest struct {
+	Generation     uint64   // merge 代数，每安装一次 merge 结果加一
+	NonMergeFileID uint32   // 没有参与 merge 的最小文件编号
+	MergedFileIDs  []uint32 // merge 生成的数据文件编号，从小到大排列
+}
+
+// IsLive 判断数据文件是否有效
+func (m *Manifest) IsLive(fileID uint32) bool {
+	if fileID >= m.NonMergeFileID {
+		return true
+	}
+	i := sort.Search(len(m.MergedFileIDs), func(i int) bool {
+		return m.MergedFileIDs[i] >= fileID
+	})
+	return i < len(m.MergedFileIDs) && m.MergedFileIDs[i] == fileID
+}
+
+// EncodeManifest 对 Manifest 进行编码
+//
+//	+-------------+------------------+-------------+-----------------------+
+//	| generation  | non merge fileID |    count    |   merged fileIDs ...  |
+//	+-------------+------------------+-------------+-----------------------+
+//	   变长（最大10）      变长（最大5）     变长（最大5）     变长（每个最大5）
+func EncodeManifest(m *Manifest) []byte {
+	buf := make([]byte, binary.MaxVarintLen64+binary.MaxVarintLen32*(2+len(m.MergedFileIDs)))
+	var index = 0
+	index += binary.PutUvarint(buf[index:], m.Generation)
+	index += binary.PutUvarint(buf[index:], uint64(m.NonMergeFileID))
+	index += binary.PutUvarint(buf[index:], uint64(len(m.MergedFileIDs)))
+	for _, fileID := range m.MergedFileIDs {
+		index += binary.PutUvarint(buf[index:], uint64(fileID))
+	}
+	return buf[:index]
+}
+
+// DecodeManifest 解码 Manifest
+func DecodeManifest(buf []byte) (*Manifest, error) {
+	var index = 0
+	readUvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(buf[index:])
+		if n <= 0 {
+			return 0, ErrInvalidManifest
+		}
+		index += n
+		return v, nil
+	}
+	generation, err := readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	nonMergeFileID, err := readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	count, err := readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{
+		Generation:     generation,
+		NonMergeFileID: uint32(nonMergeFileID),
+	}
+	for i := uint64(0); i < count; i++ {
+		fileID, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		m.MergedFileIDs = append(m.MergedFileIDs, uint32(fileID))
+	}
+	return m, nil
+}
+
+// ReadManifest 读取目录中的 Manifest，文件不存在时返回 nil
+func ReadManifest(dirPath string) (*Manifest, error) {
+	value, err := readRecordFile(dirPath, ManifestFileName, manifestKey, ErrInvalidManifest)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	return DecodeManifest(value)
+}
+
+// WriteManifest 原子地替换目录中的 Manifest
+func WriteManifest(dirPath string, m *Manifest) error {
+	return writeRecordFile(dirPath, ManifestFileName, manifestKey, EncodeManifest(m))
+}
+
+// readRecordFile 读取只保存了一条记录的文件，文件不存在时返回 nil，记录的 key 不是 key 时返回 errInvalid
+func readRecordFile(dirPath, name, key string, errInvalid error) ([]byte, error) {
+	fileName := filepath.Join(dirPath, name)
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		return nil, nil
+	}
+	file, err := newReadOnlyDataFile(fileName, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	record, _, err := file.ReadLogRecord(0)
+	if err != nil {
+		return nil, err
+	}
+	if string(record.Key) != key {
+		return nil, errInvalid
+	}
+	return record.Value, nil
+}
+
+// writeRecordFile 原子地替换只保存了一条记录的文件
+// 先写入临时文件并持久化，再重命名为正式文件，最后持久化目录
+func writeRecordFile(dirPath, name, key string, value []byte) error {
+	tmpName := filepath.Join(dirPath, name+".tmp")
+	// 上一次写入失败时可能残留临时文件，文件以追加模式打开，需要先删除
+	if err := os.Remove(tmpName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	file, err := newDataFile(tmpName, 0)
+	if err != nil {
+		return err
+	}
+	encRecord, _ := EncodeLogRecord(&LogRecord{
+		Key:   []byte(key),
+		Value: value,
+	})
+	if err := file.Write(encRecord); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, filepath.Join(dirPath, name)); err != nil {
+		return err
+	}
+	return utils.SyncDir(dirPath)
+}
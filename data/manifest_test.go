@@ -0,0 +1,84 @@
+package data
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncodeManifest(t *testing.T) {
+	m := &Manifest{
+		Generation:     3,
+		NonMergeFileID: 120,
+		MergedFileIDs:  []uint32{100, 101, 102},
+	}
+	res, err := DecodeManifest(EncodeManifest(m))
+	assert.Nil(t, err)
+	assert.Equal(t, m, res)
+
+	// 没有 merge 过的 manifest
+	empty, err := DecodeManifest(EncodeManifest(&Manifest{}))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0), empty.NonMergeFileID)
+	assert.Equal(t, 0, len(empty.MergedFileIDs))
+
+	_, err = DecodeManifest([]byte{0x01})
+	assert.Equal(t, ErrInvalidManifest, err)
+}
+
+func TestManifest_IsLive(t *testing.T) {
+	m := &Manifest{
+		NonMergeFileID: 20,
+		MergedFileIDs:  []uint32{10, 11, 12},
+	}
+	assert.False(t, m.IsLive(0))
+	assert.False(t, m.IsLive(9))
+	assert.True(t, m.IsLive(11))
+	assert.False(t, m.IsLive(13))
+	assert.True(t, m.IsLive(20))
+	assert.True(t, m.IsLive(21))
+}
+
+func TestWriteManifest(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-manifest")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	m, err := ReadManifest(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, m)
+
+	m1 := &Manifest{Generation: 1, NonMergeFileID: 5, MergedFileIDs: []uint32{3, 4}}
+	assert.Nil(t, WriteManifest(dir, m1))
+	m2 := &Manifest{Generation: 2, NonMergeFileID: 9, MergedFileIDs: []uint32{7}}
+	assert.Nil(t, WriteManifest(dir, m2))
+
+	res, err := ReadManifest(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, m2, res)
+	_, err = os.Stat(filepath.Join(dir, ManifestFileName+".tmp"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestWriteIndexType(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bitcask-index-type")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	name, err := ReadIndexType(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, "", name)
+
+	assert.Nil(t, WriteIndexType(dir, "btree"))
+	assert.Nil(t, WriteIndexType(dir, "bptree"))
+	name, err = ReadIndexType(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, "bptree", name)
+
+	// 不是索引类型文件
+	assert.Nil(t, WriteManifest(dir, &Manifest{}))
+	assert.Nil(t, os.Rename(filepath.Join(dir, ManifestFileName), filepath.Join(dir, IndexTypeFileName)))
+	_, err = ReadIndexType(dir)
+	assert.Equal(t, ErrInvalidIndexType, err)
+}
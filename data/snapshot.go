@@ -0,0 +1,223 @@
+package data
+
+import (
+	"bitcask/utils"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	IndexSnapshotFileName = "index-snapshot"
+	indexSnapshotKey      = "index-snapshot"
+	// snapshotReadSize 读取快照文件时每次读取的字节数
+	snapshotReadSize = 1 << 20
+)
+
+var (
+	ErrInvalidIndexSnapshot = errors.New("invalid index snapshot, the file maybe corrupted")
+)
+
+// IndexSnapshot 索引快照覆盖的数据范围
+// 快照文件的第一条记录保存 IndexSnapshot，之后每条记录保存一个 key 和它的位置，
+// 最后一条记录的 key 为空，value 为 key 的数量，用来判断快照是否完整
+type IndexSnapshot struct {
+	Fid        uint32 // 快照包含了这个文件中 Offset 之前的数据，以及之前的所有文件
+	Offset     int64
+	SeqNo      uint64 // 保存快照时的事务序列号
+	Generation uint64 // 保存快照时的 merge 代数，merge 之后快照中的位置失效
+}
+
+func encodeIndexSnapshot(s *IndexSnapshot) []byte {
+	buf := make([]byte, 0, binary.MaxVarintLen32+binary.MaxVarintLen64*3)
+	buf = binary.AppendUvarint(buf, uint64(s.Fid))
+	buf = binary.AppendVarint(buf, s.Offset)
+	buf = binary.AppendUvarint(buf, s.SeqNo)
+	return binary.AppendUvarint(buf, s.Generation)
+}
+
+func decodeIndexSnapshot(buf []byte) (*IndexSnapshot, error) {
+	var values [4]uint64
+	for i := range values {
+		var n int
+		if i == 1 {
+			var v int64
+			v, n = binary.Varint(buf)
+			values[i] = uint64(v)
+		} else {
+			values[i], n = binary.Uvarint(buf)
+		}
+		if n <= 0 {
+			return nil, ErrInvalidIndexSnapshot
+		}
+		buf = buf[n:]
+	}
+	return &IndexSnapshot{
+		Fid:        uint32(values[0]),
+		Offset:     int64(values[1]),
+		SeqNo:      values[2],
+		Generation: values[3],
+	}, nil
+}
+
+// SnapshotWriter 写入索引快照，Close 之后快照才会替换目录中之前的快照
+type SnapshotWriter struct {
+	dirPath string
+	file    *os.File
+	w       *bufio.Writer
+	count   uint64
+}
+
+// NewSnapshotWriter 在临时文件中写入快照
+func NewSnapshotWriter(dirPath string, s *IndexSnapshot) (*SnapshotWriter, error) {
+	file, err := os.Create(filepath.Join(dirPath, IndexSnapshotFileName+".tmp"))
+	if err != nil {
+		return nil, err
+	}
+	sw := &SnapshotWriter{dirPath: dirPath, file: file, w: bufio.NewWriterSize(file, snapshotReadSize)}
+	if err := sw.write([]byte(indexSnapshotKey), encodeIndexSnapshot(s)); err != nil {
+		sw.Abort()
+		return nil, err
+	}
+	return sw, nil
+}
+
+func (sw *SnapshotWriter) write(key, value []byte) error {
+	encRecord, _ := EncodeLogRecord(&LogRecord{Key: key, Value: value})
+	_, err := sw.w.Write(encRecord)
+	return err
+}
+
+// Add 写入一个 key 的位置，key 不能为空
+func (sw *SnapshotWriter) Add(key []byte, pos *LogRecordPos) error {
+	sw.count++
+	return sw.write(key, EncodeLogRecordPos(pos))
+}
+
+// Close 写入结束标识并持久化，之后原子地替换目录中的快照
+func (sw *SnapshotWriter) Close() error {
+	if err := sw.write(nil, binary.AppendUvarint(nil, sw.count)); err != nil {
+		sw.Abort()
+		return err
+	}
+	if err := sw.w.Flush(); err != nil {
+		sw.Abort()
+		return err
+	}
+	if err := sw.file.Sync(); err != nil {
+		sw.Abort()
+		return err
+	}
+	if err := sw.file.Close(); err != nil {
+		_ = os.Remove(sw.file.Name())
+		return err
+	}
+	if err := os.Rename(sw.file.Name(), filepath.Join(sw.dirPath, IndexSnapshotFileName)); err != nil {
+		return err
+	}
+	return utils.SyncDir(sw.dirPath)
+}
+
+// Abort 放弃写入，删除临时文件
+func (sw *SnapshotWriter) Abort() {
+	_ = sw.file.Close()
+	_ = os.Remove(sw.file.Name())
+}
+
+// SnapshotReader 依次读取索引快照中的 key
+type SnapshotReader struct {
+	file     *os.File
+	buf      []byte
+	start    int // buf 中还没有解码的数据的开始位置
+	count    uint64
+	Snapshot *IndexSnapshot
+}
+
+// OpenSnapshotReader 打开目录中的索引快照并读取快照覆盖的数据范围，快照不存在时返回 nil
+func OpenSnapshotReader(dirPath string) (*SnapshotReader, error) {
+	file, err := os.Open(filepath.Join(dirPath, IndexSnapshotFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sr := &SnapshotReader{file: file}
+	record, err := sr.next()
+	if err == nil && string(record.Key) != indexSnapshotKey {
+		err = ErrInvalidIndexSnapshot
+	}
+	if err == nil {
+		sr.Snapshot, err = decodeIndexSnapshot(record.Value)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return sr, nil
+}
+
+// Next 返回下一个 key 和它的位置，读取完所有的 key 之后返回 io.EOF
+// 快照不完整或者校验失败时返回 ErrInvalidIndexSnapshot；返回的 key 之后不会被修改
+func (sr *SnapshotReader) Next() ([]byte, *LogRecordPos, error) {
+	record, err := sr.next()
+	if err == io.EOF {
+		// 没有读取到结束标识
+		return nil, nil, ErrInvalidIndexSnapshot
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(record.Key) == 0 {
+		// 结束标识之后不能再有数据
+		if n, _ := binary.Uvarint(record.Value); n != sr.count {
+			return nil, nil, ErrInvalidIndexSnapshot
+		}
+		if _, err := sr.next(); err != io.EOF {
+			return nil, nil, ErrInvalidIndexSnapshot
+		}
+		return nil, nil, io.EOF
+	}
+	sr.count++
+	return append([]byte(nil), record.Key...), DecodeLogRecordPos(record.Value), nil
+}
+
+// next 解码下一条记录，buf 中的记录不完整时从文件中读取更多的数据
+func (sr *SnapshotReader) next() (*LogRecord, error) {
+	for {
+		record, size, err := decodeLogRecord(sr.buf[sr.start:])
+		if err == nil {
+			sr.start += int(size)
+			return record, nil
+		}
+		if err != errShortBuffer {
+			return nil, ErrInvalidIndexSnapshot
+		}
+		// 没有解码的数据复制到新的内存中，之后追加读取的数据；返回的 key 都是复制的，旧的内存可以被回收
+		rest := sr.buf[sr.start:]
+		buf := make([]byte, len(rest), len(rest)+snapshotReadSize)
+		copy(buf, rest)
+		n, err := io.ReadFull(sr.file, buf[len(rest):cap(buf)])
+		sr.buf, sr.start = buf[:len(rest)+n], 0
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if n > 0 {
+				continue
+			}
+			if len(rest) == 0 {
+				return nil, io.EOF
+			}
+			return nil, ErrInvalidIndexSnapshot
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Close 关闭快照文件
+func (sr *SnapshotReader) Close() error {
+	return sr.file.Close()
+}
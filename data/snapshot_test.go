@@ -0,0 +1,106 @@
+package data
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestSnapshot(t *testing.T, dir string, n int) *IndexSnapshot {
+	s := &IndexSnapshot{Fid: 7, Offset: 1024, SeqNo: 42, Generation: 3}
+	sw, err := NewSnapshotWriter(dir, s)
+	assert.Nil(t, err)
+	for i := 0; i < n; i++ {
+		pos := &LogRecordPos{Fid: uint32(i % 8), Offset: int64(i * 100), Size: 100}
+		assert.Nil(t, sw.Add([]byte(fmt.Sprintf("key-%09d", i)), pos))
+	}
+	assert.Nil(t, sw.Close())
+	return s
+}
+
+func readTestSnapshot(dir string) (int, error) {
+	sr, err := OpenSnapshotReader(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer sr.Close()
+	count := 0
+	for {
+		_, _, err := sr.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+func TestIndexSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	sr, err := OpenSnapshotReader(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, sr)
+
+	// 快照大于一次读取的大小
+	n := 60000
+	s := writeTestSnapshot(t, dir, n)
+	_, err = os.Stat(filepath.Join(dir, IndexSnapshotFileName+".tmp"))
+	assert.True(t, os.IsNotExist(err))
+
+	sr, err = OpenSnapshotReader(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, s, sr.Snapshot)
+	for i := 0; i < n; i++ {
+		key, pos, err := sr.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("key-%09d", i), string(key))
+		assert.Equal(t, &LogRecordPos{Fid: uint32(i % 8), Offset: int64(i * 100), Size: 100}, pos)
+	}
+	_, _, err = sr.Next()
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, sr.Close())
+}
+
+func TestIndexSnapshot_Corrupted(t *testing.T) {
+	dir := t.TempDir()
+	writeTestSnapshot(t, dir, 100)
+	fileName := filepath.Join(dir, IndexSnapshotFileName)
+	content, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+
+	// 截断之后缺少结束标识
+	assert.Nil(t, os.WriteFile(fileName, content[:len(content)-3], 0644))
+	_, err = readTestSnapshot(dir)
+	assert.Equal(t, ErrInvalidIndexSnapshot, err)
+	trailer, _ := EncodeLogRecord(&LogRecord{Value: []byte{100}})
+	assert.Nil(t, os.WriteFile(fileName, content[:len(content)-len(trailer)], 0644))
+	_, err = readTestSnapshot(dir)
+	assert.Equal(t, ErrInvalidIndexSnapshot, err)
+
+	// 数据被修改
+	corrupted := append([]byte(nil), content...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, corrupted, 0644))
+	_, err = readTestSnapshot(dir)
+	assert.Equal(t, ErrInvalidIndexSnapshot, err)
+
+	// 结束标识之后还有数据
+	assert.Nil(t, os.WriteFile(fileName, append(content, content[:20]...), 0644))
+	_, err = readTestSnapshot(dir)
+	assert.Equal(t, ErrInvalidIndexSnapshot, err)
+
+	// 没有快照信息的文件
+	assert.Nil(t, os.WriteFile(fileName, trailer, 0644))
+	_, err = OpenSnapshotReader(dir)
+	assert.Equal(t, ErrInvalidIndexSnapshot, err)
+
+	assert.Nil(t, os.WriteFile(fileName, content, 0644))
+	count, err := readTestSnapshot(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, count)
+}
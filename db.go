@@ -2,8 +2,10 @@ package bitcask
 
 import (
 	"bitcask/data"
+	"bitcask/fio"
 	"bitcask/index"
 	"bitcask/utils"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -13,6 +15,8 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const seqNoKey = "seq.no"
@@ -20,24 +24,47 @@ const seqNoKey = "seq.no"
 // DB bitcask 存储引擎实例
 // 实例各种资源 活跃文件，旧文件
 type DB struct {
-	cfg            DBConfig                  // 配置项
-	mu             *sync.RWMutex             // 互斥锁
-	fileIDs        []int                     // 文件id只能用于加载文件索引时使用，不能在其他地方使用
-	activeFile     *data.DataFile            // 活跃文件 用于写入
-	oldFile        map[uint32]*data.DataFile // 旧数据文件，只用于读出
-	index          index.Indexer             // 内存索引
-	seqNo          uint64                    // 序列号
-	isMerging      bool                      //是否正在merge
-	seqNoFileExist bool                      // 存储事务序列号的文件是否存在
-	isInitiated    bool                      // 是否是第一次初始化数据目录
+	cfg            DBConfig                             // 配置项
+	mu             *rwLock                              // 互斥锁
+	fileIDs        []int                                // 文件id只能用于加载文件索引时使用，不能在其他地方使用
+	activeFile     *data.DataFile                       // 活跃文件 用于写入
+	oldFile        map[uint32]*data.DataFile            // 旧数据文件，只用于读出
+	fileCache      *fio.FileCache                       // 限制同时打开的数据文件数量
+	generation     atomic.Pointer[fileGeneration]       // 当前可以读取的数据文件集合，读取时不需要持有锁
+	manifest       *data.Manifest                       // 当前有效的数据文件集合
+	deadBytes      deadBytes                            // 每个数据文件中可以被 merge 回收的数据量
+	keyLocks       keyLocks                             // 按 key 分片的写入锁
+	indexing       sync.RWMutex                         // 释放写锁之后正在更新索引的写入持有读锁
+	metrics        *metrics                             // 运行指标
+	syncedOff      int64                                // 活跃文件中已经持久化的偏移
+	index          index.Indexer                        // 内存索引
+	seqNo          uint64                               // 序列号
+	isMerging      bool                                 //是否正在merge
+	needCheckpoint bool                                 // 切换了活跃文件，需要记录新的 b+树索引检查点
+	hintBuf        []byte                               // 活跃文件中记录的 hint，切换活跃文件时写入 hint 文件
+	hintOff        int64                                // hintBuf 覆盖的活跃文件的长度
+	readOnly       bool                                 // 是否以只读模式打开
+	txnRecords     map[uint64][]*data.TransactionRecord // 只读模式下还没有读取到提交标识的事务数据
+	closed         atomic.Bool                          // 是否已经关闭，持有写锁时修改
+	merges         sync.WaitGroup                       // 正在进行的 merge，关闭时等待其完成
+	loading        atomic.Pointer[indexLoading]         // 后台加载索引的状态，没有使用后台加载时为空
 }
 
 // Stat 存储引擎统计信息
 type Stat struct {
-	KeyNum          uint  // key 的总数量
-	DataFileNum     uint  // 数据文件的数量
-	ReclaimableSize int64 // 可以进行 merge 回收的数据量，字节为单位
-	DiskSize        int64 // 数据目录所占磁盘空间大小
+	KeyNum          uint           // key 的总数量
+	DataFileNum     uint           // 数据文件的数量
+	ReclaimableSize int64          // 可以进行 merge 回收的数据量，字节为单位
+	DiskSize        int64          // 数据目录所占磁盘空间大小
+	DataFiles       []DataFileStat // 每个数据文件的统计信息，按文件编号从小到大排列
+}
+
+// DataFileStat 单个数据文件的统计信息
+type DataFileStat struct {
+	FileID    uint32 // 文件 id
+	Size      int64  // 文件大小
+	LiveBytes int64  // 仍被索引引用的数据量
+	DeadBytes int64  // 已经被覆盖或删除，可以被 merge 回收的数据量
 }
 
 // Open 打开bitcask存储引擎示例
@@ -47,68 +74,116 @@ func Open(cfg DBConfig) (*DB, error) {
 	if err := checkConfig(cfg); err != nil {
 		return nil, err
 	}
-	var isInitiated bool
 	// 判断数据目录是否存在，如果不存在则需要创建
 	if _, err := os.Stat(cfg.DirPath); os.IsNotExist(err) {
-		isInitiated = true
 		//os.ModePerm 默认权限，允许所有用户读写
 		if err := os.MkdirAll(cfg.DirPath, os.ModePerm); err != nil {
 			return nil, err
 		}
 	}
-	dir, err := os.ReadDir(cfg.DirPath)
+	//初试化DB实例
+	db := &DB{
+		cfg:       cfg,
+		mu:        new(rwLock),
+		oldFile:   make(map[uint32]*data.DataFile),
+		fileCache: fio.NewFileCache(cfg.MaxOpenFiles),
+		metrics:   newMetrics(),
+	}
+	// 切换了索引类型时删除失效的 b+树索引文件
+	if err := db.checkIndexType(); err != nil {
+		return nil, err
+	}
+	var err error
+	if db.index, err = db.newIndexer(cfg.SyncWrite); err != nil {
+		return nil, err
+	}
+	if err = db.load(); err == nil {
+		err = db.saveIndexType()
+	}
 	if err != nil {
+		// 释放已经打开的索引和数据文件，b+树索引的文件锁释放之后才能重新打开
+		_ = db.closeResources()
 		return nil, err
 	}
-	if len(dir) == 0 {
-		isInitiated = true
+	if l := db.loading.Load(); l != nil {
+		go db.loadInBackground(l)
 	}
-	//初试化DB实例
-	db := &DB{
-		cfg:         cfg,
-		mu:          new(sync.RWMutex),
-		oldFile:     make(map[uint32]*data.DataFile),
-		index:       index.NewIndexer(cfg.IndexType, cfg.DirPath, cfg.SyncWrite),
-		isInitiated: isInitiated,
+	return db, nil
+}
+
+// newIndexer 根据配置创建索引，配置了 IndexFactory 时使用自定义实现
+func (db *DB) newIndexer(sync bool) (index.Indexer, error) {
+	if db.cfg.IndexFactory != nil {
+		return db.cfg.IndexFactory(db.cfg.DirPath, sync)
 	}
+	return index.NewIndexer(db.cfg.IndexType, db.cfg.DirPath, sync)
+}
+
+// isBPTreeIndex 是否使用持久化到磁盘的 b+树索引
+func (db *DB) isBPTreeIndex() bool {
+	return db.cfg.IndexFactory == nil && db.cfg.IndexType == BPTree
+}
+
+// load 加载数据文件并构建索引
+func (db *DB) load() error {
 	// 加载merge目录
 	if err := db.loadMergeFile(); err != nil {
-		return nil, err
+		return err
 	}
 	//加载数据文件
 	if err := db.loadDataFiles(); err != nil {
-		return nil, err
+		return err
 	}
+	db.releaseGeneration(db.swapGeneration())
 	// b+树索引不需要从数据文件中加载索引
-	if cfg.IndexType != BPTree {
-		//从hint文件中加载索引（如果有的话）
-		if err := db.loadIndexFromHintFile(); err != nil {
-			return nil, err
+	if !db.isBPTreeIndex() {
+		if db.cfg.BackgroundLoad {
+			// Open 返回之后在后台加载索引，加载完成之后统计有效数据量
+			db.prepareBackgroundLoad()
+			if db.activeFile != nil {
+				db.syncedOff = db.activeFile.WriteOff
+			}
+			return nil
 		}
-		//从数据文件中加载索引
-		if err := db.loadIndexFromFiles(); err != nil {
-			return nil, err
+		// 从索引快照或者 hint 文件和数据文件中加载索引
+		if err := db.loadIndex(); err != nil {
+			return err
 		}
-	} else { //取出当前事务序列号
+	} else { //取出旧版本保存的事务序列号
 		if err := db.loadSeqNo(); err != nil {
-			return nil, err
+			return err
+		}
+		// 从检查点开始重放数据文件，恢复崩溃时没有持久化到索引中的修改，事务序列号保存在检查点中
+		if err := db.recoverIndex(); err != nil {
+			return err
 		}
 		if db.activeFile != nil {
-			size, err := db.activeFile.IoManager.Size()
-			if err != nil {
-				return nil, err
+			if err := os.Remove(filepath.Join(db.cfg.DirPath, data.SeqNoFileName)); err != nil && !os.IsNotExist(err) {
+				return err
 			}
-			db.activeFile.WriteOff = size
 		}
-
 	}
-
-	return db, nil
-
+	// 根据索引统计每个数据文件中的有效数据量
+	if err := db.loadDeadBytes(); err != nil {
+		return err
+	}
+	if db.activeFile != nil {
+		db.syncedOff = db.activeFile.WriteOff
+	}
+	return nil
 }
 
 // Put 写入数据 key 不能为空
 func (db *DB) Put(key []byte, value []byte) error {
+	return db.PutContext(context.Background(), key, value)
+}
+
+// PutContext 写入数据，ctx 取消或者超时之后不再等待获取锁
+func (db *DB) PutContext(ctx context.Context, key []byte, value []byte) error {
+	defer db.metrics.putLatency.observeSince(time.Now())
+	if db.readOnly {
+		return ErrReadOnly
+	}
 	// key 不能为空
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
@@ -119,19 +194,83 @@ func (db *DB) Put(key []byte, value []byte) error {
 		Value: value,
 		Type:  data.LogRecordNormal,
 	}
+	keyLock, err := db.keyLocks.lock(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer keyLock.Unlock()
+	if err := db.lockContext(ctx); err != nil {
+		return err
+	}
+	if err := db.checkWritable(); err != nil {
+		db.mu.Unlock()
+		return err
+	}
 	//追加到当前活跃文件中
-	pos, err := db.appendLogRecordWithLock(logRecord)
+	pos, err := db.appendLogRecord(logRecord)
 	if err != nil {
+		db.mu.Unlock()
 		return err
 	}
-	//更新内存索引
-	if !db.index.Put(key, pos) {
-		//索引更新失败
-		return ErrIndexUpdateFailed
+	//更新内存索引，旧的数据变为无效数据
+	return db.unlockAndIndex(key, func() error {
+		oldPos, err := db.index.Get(key)
+		if err != nil {
+			return err
+		}
+		db.markDead(oldPos)
+		if err := db.index.Put(key, pos); err != nil {
+			//索引更新失败
+			return fmt.Errorf("%w: %w", ErrIndexUpdateFailed, err)
+		}
+		return nil
+	})
+}
+
+// checkWritable 持有写锁之后检查是否可以写入
+func (db *DB) checkWritable() error {
+	if db.closed.Load() {
+		return ErrDBClosed
+	}
+	return db.loadError()
+}
+
+// unlockAndIndex 追加写入之后释放写锁并调用 update 更新索引，调用时需要持有写锁和 key 所在分片的锁
+// 后台加载期间和加载互斥，持有写锁更新索引；需要完整索引的操作持有写锁之后调用 waitIndexUpdates 等待更新完成
+func (db *DB) unlockAndIndex(key []byte, update func() error) error {
+	if db.loadingIndex() != nil {
+		defer db.mu.Unlock()
+		if err := update(); err != nil {
+			return err
+		}
+		db.markWritten(key)
+		db.maybeCheckpointIndex()
+		return nil
+	}
+	checkpoint := db.needCheckpoint
+	db.indexing.RLock()
+	db.mu.Unlock()
+	err := update()
+	db.indexing.RUnlock()
+	if err != nil {
+		return err
+	}
+	// 切换了活跃文件，这次写入更新完索引之后记录新的检查点
+	if checkpoint {
+		db.mu.Lock()
+		db.maybeCheckpointIndex()
+		db.mu.Unlock()
 	}
 	return nil
 }
 
+// waitIndexUpdates 等待已经追加到数据文件中的写入更新完索引，需要持有写锁
+func (db *DB) waitIndexUpdates() {
+	// 新的写入需要先获取写锁，获取到 indexing 的写锁时之前的写入都已经更新完索引
+	db.indexing.Lock()
+	db.indexing.Unlock()
+}
+
 // appendLogRecord 追加写入到活跃的文件中
 // 返回数据的索引信息，内存索引会去存放这个数据
 func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
@@ -148,9 +287,10 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 	if db.activeFile.WriteOff+size > db.cfg.DataFileSize {
 		//将当前文件持久化,保证已有的数据保存到磁盘
 
-		if err := db.activeFile.Sync(); err != nil {
+		if err := db.syncActiveFile(); err != nil {
 			return nil, err
 		}
+		db.writeHintFile()
 		//持久化之后，将当前的活跃文件转化为旧文件
 		db.oldFile[db.activeFile.FileID] = db.activeFile
 		//打开新的数据文件
@@ -158,6 +298,9 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 		if err := db.setActiveFile(); err != nil {
 			return nil, err
 		}
+		db.metrics.fileRotations.Add(1)
+		// 之前的文件已经持久化，当前的写入更新完索引之后记录新的 b+树索引检查点
+		db.needCheckpoint = db.isBPTreeIndex()
 	}
 	// 记录当前文件offset
 	offset := db.activeFile.WriteOff
@@ -166,18 +309,23 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 	if err := db.activeFile.Write(encRecord); err != nil {
 		return nil, err
 	}
+	db.metrics.bytesWritten.Add(size)
+	pos := &data.LogRecordPos{
+		Fid:    db.activeFile.FileID,
+		Offset: offset,
+		Size:   uint32(size),
+	}
+	if offset == db.hintOff {
+		db.appendHint(logRecord, pos)
+	}
 	//每次写入之后是否要对数据进行持久化，提升安全性，但是性能会下降
 	if db.cfg.SyncWrite {
 
-		if err := db.activeFile.Sync(); err != nil {
+		if err := db.syncActiveFile(); err != nil {
 			return nil, err
 		}
 	}
 	//构造内存索引信息并返回
-	pos := &data.LogRecordPos{
-		Fid:    db.activeFile.FileID,
-		Offset: offset,
-	}
 	return pos, nil
 }
 
@@ -197,40 +345,109 @@ func (db *DB) setActiveFile() error {
 	if db.activeFile != nil {
 		initialFileId = db.activeFile.FileID + 1
 	}
-	// 打开新的活跃文件
-	file, err := data.OpenDataFile(db.cfg.DirPath, initialFileId)
+	return db.setActiveFileWithID(initialFileId)
+}
+
+// setActiveFileWithID 使用指定的文件编号打开新的活跃文件
+func (db *DB) setActiveFileWithID(fileID uint32) error {
+	// 打开新的活跃文件，活跃文件一直保持打开，之前的活跃文件可以被关闭
+	file, err := data.OpenCachedDataFile(db.cfg.DirPath, fileID, db.fileCache)
 	if err != nil {
 		return err
 	}
+	if err := file.Pin(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if db.activeFile != nil {
+		db.activeFile.Unpin()
+	}
 	db.activeFile = file
+	db.syncedOff = 0
+	db.hintBuf, db.hintOff = nil, 0
+	// 发布包含新的活跃文件的文件集合，读取新写入的数据之前一定可以看到这个文件
+	db.releaseGeneration(db.swapGeneration())
+	return nil
+}
+
+// syncActiveFile 持久化活跃文件，并记录耗时和持久化的数据量
+func (db *DB) syncActiveFile() error {
+	start := time.Now()
+	if err := db.activeFile.Sync(); err != nil {
+		return err
+	}
+	db.metrics.syncLatency.observeSince(start)
+	db.metrics.bytesSynced.Add(db.activeFile.WriteOff - db.syncedOff)
+	db.syncedOff = db.activeFile.WriteOff
 	return nil
 }
 
 // Get 根据key获取数据
 func (db *DB) Get(key []byte) ([]byte, error) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
+	return db.GetContext(context.Background(), key)
+}
+
+// GetContext 根据key获取数据，ctx 取消之后直接返回
+// 读取不需要持有数据库的锁，文件集合的引用保证读取期间文件不会被 merge 关闭
+func (db *DB) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	defer db.metrics.getLatency.observeSince(time.Now())
 	// key 不能为空
 	if len(key) == 0 {
 		return nil, ErrKeyIsEmpty
 	}
-	//从内存中取出key对应的索引信息
-	pos := db.index.Get(key)
-	if pos == nil {
-		return nil, ErrKeyNotFound
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for {
+		// 先获取文件集合再查找索引，索引中的位置只会指向这个集合或者之后发布的集合中的文件
+		gen := db.acquireGeneration()
+		if gen == nil {
+			return nil, ErrDBClosed
+		}
+		if l := db.loadingIndex(); l != nil {
+			if err := l.failed(); err != nil {
+				db.releaseGeneration(gen)
+				return nil, err
+			}
+			// 后台加载完成之前，打开之后没有写入过的 key 从数据文件中查找，查找次数用完之后等待加载完成
+			if !db.writtenWhileLoading(key) {
+				if l.scans.Add(-1) < 0 {
+					db.releaseGeneration(gen)
+					if err := db.WaitReady(ctx); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				value, err := db.scanValue(gen, l, key)
+				db.releaseGeneration(gen)
+				return value, err
+			}
+		}
+		//从内存中取出key对应的索引信息
+		pos, err := gen.index.Get(key)
+		if err != nil {
+			db.releaseGeneration(gen)
+			return nil, err
+		}
+		if pos == nil {
+			db.releaseGeneration(gen)
+			return nil, ErrKeyNotFound
+		}
+		value, err := db.getValueFromGeneration(gen, pos)
+		db.releaseGeneration(gen)
+		// 获取文件集合之后发生了文件切换或者 merge，使用新的文件集合重试
+		if err == ErrDataFileNotFound && gen != db.generation.Load() {
+			continue
+		}
+		return value, err
 	}
-
-	return db.getValueByPosition(pos)
 }
-func (db *DB) getValueByPosition(pos *data.LogRecordPos) ([]byte, error) {
+
+// getValueFromGeneration 从指定的文件集合中读取数据
+// 迭代器的索引位置可能指向已经被 merge 替换的文件，需要从其持有的文件集合中读取
+func (db *DB) getValueFromGeneration(gen *fileGeneration, pos *data.LogRecordPos) ([]byte, error) {
 	//根据文件id找到对应的文件
-	var dataFile *data.DataFile
-	if db.activeFile.FileID == pos.Fid {
-		dataFile = db.activeFile
-	} else {
-		//活跃文件中没有找旧文件
-		dataFile = db.oldFile[pos.Fid]
-	}
+	dataFile := gen.files[pos.Fid]
 	//数据文件为空
 	if dataFile == nil {
 		return nil, ErrDataFileNotFound
@@ -238,6 +455,7 @@ func (db *DB) getValueByPosition(pos *data.LogRecordPos) ([]byte, error) {
 	//根据偏移读取数据
 	record, _, err := dataFile.ReadLogRecord(pos.Offset)
 	if err != nil {
+		db.metrics.observeReadError(err)
 		return nil, err
 	}
 	//判断是否是被删除的
@@ -255,43 +473,58 @@ func checkConfig(cfg DBConfig) error {
 	if cfg.DataFileSize <= 0 {
 		return errors.New("database data file size must be greater than 0")
 	}
+	if cfg.MaxOpenFiles < 0 {
+		return errors.New("database max open files must not be negative")
+	}
+	if cfg.LoadConcurrency < 0 {
+		return errors.New("database load concurrency must not be negative")
+	}
 
 	return nil
 }
 
 // loadDataFiles 从磁盘中加载文件
+// 只加载 manifest 中记录的有效文件，已经被 merge 替换的文件直接删除
 func (db *DB) loadDataFiles() error {
-	//根据配置项读取目录
-	dir, err := os.ReadDir(db.cfg.DirPath)
+	allFileIds, err := db.listDataFileIDs()
 	if err != nil {
 		return err
 	}
 	var fileIds []int
-	// 遍历目录中的所有文件,找到所有以.data结尾的文件
-	for _, entry := range dir {
-		if strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
-			//分割文件名称,取出文件ID
-			split := strings.Split(entry.Name(), ".")
-			fileID, err := strconv.Atoi(split[0])
-			// 数据目录可能已经损坏了
-			if err != nil {
-				return ErrDataDirectoryCorrupted
-			}
-			fileIds = append(fileIds, fileID)
-
+	for _, fid := range allFileIds {
+		if db.manifest.IsLive(uint32(fid)) {
+			fileIds = append(fileIds, fid)
+			continue
+		}
+		// 只读模式下由写入进程负责删除
+		if db.readOnly {
+			continue
+		}
+		if err := db.removeDataFile(uint32(fid)); err != nil {
+			return err
+		}
+	}
+	if !db.readOnly {
+		if err := db.removeStaleHintFiles(fileIds); err != nil {
+			return err
 		}
 	}
-	//依次加载数据文件
-	sort.Ints(fileIds)
 	db.fileIDs = fileIds
 	//遍历每个文件ID，打开对应的数据文件
 	for i, fid := range fileIds {
-		file, err := data.OpenDataFile(db.cfg.DirPath, uint32(fid))
+		file, err := data.OpenCachedDataFile(db.cfg.DirPath, uint32(fid), db.fileCache)
 		if err != nil {
 			return err
 		}
+		// 旧文件不会再写入，偏移即为文件大小
+		if file.WriteOff, err = file.IoManager.Size(); err != nil {
+			return err
+		}
 		//最后的一个也就是最新的一个是活跃文件
 		if i == len(fileIds)-1 {
+			if err := file.Pin(); err != nil {
+				return err
+			}
 			db.activeFile = file
 		} else { //其他的也就是旧文件
 			db.oldFile[uint32(fid)] = file
@@ -300,113 +533,165 @@ func (db *DB) loadDataFiles() error {
 	return nil
 }
 
+// listDataFileIDs 从小到大列出数据目录中所有数据文件的编号
+func (db *DB) listDataFileIDs() ([]int, error) {
+	//根据配置项读取目录
+	dir, err := os.ReadDir(db.cfg.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	var fileIds []int
+	// 遍历目录中的所有文件,找到所有以.data结尾的文件
+	for _, entry := range dir {
+		if strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+			//分割文件名称,取出文件ID
+			split := strings.Split(entry.Name(), ".")
+			fileID, err := strconv.Atoi(split[0])
+			// 数据目录可能已经损坏了
+			if err != nil {
+				return nil, ErrDataDirectoryCorrupted
+			}
+			fileIds = append(fileIds, fileID)
+
+		}
+	}
+	sort.Ints(fileIds)
+	return fileIds, nil
+}
+
 // loadIndexFromFiles 从数据文件中加载索引
 // 遍历文件中的所有记录，并更新到内存索引中
 func (db *DB) loadIndexFromFiles() error {
+	// 暂存事务数据
+	db.txnRecords = make(map[uint64][]*data.TransactionRecord)
 	//长度为0说明数据库为空
 	if len(db.fileIDs) == 0 {
 		return nil
 	}
-	// 从hint文件中已经加载过了
-	hasMerge, nonMergeFileID := false, uint32(0)
-	fileName := filepath.Join(db.cfg.DirPath, data.MergeFinishedFileName)
-	if _, err := os.Stat(fileName); err == nil {
-		fileID, err := db.getNonMergeFileID(db.cfg.DirPath)
-		if err != nil {
+	// merge 生成的文件已经从hint文件中加载过了
+	loads := db.fileLoadsFrom(db.manifest.NonMergeFileID, 0)
+	err := db.loadIndexFromFileLoads(loads, func(load fileLoad, end int64, err error) error {
+		if err != nil && !db.isIncompleteTail(load.dataFile, err) {
 			return err
 		}
-		hasMerge = true
-		nonMergeFileID = fileID
+		//如果当前是活跃文件，更新活跃文件的偏移，后台加载时活跃文件已经开始写入
+		if load.dataFile == db.activeFile && db.loadingIndex() == nil {
+			db.activeFile.WriteOff = end
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// 只读模式下没有提交的事务可能在之后的 Refresh 中读取到提交标识
+	if !db.readOnly {
+		db.txnRecords = nil
 	}
+	return nil
+}
 
-	updateIndex := func(key []byte, ty data.LogRecordType, pos *data.LogRecordPos) {
-		var ok bool
-		if ty == data.LogRecordDeleted {
-			ok = db.index.Delete(key)
-		} else {
-			ok = db.index.Put(key, pos)
+// loadIndexFromFile 从 offset 开始读取数据文件中的记录并更新索引
+// 返回最后一条完整读取的记录的结束位置
+func (db *DB) loadIndexFromFile(dataFile *data.DataFile, offset int64) (int64, error) {
+	size, err := dataFile.IoManager.Size()
+	if err != nil {
+		return offset, err
+	}
+	end, readErr := offset, error(nil)
+	var applyErr error
+	db.readFileLoad(fileLoad{dataFile: dataFile, offset: offset, size: size}, func(chunk *loadedFile) bool {
+		end, readErr = chunk.end, chunk.err
+		applyErr = db.applyLoadedFile(dataFile, chunk)
+		return applyErr == nil
+	})
+	if applyErr != nil {
+		return offset, applyErr
+	}
+	return end, readErr
+}
+
+// indexLogRecord 根据数据文件中的一条记录更新索引，事务的数据在读取到提交标识之后才更新
+// 修改通过 w 写入索引，调用方可以把多条记录合并到一次批量操作中
+func (db *DB) indexLogRecord(w index.BatchWriter, record *data.LogRecord, pos *data.LogRecordPos) error {
+	updateIndex := func(key []byte, ty data.LogRecordType, pos *data.LogRecordPos) error {
+		// 后台加载期间写入过的 key 在索引中已经是最新的位置
+		if db.isWritten(key) {
+			return nil
 		}
-		if !ok {
-			panic("failed to update index at startup")
+		if ty == data.LogRecordDeleted {
+			// key 对应的数据可能已经被 merge 清理了，删除不存在的 key 不是错误
+			_, err := w.Delete(key)
+			return err
 		}
+		return w.Put(key, pos)
 	}
-	// 暂存事务数据
-	transactionRecords := make(map[uint64][]*data.TransactionRecord)
-	var currentSeqNo = nonTransactionSeqNo
-
-	//遍历文件id，处理文件中的记录
-	for i, fid := range db.fileIDs {
-		var fileID = uint32(fid)
-		// 从hint文件加载过了，不需要重新加载
-		if hasMerge && fileID == nonMergeFileID {
-			continue
+	// 解析key，拿到事务序列号
+	realKey, seqNo := parseLogRecordKey(record.Key)
+	if seqNo == nonTransactionSeqNo {
+		// 非事务提交，直接更新内存索引
+		if err := updateIndex(realKey, record.Type, pos); err != nil {
+			return fmt.Errorf("%w: %w", ErrIndexUpdateFailed, err)
 		}
-		var dataFile *data.DataFile
-		if fileID == db.activeFile.FileID {
-			dataFile = db.activeFile
-		} else {
-			dataFile = db.oldFile[fileID]
-		}
-		var offset int64 = 0
-		for {
-			record, size, err := dataFile.ReadLogRecord(offset)
-			if err != nil {
-				//说明文件读取完成
-				if err == io.EOF {
-					break
-				}
-				return err
-			}
-			//构建内存索引并保存
-			pos := &data.LogRecordPos{
-				Fid:    fileID,
-				Offset: offset,
-			}
-			// 解析key，拿到事务序列号
-			realKey, seqNo := parseLogRecordKey(record.Key)
-			if seqNo == nonTransactionSeqNo {
-				// 非事务提交，直接更新内存索引
-				updateIndex(realKey, record.Type, pos)
-			} else {
-				//事务提交
-				// 事务完成后，更新到内存
-				if record.Type == data.LogRecordTxnFinished {
-					for _, txnRecord := range transactionRecords[seqNo] {
-						updateIndex(txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos)
-					}
-					delete(transactionRecords, seqNo)
-				} else {
-					record.Key = realKey
-					transactionRecords[seqNo] = append(transactionRecords[seqNo], &data.TransactionRecord{
-						Record: record,
-						Pos:    pos,
-					})
+	} else {
+		//事务提交
+		// 事务完成后，更新到内存
+		if record.Type == data.LogRecordTxnFinished {
+			for _, txnRecord := range db.txnRecords[seqNo] {
+				if err := updateIndex(txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos); err != nil {
+					return fmt.Errorf("%w: %w", ErrIndexUpdateFailed, err)
 				}
 			}
-			// 更新事务序列号
-			if seqNo > currentSeqNo {
-				currentSeqNo = seqNo
-			}
-			//递增offset
-			offset += size
-		}
-		//如果当前是活跃文件，更新活跃文件的偏移
-		if i == len(db.fileIDs)-1 {
-			db.activeFile.WriteOff = offset
+			delete(db.txnRecords, seqNo)
+		} else {
+			record.Key = realKey
+			db.txnRecords[seqNo] = append(db.txnRecords[seqNo], &data.TransactionRecord{
+				Record: record,
+				Pos:    pos,
+			})
 		}
 	}
-	//更新事务序列号
-	db.seqNo = currentSeqNo
+	// 更新事务序列号
+	if seqNo > db.seqNo {
+		db.seqNo = seqNo
+	}
 	return nil
 }
 
 // Delete 先写入到磁盘，之后再从内存索引中删除key
 func (db *DB) Delete(key []byte) error {
+	return db.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext 删除key，ctx 取消或者超时之后不再等待获取锁
+func (db *DB) DeleteContext(ctx context.Context, key []byte) error {
+	defer db.metrics.deleteLatency.observeSince(time.Now())
+	if db.readOnly {
+		return ErrReadOnly
+	}
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	keyLock, err := db.keyLocks.lock(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer keyLock.Unlock()
+	if err := db.lockContext(ctx); err != nil {
+		return err
+	}
+	if err := db.checkWritable(); err != nil {
+		db.mu.Unlock()
+		return err
+	}
 	//从内存索引查找key
-	if pod := db.index.Get(key); pod == nil {
+	oldPos, err := db.index.Get(key)
+	if err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	// 后台加载完成之前索引中没有 key 不代表数据文件中没有
+	if oldPos == nil && db.loadingIndex() == nil {
+		db.mu.Unlock()
 		return nil
 	}
 	//构造logRecord信息，标记删除信息
@@ -415,39 +700,72 @@ func (db *DB) Delete(key []byte) error {
 		Key:  logRecordKeyWriteWithSeq(key, nonTransactionSeqNo),
 	}
 	//写入到数据文件中
-	_, err := db.appendLogRecordWithLock(logRecord)
+	pos, err := db.appendLogRecord(logRecord)
 	if err != nil {
+		db.mu.Unlock()
 		return err
 	}
-	//删除内存索引中的key
-	if !db.index.Delete(key) {
-		return ErrIndexUpdateFailed
-	}
-	return nil
+	return db.unlockAndIndex(key, func() error {
+		// 释放写锁之后 merge 可能已经更新了 key 的位置，重新查找被删除的数据
+		oldPos, err := db.index.Get(key)
+		if err != nil {
+			return err
+		}
+		// 删除标记本身和被删除的数据都是无效数据
+		db.markDead(pos)
+		db.markDead(oldPos)
+		//删除内存索引中的key
+		if _, err := db.index.Delete(key); err != nil {
+			return fmt.Errorf("%w: %w", ErrIndexUpdateFailed, err)
+		}
+		return nil
+	})
 }
 
 // ListKeys returns a list of keys in the database.
-func (db *DB) ListKeys() [][]byte {
-	db.mu.RLock()
+// It returns ErrDBClosed after the database is closed.
+func (db *DB) ListKeys() ([][]byte, error) {
+	return db.ListKeysContext(context.Background())
+}
+
+// ListKeysContext returns a list of keys in the database.
+// It stops and returns the context error once ctx is cancelled.
+func (db *DB) ListKeysContext(ctx context.Context) ([][]byte, error) {
+	if err := db.WaitReady(ctx); err != nil {
+		return nil, err
+	}
+	if err := db.rLockContext(ctx); err != nil {
+		return nil, err
+	}
 	defer db.mu.RUnlock()
+	if db.closed.Load() {
+		return nil, ErrDBClosed
+	}
 	// Get an iterator for the index.
-	iterator := db.index.Iterator(false)
+	iterator, err := db.index.Iterator(false)
+	if err != nil {
+		return nil, err
+	}
 	defer iterator.Close()
 	// Create a slice to store the keys.
-	keys := make([][]byte, db.index.Size())
-
-	// Initialize the index of the keys slice.
-	var idx int
+	// 索引在释放锁之后更新，Size 和迭代器的快照可能不是同一时刻的，只用来预估容量
+	size, err := db.index.Size()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([][]byte, 0, size)
 
 	// Iterate over the index using the iterator.
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
-		// Get the key from the iterator and store it in the keys slice.
-		keys[idx] = iterator.Key()
-		idx++
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		// Get the key from the iterator and append it to the keys slice.
+		keys = append(keys, iterator.Key())
 	}
 
 	// Return the keys slice.
-	return keys
+	return keys, nil
 }
 
 // Fold 获取所有的数据并执行指定的操作
@@ -457,21 +775,45 @@ func (db *DB) ListKeys() [][]byte {
 // The function must be safe for concurrent access.
 // The Fold function returns an error if there is a problem iterating over the database.
 func (db *DB) Fold(fn func(key, value []byte) bool) error {
-	// Acquire a read lock on the database.
-	db.mu.RLock()
-	defer db.mu.RUnlock()
+	return db.FoldContext(context.Background(), fn)
+}
 
+// FoldContext is like Fold, but stops and returns the context error once ctx is cancelled.
+// The read lock is only held while the index iterator and the data files are captured,
+// so writers are not blocked by the disk reads.
+func (db *DB) FoldContext(ctx context.Context, fn func(key, value []byte) bool) error {
+	if err := db.WaitReady(ctx); err != nil {
+		return err
+	}
+	// Acquire a read lock on the database.
+	if err := db.rLockContext(ctx); err != nil {
+		return err
+	}
+	if db.closed.Load() {
+		db.mu.RUnlock()
+		return ErrDBClosed
+	}
 	// Get an iterator for the index.
-	iterator := db.index.Iterator(false)
+	iterator, err := db.index.Iterator(false)
+	if err != nil {
+		db.mu.RUnlock()
+		return err
+	}
+	gen := db.acquireGeneration()
+	db.mu.RUnlock()
 	defer iterator.Close()
+	defer db.releaseGeneration(gen)
 
 	// Iterate over the index using the iterator.
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		// Get the key from the iterator.
 		key := iterator.Key()
 
 		// Get the value for the key from the database.
-		value, err := db.getValueByPosition(iterator.Value())
+		value, err := db.getValueFromGeneration(gen, iterator.Value())
 		if err != nil {
 			return err
 		}
@@ -487,57 +829,81 @@ func (db *DB) Fold(fn func(key, value []byte) bool) error {
 }
 
 // Close closes the DB connection and releases any resources.
+// It waits for a running merge and for all iterators to be closed, then closes the index
+// and the data files. Calling Close again returns nil, other methods return ErrDBClosed.
 func (db *DB) Close() error {
-	if db.activeFile == nil {
+	db.mu.Lock()
+	if db.closed.Load() {
+		db.mu.Unlock()
 		return nil
 	}
+	db.closed.Store(true)
+	db.mu.Unlock()
+
+	// 停止后台加载索引，加载时会读取数据文件
+	db.stopLoading()
+	// 等待 merge 完成，merge 安装时会发布新的文件集合
+	db.merges.Wait()
+	// 释放数据库持有的文件集合引用，等待正在进行的读取和迭代器结束
+	if gen := db.generation.Load(); gen != nil {
+		db.releaseGeneration(gen)
+		<-gen.drained
+	}
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	if err := db.index.Close(); err != nil {
-		return err
-	}
-	// 保存当前事务序列号
-	seqNoFile, err := data.OpenSeqNoFile(db.cfg.DirPath)
-	if err != nil {
-		return err
-	}
-	record := &data.LogRecord{
-		Key:   []byte(seqNoKey),
-		Value: []byte(strconv.FormatUint(db.seqNo, 10)),
-	}
-	encRecord, _ := data.EncodeLogRecord(record)
-	if err := seqNoFile.Write(encRecord); err != nil {
-		return err
+	db.waitIndexUpdates()
+	// 出错时继续释放其他资源，返回第一个错误
+	var firstErr error
+	setErr := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
-	if err := seqNoFile.Sync(); err != nil {
-		return err
+	// 记录检查点和当前事务序列号，内存索引保存为快照，只读模式下不修改数据目录
+	if !db.readOnly {
+		setErr(db.checkpointIndex(true))
+		setErr(db.saveIndexSnapshot())
+		setErr(db.saveDeadBytes())
 	}
+	setErr(db.closeResources())
+	return firstErr
+}
 
-	// Close the current active file.
-	if err := db.activeFile.Close(); err != nil {
-		return err
+// closeResources 关闭索引和全部数据文件，出错时继续关闭其他资源并返回第一个错误
+func (db *DB) closeResources() error {
+	var firstErr error
+	if db.index != nil {
+		firstErr = db.index.Close()
 	}
-
-	// Close the old data files.
-	for _, file := range db.oldFile {
-		if err := file.Close(); err != nil {
-			return err
+	for _, file := range db.allDataFiles() {
+		if err := file.Close(); err != nil && firstErr == nil {
+			firstErr = err
 		}
 	}
-
-	return nil
+	return firstErr
 }
 
 func (db *DB) Sync() error {
-	if db.activeFile == nil {
-		return nil
+	if db.readOnly {
+		return ErrReadOnly
 	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	return db.activeFile.Sync()
+	if db.closed.Load() {
+		return ErrDBClosed
+	}
+	if db.activeFile == nil {
+		return nil
+	}
+	// b+树索引同时持久化索引并记录检查点
+	if db.isBPTreeIndex() {
+		return db.checkpointIndex(false)
+	}
+	return db.syncActiveFile()
 }
 
-// loadSeqNo 从指定路径加载序列号文件并获取最新的序列号
+// loadSeqNo 加载旧版本在关闭时保存的序列号文件，每次关闭都会追加一条记录，最后一条是最新的
 func (db *DB) loadSeqNo() error {
 	// 拼接序列号文件路径
 	path := filepath.Join(db.cfg.DirPath, data.SeqNoFileName)
@@ -550,24 +916,35 @@ func (db *DB) loadSeqNo() error {
 	if err != nil {
 		return err
 	}
-	// 读取文件第一条日志记录
-	record, _, err := file.ReadLogRecord(0)
-	if err != nil {
-		return err
-	}
-	// 将日志记录的值转换为序列号
-	seq, err := strconv.ParseUint(string(record.Value), 10, 64)
-	if err != nil {
-		return err
+	defer file.Close()
+	var offset int64
+	for {
+		record, size, err := file.ReadLogRecord(offset)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// 将日志记录的值转换为序列号
+		seq, err := strconv.ParseUint(string(record.Value), 10, 64)
+		if err != nil {
+			return err
+		}
+		if seq > db.seqNo {
+			db.seqNo = seq
+		}
+		offset += size
 	}
-	// 更新数据库的序列号
-	db.seqNo = seq
-	db.seqNoFileExist = true
-	return nil
 }
+
+// Stat 返回存储引擎的统计信息，数据库关闭之后返回空的统计信息
 func (db *DB) Stat() *Stat {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
+	if db.closed.Load() {
+		return &Stat{}
+	}
 
 	var dataFiles = uint(len(db.oldFile))
 	if db.activeFile != nil {
@@ -578,10 +955,133 @@ func (db *DB) Stat() *Stat {
 	if err != nil {
 		panic(fmt.Sprintf("failed to get dir size : %v", err))
 	}
-	return &Stat{
-		KeyNum:          uint(db.index.Size()),
-		DataFileNum:     dataFiles,
-		DiskSize:        dirSize,
-		ReclaimableSize: db.getReclaimableSize(),
+	// 磁盘索引读取失败时 key 的数量记为 0
+	keyNum, _ := db.index.Size()
+	stat := &Stat{
+		KeyNum:      uint(keyNum),
+		DataFileNum: dataFiles,
+		DiskSize:    dirSize,
+	}
+	for _, file := range db.allDataFiles() {
+		dead := db.deadBytes.get(file.FileID)
+		stat.ReclaimableSize += dead
+		stat.DataFiles = append(stat.DataFiles, DataFileStat{
+			FileID:    file.FileID,
+			Size:      file.WriteOff,
+			LiveBytes: file.WriteOff - dead,
+			DeadBytes: dead,
+		})
 	}
+	return stat
+}
+
+// allDataFiles 按文件编号从小到大返回所有的数据文件
+func (db *DB) allDataFiles() []*data.DataFile {
+	files := make([]*data.DataFile, 0, len(db.oldFile)+1)
+	for _, file := range db.oldFile {
+		files = append(files, file)
+	}
+	if db.activeFile != nil {
+		files = append(files, db.activeFile)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].FileID < files[j].FileID
+	})
+	return files
+}
+
+// markDead 记录 pos 指向的数据已经无效
+func (db *DB) markDead(pos *data.LogRecordPos) {
+	if pos == nil {
+		return
+	}
+	db.deadBytes.add(pos.Fid, int64(pos.Size))
+}
+
+// loadDeadBytes 统计每个数据文件中的无效数据量
+// 数据文件和关闭时一致时直接使用关闭时保存的计数，否则遍历索引重新统计
+func (db *DB) loadDeadBytes() error {
+	if db.restoreDeadBytes() {
+		return nil
+	}
+	return db.countDeadBytes()
+}
+
+// countDeadBytes 遍历索引统计每个数据文件的有效数据量，其余的数据都是无效数据
+// 旧版本写入的索引中没有记录数据大小，包含这种数据的文件不统计无效数据，避免被当作可以回收的数据
+func (db *DB) countDeadBytes() error {
+	liveBytes := make(map[uint32]int64)
+	unknown := make(map[uint32]bool)
+	iterator, err := db.index.Iterator(false)
+	if err != nil {
+		return err
+	}
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		pos := iterator.Value()
+		if pos.Size == 0 {
+			unknown[pos.Fid] = true
+		}
+		liveBytes[pos.Fid] += int64(pos.Size)
+	}
+	iterator.Close()
+
+	deadBytes := make(map[uint32]int64)
+	for _, file := range db.allDataFiles() {
+		if unknown[file.FileID] {
+			continue
+		}
+		if dead := file.WriteOff - liveBytes[file.FileID]; dead > 0 {
+			deadBytes[file.FileID] = dead
+		}
+	}
+	db.deadBytes.reset(deadBytes)
+	return nil
+}
+
+// restoreDeadBytes 使用关闭时保存的无效数据量，保存之后数据文件有变化时返回 false
+// 保存的文件损坏时同样返回 false，重新统计即可
+func (db *DB) restoreDeadBytes() bool {
+	if db.activeFile == nil {
+		return false
+	}
+	saved, err := data.ReadDeadBytes(db.cfg.DirPath)
+	if err != nil || saved == nil {
+		return false
+	}
+	if saved.Generation != db.manifest.Generation || saved.Fid != db.activeFile.FileID ||
+		saved.Offset != db.activeFile.WriteOff {
+		return false
+	}
+	db.deadBytes.reset(saved.Files)
+	return true
+}
+
+// saveDeadBytes 关闭时保存每个数据文件中的无效数据量，需要持有写锁
+// 后台加载没有完成时计数不完整，不保存
+func (db *DB) saveDeadBytes() error {
+	if db.activeFile == nil || db.loadingIndex() != nil {
+		return nil
+	}
+	saved := &data.DeadBytes{
+		Generation: db.manifest.Generation,
+		Fid:        db.activeFile.FileID,
+		Offset:     db.activeFile.WriteOff,
+		Files:      make(map[uint32]int64),
+	}
+	for _, file := range db.allDataFiles() {
+		if dead := db.deadBytes.get(file.FileID); dead > 0 {
+			saved.Files[file.FileID] = dead
+		}
+	}
+	return data.WriteDeadBytes(db.cfg.DirPath, saved)
+}
+
+// lockContext 获取写锁，ctx 取消或者超时之后放弃获取并返回 ctx 的错误
+func (db *DB) lockContext(ctx context.Context) error {
+	return db.mu.LockContext(ctx)
+}
+
+// rLockContext 获取读锁，ctx 取消或者超时之后放弃获取并返回 ctx 的错误
+func (db *DB) rLockContext(ctx context.Context) error {
+	return db.mu.RLockContext(ctx)
 }
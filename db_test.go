@@ -1,17 +1,21 @@
 package bitcask
 
 import (
+	"bitcask/data"
+	"bitcask/index"
 	"bitcask/utils"
+	"bytes"
+	"context"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"sync"
 	"testing"
+	"time"
 )
 
 func destroyDB(db *DB) {
 	if db != nil {
-		if db.activeFile != nil {
-			_ = db.Close()
-		}
+		_ = db.Close()
 		err := os.RemoveAll(db.cfg.DirPath)
 		if err != nil {
 			panic(err)
@@ -19,6 +23,20 @@ func destroyDB(db *DB) {
 	}
 }
 
+// listKeys 返回数据库中全部的 key
+func listKeys(t *testing.T, db *DB) [][]byte {
+	keys, err := db.ListKeys()
+	assert.Nil(t, err)
+	return keys
+}
+
+// getIndexPos 从索引中读取 key 的位置
+func getIndexPos(t *testing.T, db *DB, key []byte) *data.LogRecordPos {
+	pos, err := db.index.Get(key)
+	assert.Nil(t, err)
+	return pos
+}
+
 // TestOpen is a test function for the Open function.
 func TestOpen(t *testing.T) {
 	cfg := DefaultConfig
@@ -234,13 +252,15 @@ func TestDB_ListKeys(t *testing.T) {
 	assert.NotNil(t, db)
 
 	// Test when the database is empty
-	keys1 := db.ListKeys()
+	keys1, err := db.ListKeys()
+	assert.Nil(t, err)
 	assert.Equal(t, 0, len(keys1))
 
 	// Test when there is only one key-value pair
 	err = db.Put(utils.GetTestKey(10), utils.GetTestValue(10))
 	assert.Nil(t, err)
-	keys2 := db.ListKeys()
+	keys2, err := db.ListKeys()
+	assert.Nil(t, err)
 	assert.Equal(t, 1, len(keys2))
 
 	// Test when there are multiple key-value pairs
@@ -252,10 +272,58 @@ func TestDB_ListKeys(t *testing.T) {
 	assert.Nil(t, err)
 	err = db.Put(utils.GetTestKey(14), utils.GetTestValue(10))
 	assert.Nil(t, err)
-	keys3 := db.ListKeys()
+	keys3, err := db.ListKeys()
+	assert.Nil(t, err)
 	assert.Equal(t, 5, len(keys3))
 }
 
+// TestDB_ListKeys_ConcurrentWrites 并发写入和删除时 ListKeys 返回的 key 不会为空或者越界
+func TestDB_ListKeys_ConcurrentWrites(t *testing.T) {
+	for _, indexType := range []IndexerType{Btree, Sharded} {
+		cfg := DefaultConfig
+		temp, err := os.MkdirTemp("", "bitcask-test-list-keys-concurrent")
+		assert.Nil(t, err)
+		cfg.DirPath = temp
+		cfg.IndexType = indexType
+		db, err := Open(cfg)
+		assert.Nil(t, err)
+
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for g := 0; g < 16; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					key := utils.GetTestKey(g*100 + i%100)
+					if i%2 == 1 {
+						assert.Nil(t, db.Delete(key))
+					} else {
+						assert.Nil(t, db.Put(key, utils.GetTestValue(8)))
+					}
+				}
+			}(g)
+		}
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+			keys := listKeys(t, db)
+			assert.True(t, len(keys) <= 1600)
+			for j, key := range keys {
+				if key == nil || (j > 0 && bytes.Compare(keys[j-1], key) >= 0) {
+					t.Fatalf("invalid key at %d: %q", j, key)
+				}
+			}
+		}
+		close(stop)
+		wg.Wait()
+		destroyDB(db)
+	}
+}
+
 // TestDB_Fold is a test function for the Fold method of the DB struct.
 func TestDB_Fold(t *testing.T) {
 	// Create a temporary directory for testing
@@ -288,19 +356,159 @@ func TestDB_Fold(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+// TestDB_Context verifies that the context variants stop once the context is done.
+func TestDB_Context(t *testing.T) {
+	cfg := DefaultConfig
+	temp, err := os.MkdirTemp("", "bitcask-test-context")
+	assert.Nil(t, err)
+	cfg.DirPath = temp
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(10)))
+	}
+
+	// 已经取消的 ctx 直接返回错误
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = db.GetContext(cancelled, utils.GetTestKey(1))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.ErrorIs(t, db.PutContext(cancelled, utils.GetTestKey(1), []byte("v")), context.Canceled)
+	assert.ErrorIs(t, db.DeleteContext(cancelled, utils.GetTestKey(1)), context.Canceled)
+	_, err = db.ListKeysContext(cancelled)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// 等待锁超时之后放弃，读取不需要获取锁
+	db.mu.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	assert.ErrorIs(t, db.PutContext(ctx, utils.GetTestKey(1), []byte("v")), context.DeadlineExceeded)
+	_, err = db.GetContext(context.Background(), utils.GetTestKey(1))
+	assert.Nil(t, err)
+	cancel()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		db.mu.Unlock()
+	}()
+	assert.Nil(t, db.PutContext(ctx, utils.GetTestKey(1), []byte("v")))
+	cancel()
+
+	// Fold 在 ctx 取消之后停止遍历
+	ctx, cancel = context.WithCancel(context.Background())
+	var count int
+	err = db.FoldContext(ctx, func(key, value []byte) bool {
+		count++
+		if count == 10 {
+			cancel()
+		}
+		return true
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 10, count)
+
+	val, err := db.GetContext(context.Background(), utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), val)
+}
+
 // TestDB_Close is a unit test function for the Close method of the DB struct.
 func TestDB_Close(t *testing.T) {
-	// Create a temporary directory for testing
+	for _, indexType := range []IndexerType{Btree, BPTree} {
+		// Create a temporary directory for testing
+		cfg := DefaultConfig
+		temp, err := os.MkdirTemp("", "bitcask-test-close")
+		assert.Nil(t, err)
+		cfg.DirPath = temp
+		cfg.IndexType = indexType
+
+		// Open a new DB instance
+		db, err := Open(cfg)
+		assert.Nil(t, err)
+		assert.NotNil(t, db)
+		// 空的数据库关闭时同样释放 b+树索引文件，否则重新打开会一直等待文件锁
+		assert.Nil(t, db.Close())
+		db, err = Open(cfg)
+		assert.Nil(t, err)
+		assert.Nil(t, db.Put(utils.GetTestKey(1), utils.GetTestValue(10)))
+		assert.Nil(t, db.Close())
+		assert.Nil(t, db.Close())
+
+		// 关闭之后所有操作都返回 ErrDBClosed
+		assert.Equal(t, ErrDBClosed, db.Put(utils.GetTestKey(2), utils.GetTestValue(10)))
+		_, err = db.Get(utils.GetTestKey(1))
+		assert.Equal(t, ErrDBClosed, err)
+		assert.Equal(t, ErrDBClosed, db.Delete(utils.GetTestKey(1)))
+		assert.Equal(t, ErrDBClosed, db.Sync())
+		assert.Equal(t, ErrDBClosed, db.Merge())
+		assert.Equal(t, ErrDBClosed, db.Refresh())
+		assert.Equal(t, ErrDBClosed, db.Fold(func(key, value []byte) bool { return true }))
+		keys, err := db.ListKeys()
+		assert.Equal(t, ErrDBClosed, err)
+		assert.Nil(t, keys)
+		_, err = db.ListKeysContext(context.Background())
+		assert.Equal(t, ErrDBClosed, err)
+		_, err = db.Scan(nil, nil, 0)
+		assert.Equal(t, ErrDBClosed, err)
+		wb := db.NewWriteBatch(DefaultWriteBatchConfig)
+		assert.Equal(t, ErrDBClosed, wb.Put(utils.GetTestKey(2), utils.GetTestValue(10)))
+		assert.Equal(t, ErrDBClosed, wb.Delete(utils.GetTestKey(1)))
+		assert.Equal(t, ErrDBClosed, wb.Delete(utils.GetTestKey(3)))
+		assert.Equal(t, ErrDBClosed, wb.Commit())
+		iter := db.NewIterator(DefaultIteratorConfig)
+		iter.Rewind()
+		assert.False(t, iter.Valid())
+		assert.Equal(t, ErrDBClosed, iter.Err())
+		iter.Close()
+		assert.Equal(t, &Stat{}, db.Stat())
+		assert.Nil(t, os.RemoveAll(temp))
+	}
+}
+
+// TestDB_Close_PendingBatch 关闭之前暂存的写入在关闭之后不能提交
+func TestDB_Close_PendingBatch(t *testing.T) {
+	db, _ := openMergeTestDB(t, BPTree)
+	defer destroyDB(db)
+	wb := db.NewWriteBatch(DefaultWriteBatchConfig)
+	assert.Nil(t, wb.Put(utils.GetTestKey(1), utils.GetTestValue(10)))
+	assert.Nil(t, db.Close())
+	assert.Equal(t, ErrDBClosed, wb.Commit())
+}
+
+func TestDB_Close_WaitsForIterators(t *testing.T) {
 	cfg := DefaultConfig
 	temp, err := os.MkdirTemp("", "bitcask-test-close")
 	assert.Nil(t, err)
 	cfg.DirPath = temp
-
-	// Open a new DB instance
+	cfg.IndexType = Btree
 	db, err := Open(cfg)
-
 	assert.Nil(t, err)
-	assert.NotNil(t, db)
+	defer destroyDB(db)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(10)))
+	}
+
+	iter := db.NewIterator(DefaultIteratorConfig)
+	closed := make(chan error, 1)
+	go func() {
+		closed <- db.Close()
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close returned before the iterator was closed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// 关闭过程中不能再写入，迭代器仍然可以读取
+	assert.Equal(t, ErrDBClosed, db.Put(utils.GetTestKey(1), utils.GetTestValue(10)))
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		_, err := iter.Value()
+		assert.Nil(t, err)
+		count++
+	}
+	assert.Equal(t, 100, count)
+	iter.Close()
+	assert.Nil(t, <-closed)
 }
 
 // TestDB_Sync is a unit test function for the Sync method of the DB struct.
@@ -319,3 +527,276 @@ func TestDB_Sync(t *testing.T) {
 	err = db.Sync()
 	assert.Nil(t, err)
 }
+
+// TestDB_Stat is a unit test function for the Stat method of the DB struct.
+func TestDB_Stat(t *testing.T) {
+	for _, indexType := range []IndexerType{Btree, ART, BPTree, Sharded, Hash, Arena} {
+		db, cfg := openMergeTestDB(t, indexType)
+
+		// 覆盖写入和删除的数据都可以回收
+		var dead int64
+		for i := 0; i < 1000; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+		}
+		for i := 0; i < 300; i++ {
+			pos := getIndexPos(t, db, utils.GetTestKey(i))
+			dead += int64(pos.Size)
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+		}
+		for i := 300; i < 400; i++ {
+			pos := getIndexPos(t, db, utils.GetTestKey(i))
+			dead += int64(pos.Size)
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+			_, size := data.EncodeLogRecord(&data.LogRecord{
+				Key:  logRecordKeyWriteWithSeq(utils.GetTestKey(i), nonTransactionSeqNo),
+				Type: data.LogRecordDeleted,
+			})
+			dead += size
+		}
+		stat := db.Stat()
+		assert.Equal(t, uint(900), stat.KeyNum)
+		assert.Equal(t, dead, stat.ReclaimableSize)
+		assert.Equal(t, int(stat.DataFileNum), len(stat.DataFiles))
+		var total int64
+		for _, fileStat := range stat.DataFiles {
+			assert.Equal(t, fileStat.Size, fileStat.LiveBytes+fileStat.DeadBytes)
+			total += fileStat.DeadBytes
+		}
+		assert.Equal(t, dead, total)
+
+		// 重启之后重新统计
+		assert.Nil(t, db.Close())
+		db, err := Open(cfg)
+		assert.Nil(t, err)
+		assert.Equal(t, stat.DataFiles, db.Stat().DataFiles)
+
+		// merge 之后没有可以回收的数据
+		assert.Nil(t, db.Merge())
+		assert.Equal(t, int64(0), db.Stat().ReclaimableSize)
+		destroyDB(db)
+	}
+}
+
+// TestDB_Stat_SavedDeadBytes 数据文件和关闭时一致时使用保存的无效数据量，有变化之后重新统计
+func TestDB_Stat_SavedDeadBytes(t *testing.T) {
+	for _, indexType := range []IndexerType{Btree, BPTree} {
+		db, cfg := openMergeTestDB(t, indexType)
+		for i := 0; i < 500; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i%200), utils.GetTestValue(64)))
+		}
+		stat := db.Stat()
+		assert.True(t, stat.ReclaimableSize > 0)
+		assert.Nil(t, db.Close())
+
+		saved, err := data.ReadDeadBytes(cfg.DirPath)
+		assert.Nil(t, err)
+		assert.NotNil(t, saved)
+		assert.Equal(t, stat.ReclaimableSize, sumDeadBytes(saved.Files))
+
+		// 打开时不再遍历索引，直接使用保存的计数
+		saved.Files[saved.Fid] += 100
+		assert.Nil(t, data.WriteDeadBytes(cfg.DirPath, saved))
+		db, err = Open(cfg)
+		assert.Nil(t, err)
+		assert.Equal(t, stat.ReclaimableSize+100, db.Stat().ReclaimableSize)
+
+		// 之后的写入没有保存计数就崩溃，重新打开时遍历索引统计
+		assert.Nil(t, db.Put(utils.GetTestKey(0), utils.GetTestValue(64)))
+		assert.Nil(t, db.Sync())
+		stat = db.Stat()
+		crashDB(db)
+		db, err = Open(cfg)
+		assert.Nil(t, err)
+		assert.Equal(t, stat.ReclaimableSize-100, db.Stat().ReclaimableSize)
+		destroyDB(db)
+	}
+}
+
+// TestDB_Stat_UnknownSize 旧版本的索引中没有记录数据大小，所在的文件不统计无效数据
+func TestDB_Stat_UnknownSize(t *testing.T) {
+	cfg := DefaultConfig
+	temp, err := os.MkdirTemp("", "bitcask-test-unknown-size")
+	assert.Nil(t, err)
+	cfg.DirPath = temp
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i%50), utils.GetTestValue(64)))
+	}
+	assert.Nil(t, db.countDeadBytes())
+	assert.True(t, db.Stat().ReclaimableSize > 0)
+
+	pos := getIndexPos(t, db, utils.GetTestKey(0))
+	assert.Nil(t, db.index.Put(utils.GetTestKey(0), &data.LogRecordPos{Fid: pos.Fid, Offset: pos.Offset}))
+	assert.Nil(t, db.countDeadBytes())
+	assert.Equal(t, int64(0), db.Stat().ReclaimableSize)
+}
+
+// sumDeadBytes 全部文件中的无效数据量
+func sumDeadBytes(files map[uint32]int64) int64 {
+	var total int64
+	for _, dead := range files {
+		total += dead
+	}
+	return total
+}
+
+// TestDB_ConcurrentWrites 并发写入同一批 key，索引和无效数据量与重新打开之后从数据文件中恢复的一致
+func TestDB_ConcurrentWrites(t *testing.T) {
+	for _, indexType := range []IndexerType{Btree, BPTree} {
+		db, cfg := openMergeTestDB(t, indexType)
+
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 300; i++ {
+					key := utils.GetTestKey((w*7 + i) % 50)
+					if i%5 == 0 {
+						assert.Nil(t, db.Delete(key))
+					} else {
+						assert.Nil(t, db.Put(key, utils.GetTestValue(64)))
+					}
+				}
+			}(w)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				wb := db.NewWriteBatch(DefaultWriteBatchConfig)
+				assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+				assert.Nil(t, wb.Delete(utils.GetTestKey(49-i)))
+				assert.Nil(t, wb.Commit())
+			}
+		}()
+		wg.Wait()
+
+		values := make(map[string][]byte)
+		for i := 0; i < 50; i++ {
+			if val, err := db.Get(utils.GetTestKey(i)); err == nil {
+				values[string(utils.GetTestKey(i))] = val
+			}
+		}
+		stat := db.Stat()
+		assert.Nil(t, db.Close())
+
+		db, err := Open(cfg)
+		assert.Nil(t, err)
+		assert.Equal(t, len(values), len(listKeys(t, db)))
+		for key, value := range values {
+			val, err := db.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, value, val)
+		}
+		assert.Equal(t, stat.DataFiles, db.Stat().DataFiles)
+		destroyDB(db)
+	}
+}
+
+func TestDB_MaxOpenFiles(t *testing.T) {
+	cfg := DefaultConfig
+	temp, err := os.MkdirTemp("", "bitcask-test-max-open-files")
+	assert.Nil(t, err)
+	cfg.DirPath = temp
+	cfg.DataFileSize = 4 * 1024
+	cfg.IndexType = Btree
+	cfg.MaxOpenFiles = 2
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	values := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		key := utils.GetTestKey(i % 600)
+		values[string(key)] = utils.GetTestValue(64)
+		assert.Nil(t, db.Put(key, values[string(key)]))
+	}
+	assert.Greater(t, db.Stat().DataFileNum, uint(10))
+	assert.LessOrEqual(t, db.fileCache.Len(), 2)
+	for key, value := range values {
+		val, err := db.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+	assert.LessOrEqual(t, db.fileCache.Len(), 2)
+
+	// 迭代器在 merge 之后仍然可以读取被替换的文件
+	iter := db.NewIterator(DefaultIteratorConfig)
+	assert.Nil(t, db.Merge())
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		val, err := iter.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, values[string(iter.Key())], val)
+		count++
+	}
+	assert.Equal(t, 600, count)
+	iter.Close()
+	assert.LessOrEqual(t, db.Metrics().OpenDataFiles, int64(2))
+
+	// 重启之后同样限制打开的文件数量
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, db.fileCache.Len(), 2)
+	for key, value := range values {
+		val, err := db.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+
+	cfg.MaxOpenFiles = -1
+	_, err = Open(cfg)
+	assert.NotNil(t, err)
+}
+
+// countingIndex 记录被创建次数的自定义索引
+type countingIndex struct {
+	*index.BTree
+}
+
+func TestDB_IndexFactory(t *testing.T) {
+	var created int
+	index.Register("test-counting", func(string, bool) (index.Indexer, error) {
+		created++
+		return countingIndex{index.NewBTree()}, nil
+	})
+	factory, ok := index.Lookup("test-counting")
+	assert.True(t, ok)
+
+	cfg := DefaultConfig
+	temp, err := os.MkdirTemp("", "bitcask-test-index-factory")
+	assert.Nil(t, err)
+	cfg.DirPath = temp
+	cfg.DataFileSize = 4 * 1024
+	cfg.IndexFactory = factory
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+	assert.Equal(t, 1, created)
+	assert.IsType(t, countingIndex{}, db.index)
+
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	assert.Nil(t, db.Delete(utils.GetTestKey(0)))
+	assert.Nil(t, db.Merge())
+
+	// 自定义索引在重新打开时从数据文件中构建
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, created)
+	assert.Equal(t, 199, len(listKeys(t, db)))
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 创建索引失败时返回错误
+	cfg.IndexFactory = func(string, bool) (index.Indexer, error) { return nil, index.ErrUnsupportedIndexType }
+	cfg.DirPath = t.TempDir()
+	_, err = Open(cfg)
+	assert.Equal(t, index.ErrUnsupportedIndexType, err)
+}
@@ -0,0 +1,55 @@
+package bitcask
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// deadBytes 每个数据文件中可以被 merge 回收的数据量
+// 写入在释放数据库的锁之后更新索引，计数使用原子操作，不需要持有锁
+type deadBytes struct {
+	files sync.Map // uint32 -> *atomic.Int64
+}
+
+// add 增加 fid 文件中的无效数据量
+func (d *deadBytes) add(fid uint32, n int64) {
+	counter, ok := d.files.Load(fid)
+	if !ok {
+		counter, _ = d.files.LoadOrStore(fid, new(atomic.Int64))
+	}
+	counter.(*atomic.Int64).Add(n)
+}
+
+// get 返回 fid 文件中的无效数据量
+func (d *deadBytes) get(fid uint32) int64 {
+	if counter, ok := d.files.Load(fid); ok {
+		return counter.(*atomic.Int64).Load()
+	}
+	return 0
+}
+
+// remove 删除已经被 merge 回收的文件的计数，需要持有写锁并等待正在进行的索引更新完成
+func (d *deadBytes) remove(fid uint32) {
+	d.files.Delete(fid)
+}
+
+// total 返回全部数据文件中的无效数据量
+func (d *deadBytes) total() int64 {
+	var total int64
+	d.files.Range(func(_, counter any) bool {
+		total += counter.(*atomic.Int64).Load()
+		return true
+	})
+	return total
+}
+
+// reset 使用重新统计的结果替换全部计数
+func (d *deadBytes) reset(files map[uint32]int64) {
+	d.files.Range(func(fid, _ any) bool {
+		d.files.Delete(fid)
+		return true
+	})
+	for fid, n := range files {
+		d.add(fid, n)
+	}
+}
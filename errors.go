@@ -13,4 +13,7 @@ var (
 	ErrDatabaseIsUsing        = errors.New("the database directory is used by another process")
 	ErrMergeRatioUnreached    = errors.New("the merge ratio do not reach the option")
 	ErrNoEnoughSpaceForMerge  = errors.New("no enough disk space for merge")
+	ErrMergeFileIDExhausted   = errors.New("merge output exceeds the reserved file ids")
+	ErrReadOnly               = errors.New("the database is opened in read-only mode")
+	ErrDBClosed               = errors.New("the database is closed")
 )
@@ -0,0 +1,237 @@
+package fio
+
+import (
+	"container/list"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// FileCache 限制同时打开的文件数量
+// 超出数量时关闭最近没有使用、并且没有正在进行读写的文件，之后访问时重新打开
+// 已经打开的文件读写时只修改文件自身的引用计数，只有打开和关闭文件时需要获取 mu
+type FileCache struct {
+	mu       sync.Mutex
+	capacity int          // 最多同时打开的文件数量，0 表示不限制
+	flag     int          // 打开文件的模式
+	lru      *list.List   // 已经打开的文件，新打开和最近使用过的在前面
+	open     atomic.Int64 // lru 中的文件数量，超出 capacity 时释放文件之后尝试关闭
+}
+
+// NewFileCache 初始化文件缓存，capacity 为 0 时不限制打开的文件数量
+func NewFileCache(capacity int) *FileCache {
+	return &FileCache{capacity: capacity, flag: os.O_CREATE | os.O_RDWR | os.O_APPEND, lru: list.New()}
+}
+
+// NewReadOnlyFileCache 初始化以只读方式打开文件的缓存，文件不存在时不会创建
+func NewReadOnlyFileCache(capacity int) *FileCache {
+	return &FileCache{capacity: capacity, flag: os.O_RDONLY, lru: list.New()}
+}
+
+// Len 返回当前打开的文件数量
+func (fc *FileCache) Len() int {
+	return int(fc.open.Load())
+}
+
+// overCapacity 打开的文件数量是否超出了上限
+func (fc *FileCache) overCapacity() bool {
+	return fc.capacity > 0 && fc.open.Load() > int64(fc.capacity)
+}
+
+// Open 返回按需打开文件的 IOManager，非只读模式下文件不存在时创建
+func (fc *FileCache) Open(fileName string) (*CachedFileIO, error) {
+	cf := &CachedFileIO{cache: fc, fileName: fileName}
+	// 打开一次文件，确保文件存在并且可以访问
+	if _, err := cf.acquire(); err != nil {
+		return nil, err
+	}
+	cf.release()
+	return cf, nil
+}
+
+// CachedFileIO 由 FileCache 管理文件描述符的标准文件 IO
+// 每次读写时持有文件，读写期间文件不会被关闭
+// 文件打开时 cache 持有一个引用，refs 大于 0 时可以直接增加引用读写；
+// 关闭文件描述符之前需要把 refs 从 1 修改为 0，和读写的获取互斥
+type CachedFileIO struct {
+	cache    *FileCache
+	fileName string
+	fd       atomic.Pointer[os.File] // 文件描述符，被关闭之后为空
+	refs     atomic.Int64            // cache 持有的引用加上正在进行的读写数量，文件没有打开时为 0
+	used     atomic.Bool             // 上一次淘汰之后被读写过，淘汰时再保留一轮
+	closed   atomic.Bool
+	pinned   bool          // 是否保持打开，需要持有 cache.mu
+	elem     *list.Element // 在 lru 中的位置，需要持有 cache.mu
+}
+
+// acquire 获取打开的文件描述符，使用完之后需要调用 release
+func (cf *CachedFileIO) acquire() (*os.File, error) {
+	for refs := cf.refs.Load(); refs > 0; refs = cf.refs.Load() {
+		if cf.refs.CompareAndSwap(refs, refs+1) {
+			if cf.closed.Load() {
+				cf.release()
+				return nil, os.ErrClosed
+			}
+			cf.used.Store(true)
+			return cf.fd.Load(), nil
+		}
+	}
+	// 文件没有打开，获取锁之后打开
+	fc := cf.cache
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if err := cf.open(); err != nil {
+		return nil, err
+	}
+	cf.refs.Add(1)
+	fc.evict()
+	return cf.fd.Load(), nil
+}
+
+// open 文件没有打开时打开文件并放到 lru 的最前面，需要持有锁
+func (cf *CachedFileIO) open() error {
+	fc := cf.cache
+	if cf.closed.Load() {
+		return os.ErrClosed
+	}
+	if cf.refs.Load() > 0 {
+		return nil
+	}
+	fd, err := os.OpenFile(cf.fileName, fc.flag, DataFilePerm)
+	if err != nil {
+		return err
+	}
+	cf.fd.Store(fd)
+	cf.used.Store(false)
+	cf.elem = fc.lru.PushFront(cf)
+	fc.open.Add(1)
+	// cache 持有的引用，之后读写可以不获取锁
+	cf.refs.Store(1)
+	return nil
+}
+
+// release 释放读写时获取的引用，Close 之后最后一个引用释放时关闭文件描述符
+func (cf *CachedFileIO) release() {
+	fc := cf.cache
+	if cf.refs.Add(-1) == 0 {
+		fc.mu.Lock()
+		cf.closeFD()
+		fc.mu.Unlock()
+		return
+	}
+	// 之前因为文件正在使用而没有关闭成功
+	if fc.overCapacity() {
+		fc.mu.Lock()
+		fc.evict()
+		fc.mu.Unlock()
+	}
+}
+
+// evict 关闭超出数量的文件，需要持有锁
+// 正在使用和被 Pin 的文件会被跳过，上一次淘汰之后使用过的文件移动到最前面再保留一轮
+func (fc *FileCache) evict() {
+	for pass := 0; pass < 2 && fc.overCapacity(); pass++ {
+		for e := fc.lru.Back(); e != nil && fc.overCapacity(); {
+			prev := e.Prev()
+			cf := e.Value.(*CachedFileIO)
+			switch {
+			case cf.pinned:
+			case cf.used.Swap(false):
+				fc.lru.MoveToFront(e)
+			case cf.refs.CompareAndSwap(1, 0):
+				cf.closeFD()
+			}
+			e = prev
+		}
+	}
+}
+
+// closeFD 在 refs 归零之后关闭文件描述符并从 lru 中移除，需要持有锁
+func (cf *CachedFileIO) closeFD() {
+	fd := cf.fd.Swap(nil)
+	if fd == nil {
+		return
+	}
+	_ = fd.Close()
+	cf.cache.lru.Remove(cf.elem)
+	cf.cache.open.Add(-1)
+	cf.elem = nil
+}
+
+// Pin 保持文件打开直到调用 Unpin 或者 Close，用于频繁写入的活跃文件
+func (cf *CachedFileIO) Pin() error {
+	fc := cf.cache
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if err := cf.open(); err != nil {
+		return err
+	}
+	cf.pinned = true
+	fc.evict()
+	return nil
+}
+
+// Unpin 取消 Pin，之后文件可以被关闭
+func (cf *CachedFileIO) Unpin() {
+	fc := cf.cache
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	cf.pinned = false
+	fc.evict()
+}
+
+func (cf *CachedFileIO) Read(b []byte, offset int64) (int, error) {
+	fd, err := cf.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer cf.release()
+	return fd.ReadAt(b, offset)
+}
+
+func (cf *CachedFileIO) Write(b []byte) (int, error) {
+	fd, err := cf.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer cf.release()
+	return fd.Write(b)
+}
+
+func (cf *CachedFileIO) Sync() error {
+	fd, err := cf.acquire()
+	if err != nil {
+		return err
+	}
+	defer cf.release()
+	return fd.Sync()
+}
+
+// Close 关闭文件，正在进行的读写完成之后才会关闭文件描述符
+func (cf *CachedFileIO) Close() error {
+	fc := cf.cache
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if cf.closed.Swap(true) {
+		return nil
+	}
+	cf.pinned = false
+	// 释放 cache 持有的引用，没有正在进行的读写时立即关闭
+	if cf.refs.Load() > 0 && cf.refs.Add(-1) == 0 {
+		cf.closeFD()
+	}
+	return nil
+}
+
+func (cf *CachedFileIO) Size() (int64, error) {
+	fd, err := cf.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer cf.release()
+	stat, err := fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
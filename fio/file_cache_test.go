@@ -0,0 +1,122 @@
+package fio
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func openCachedFiles(t *testing.T, cache *FileCache, n int) []*CachedFileIO {
+	dir, err := os.MkdirTemp("", "bitcask-file-cache")
+	assert.Nil(t, err)
+	t.Cleanup(func() { destoryTestFile(dir) })
+	files := make([]*CachedFileIO, n)
+	for i := range files {
+		files[i], err = cache.Open(filepath.Join(dir, fmt.Sprintf("%09d.data", i)))
+		assert.Nil(t, err)
+	}
+	return files
+}
+
+func TestFileCache_Evict(t *testing.T) {
+	cache := NewFileCache(2)
+	files := openCachedFiles(t, cache, 5)
+	assert.Equal(t, 2, cache.Len())
+
+	// 被关闭的文件在读写时重新打开
+	for i, f := range files {
+		_, err := f.Write([]byte(fmt.Sprintf("file-%d", i)))
+		assert.Nil(t, err)
+		assert.LessOrEqual(t, cache.Len(), 2)
+	}
+	for i, f := range files {
+		buf := make([]byte, 6)
+		_, err := f.Read(buf, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("file-%d", i), string(buf))
+		size, err := f.Size()
+		assert.Nil(t, err)
+		assert.Equal(t, int64(6), size)
+	}
+	assert.Equal(t, 2, cache.Len())
+	// 最近使用的文件仍然是打开的
+	assert.NotNil(t, files[4].fd.Load())
+	assert.Nil(t, files[0].fd.Load())
+
+	for _, f := range files {
+		assert.Nil(t, f.Close())
+	}
+	assert.Equal(t, 0, cache.Len())
+}
+
+func TestFileCache_Pin(t *testing.T) {
+	cache := NewFileCache(1)
+	files := openCachedFiles(t, cache, 3)
+
+	assert.Nil(t, files[0].Pin())
+	for _, f := range files[1:] {
+		_, err := f.Write([]byte("a"))
+		assert.Nil(t, err)
+	}
+	// 被 Pin 的文件不会被关闭，其他文件可以超出数量临时打开
+	assert.NotNil(t, files[0].fd.Load())
+	assert.Equal(t, 1, cache.Len())
+
+	files[0].Unpin()
+	_, err := files[1].Write([]byte("a"))
+	assert.Nil(t, err)
+	assert.Nil(t, files[0].fd.Load())
+	assert.Equal(t, 1, cache.Len())
+}
+
+func TestFileCache_InUse(t *testing.T) {
+	cache := NewFileCache(1)
+	files := openCachedFiles(t, cache, 2)
+
+	// 正在读写的文件不会被关闭
+	fd, err := files[0].acquire()
+	assert.Nil(t, err)
+	_, err = files[1].Write([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, fd, files[0].fd.Load())
+	assert.Equal(t, 1, cache.Len())
+
+	// 读写期间 Close，读写完成之后才关闭文件描述符
+	assert.Nil(t, files[0].Close())
+	_, err = fd.Write([]byte("b"))
+	assert.Nil(t, err)
+	files[0].release()
+	assert.Nil(t, files[0].fd.Load())
+	assert.Equal(t, 0, cache.Len())
+
+	_, err = files[0].Write([]byte("c"))
+	assert.ErrorIs(t, err, os.ErrClosed)
+}
+
+func TestFileCache_Concurrent(t *testing.T) {
+	cache := NewFileCache(3)
+	files := openCachedFiles(t, cache, 10)
+	for _, f := range files {
+		_, err := f.Write([]byte("0123456789"))
+		assert.Nil(t, err)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			buf := make([]byte, 10)
+			for i := 0; i < 500; i++ {
+				_, err := files[(g+i)%len(files)].Read(buf, 0)
+				assert.Nil(t, err)
+				assert.Equal(t, "0123456789", string(buf))
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, cache.Len(), 3)
+}
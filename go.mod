@@ -4,7 +4,6 @@ go 1.22.0
 
 require (
 	github.com/google/btree v1.1.2
-	github.com/plar/go-adaptive-radix-tree v1.0.5
 	github.com/stretchr/testify v1.8.4
 	go.etcd.io/bbolt v1.3.8
 	github.com/tidwall/redcon v1.6.2
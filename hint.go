@@ -0,0 +1,63 @@
+package bitcask
+
+import (
+	"bitcask/data"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// appendHint 记录活跃文件中一条记录的 hint，需要持有锁
+func (db *DB) appendHint(record *data.LogRecord, pos *data.LogRecordPos) {
+	db.hintBuf = append(db.hintBuf, data.EncodeHintRecord(record.Key, record.Type, pos)...)
+	db.hintOff = pos.Offset + int64(pos.Size)
+}
+
+// writeHintFile 活跃文件持久化之后、切换之前写入它的 hint 文件，需要持有锁
+// 只有 hint 覆盖了整个活跃文件时才写入；hint 文件只用来加快打开数据库的速度，写入失败时忽略，之后仍然读取数据文件
+func (db *DB) writeHintFile() {
+	if db.readOnly || db.activeFile == nil || db.hintOff != db.activeFile.WriteOff || db.hintOff == 0 {
+		return
+	}
+	_ = data.WriteHintFile(db.cfg.DirPath, db.activeFile.FileID, db.hintBuf, db.hintOff)
+	db.hintBuf = nil
+}
+
+// removeDataFile 删除数据文件和它的 hint 文件
+// 先删除 hint 文件，之后崩溃时不会留下没有数据文件的 hint 文件
+func (db *DB) removeDataFile(fileID uint32) error {
+	if err := os.Remove(data.GetHintFileName(db.cfg.DirPath, fileID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(data.GetDataFileName(db.cfg.DirPath, fileID))
+}
+
+// removeStaleHintFiles 删除没有对应的有效数据文件的 hint 文件，以及写入时残留的临时文件
+// merge 生成的文件从 merge 的 hint 文件中加载，不使用单独的 hint 文件
+func (db *DB) removeStaleHintFiles(fileIDs []int) error {
+	live := make(map[int]bool, len(fileIDs))
+	for _, fid := range fileIDs {
+		if uint32(fid) >= db.manifest.NonMergeFileID {
+			live[fid] = true
+		}
+	}
+	dir, err := os.ReadDir(db.cfg.DirPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dir {
+		name := entry.Name()
+		if !strings.HasSuffix(name, data.HintFileNameSuffix) && !strings.HasSuffix(name, data.HintFileNameSuffix+".tmp") {
+			continue
+		}
+		fid, err := strconv.Atoi(name[:strings.Index(name, ".")])
+		if err == nil && live[fid] && strings.HasSuffix(name, data.HintFileNameSuffix) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(db.cfg.DirPath, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
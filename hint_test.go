@@ -0,0 +1,114 @@
+package bitcask
+
+import (
+	"bitcask/data"
+	"bitcask/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestDB_HintFile 切换活跃文件时写入 hint 文件，打开时旧文件从 hint 文件中加载
+func TestDB_HintFile(t *testing.T) {
+	db, cfg := openMergeTestDB(t, Btree)
+	dir := cfg.DirPath
+	defer func() { destroyDB(db) }()
+
+	values := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		key := utils.GetTestKey(i)
+		values[string(key)] = utils.GetTestValue(64)
+		assert.Nil(t, db.Put(key, values[string(key)]))
+		// 事务跨越多个数据文件
+		if i%100 == 99 {
+			wb := db.NewWriteBatch(DefaultWriteBatchConfig)
+			for j := i - 50; j <= i; j++ {
+				assert.Nil(t, wb.Delete(utils.GetTestKey(j)))
+				delete(values, string(utils.GetTestKey(j)))
+			}
+			assert.Nil(t, wb.Commit())
+		}
+	}
+	activeFileID := db.activeFile.FileID
+	assert.True(t, activeFileID > 2)
+	assert.Nil(t, db.Close())
+	removeIndexSnapshot(t, dir)
+	for fid := uint32(0); fid < activeFileID; fid++ {
+		_, err := os.Stat(data.GetHintFileName(dir, fid))
+		assert.Nil(t, err)
+	}
+	_, err := os.Stat(data.GetHintFileName(dir, activeFileID))
+	assert.True(t, os.IsNotExist(err))
+
+	// 旧文件中的 value 损坏了，从 hint 文件中加载时不会读取到
+	dataName := data.GetDataFileName(dir, 1)
+	copyFile(t, dataName, dataName+".bak")
+	file, err := os.OpenFile(dataName, os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.WriteAt([]byte("corrupted"), 1024)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, len(values), len(listKeys(t, db)))
+	assert.Nil(t, db.Close())
+	removeIndexSnapshot(t, dir)
+
+	// hint 文件不完整时读取数据文件
+	hintName := data.GetHintFileName(dir, 1)
+	info, err := os.Stat(hintName)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(hintName, info.Size()-1))
+	_, err = Open(cfg)
+	assert.Equal(t, data.ErrInvalidCRC, err)
+	assert.Nil(t, os.Rename(dataName+".bak", dataName))
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, len(values), len(listKeys(t, db)))
+	for key, value := range values {
+		val, err := db.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+	assert.Nil(t, db.Close())
+	removeIndexSnapshot(t, dir)
+
+	// hint 文件中间损坏时，只从最后一条有效的 hint 之后读取数据文件，前面损坏的 value 不会读取到
+	dataName = data.GetDataFileName(dir, 2)
+	copyFile(t, dataName, dataName+".bak")
+	file, err = os.OpenFile(dataName, os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.WriteAt([]byte("corrupted"), 1024)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+	hintName = data.GetHintFileName(dir, 2)
+	info, err = os.Stat(hintName)
+	assert.Nil(t, err)
+	file, err = os.OpenFile(hintName, os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.WriteAt([]byte("corrupted"), info.Size()-64)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, len(values), len(listKeys(t, db)))
+	assert.Nil(t, db.Close())
+	assert.Nil(t, os.Rename(dataName+".bak", dataName))
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+
+	// merge 之后删除被替换的文件的 hint 文件
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, len(values), len(listKeys(t, db)))
+	for fid := uint32(0); fid <= activeFileID; fid++ {
+		_, err := os.Stat(data.GetHintFileName(dir, fid))
+		assert.True(t, os.IsNotExist(err))
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+data.HintFileNameSuffix+"*"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(matches))
+}
@@ -43,7 +43,7 @@ func handlePut(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	for key, value := range kv {
-		if err := db.Put([]byte(key), []byte(value)); err != nil {
+		if err := db.PutContext(r.Context(), []byte(key), []byte(value)); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -59,7 +59,7 @@ func handleGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	key := r.URL.Query().Get("key")
-	value, err := db.Get([]byte(key))
+	value, err := db.GetContext(r.Context(), []byte(key))
 	if err != nil && !errors.Is(err, bitcask.ErrKeyNotFound) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		log.Printf("failed to get kv in db, error:%v", err)
@@ -76,7 +76,7 @@ func handleDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	key := r.URL.Query().Get("key")
-	if err := db.Delete([]byte(key)); err != nil && !errors.Is(err, bitcask.ErrKeyIsEmpty) {
+	if err := db.DeleteContext(r.Context(), []byte(key)); err != nil && !errors.Is(err, bitcask.ErrKeyIsEmpty) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -90,7 +90,11 @@ func handleListKey(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	keys := db.ListKeys()
+	keys, err := db.ListKeysContext(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	var result []string
 	for _, key := range keys {
@@ -110,6 +114,16 @@ func handleStat(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(stat)
 }
 
+// handleMetrics handles GET requests to export metrics in the Prometheus text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_ = db.Metrics().WritePrometheus(w)
+}
+
 func main() {
 	// Serve embedded static files at root
 	staticFS, err := fs.Sub(staticFiles, "static")
@@ -124,6 +138,7 @@ func main() {
 	http.HandleFunc("/bitcask/delete", handleDelete)
 	http.HandleFunc("/bitcask/listkey", handleListKey)
 	http.HandleFunc("/bitcask/stat", handleStat)
+	http.HandleFunc("/metrics", handleMetrics)
 
 	addr := ":8082"
 	log.Printf("Bitcask Web UI running at http://localhost%s", addr)
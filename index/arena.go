@@ -0,0 +1,357 @@
+package index
+
+import (
+	"bitcask/data"
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"sync"
+)
+
+// ArenaIndex 把 key 和位置信息保存在大块内存中的有序索引，适合 key 数量非常多的场景
+// key 依次追加到 key 内存块中，索引项只保存 key 的整数引用和定长的位置信息，不包含任何指针
+// GC 只需要扫描内存块列表，不需要扫描每个索引项
+// 索引项按照 key 的顺序分成多个定长的块，块内有序，块按照第一个 key 排序
+// 每个索引项占用 24 字节，按顺序写入 20 万个 21 字节的 key 时每个 key 共占用约 60 字节（包括 key 本身），
+// 随机写入时块没有填满，每个 key 约占用 67 字节，见 TestIndex_MemoryPerKey
+type ArenaIndex struct {
+	lock *sync.RWMutex
+
+	keyChunks    [][]byte // key 内存块，每个 key 之前保存 uvarint 编码的长度
+	keyBytes     int64    // 有效的 key 占用的字节数（包括长度前缀）
+	deadKeyBytes int64    // 已经删除的 key 占用的字节数
+
+	entryChunks [][]arenaEntry // 索引项内存块，每个内存块包含 arenaBlocksPerChunk 个块
+	blockLens   []uint16       // 每个块中的索引项数量，下标为块 id
+	order       []uint32       // 按照 key 排序的块 id
+	freeBlocks  []uint32       // 空闲的块 id
+	count       int
+}
+
+// arenaEntry 索引项，keyRef 高 32 位是 key 内存块的下标，低 32 位是在内存块中的偏移
+type arenaEntry struct {
+	keyRef uint64
+	fid    uint32
+	size   uint32
+	offset int64
+}
+
+const (
+	arenaKeyChunkSize   = 4 << 20 // key 内存块的大小
+	arenaBlockSize      = 256     // 每个块最多保存的索引项数量
+	arenaBlocksPerChunk = 64      // 每个索引项内存块包含的块数量
+	arenaEntrySize      = 24      // arenaEntry 占用的字节数
+	arenaSliceHeader    = 24      // 内存块列表中每个 slice 头占用的字节数
+)
+
+// NewArenaIndex 初始化 arena 索引
+func NewArenaIndex() *ArenaIndex {
+	return &ArenaIndex{lock: new(sync.RWMutex)}
+}
+
+// arenaKey 从 key 内存块中读取 key，返回的 slice 不能追加
+func arenaKey(chunks [][]byte, ref uint64) []byte {
+	chunk := chunks[ref>>32]
+	off := uint32(ref)
+	n, l := binary.Uvarint(chunk[off:])
+	start := uint64(off) + uint64(l)
+	end := start + n
+	return chunk[start:end:end]
+}
+
+// appendKey 把 key 追加到 key 内存块中，返回引用
+// 已经写入的 key 不会被修改，迭代器可以继续读取
+func (ai *ArenaIndex) appendKey(key []byte) uint64 {
+	need := uvarintLen(uint64(len(key))) + len(key)
+	last := len(ai.keyChunks) - 1
+	if last < 0 || cap(ai.keyChunks[last])-len(ai.keyChunks[last]) < need {
+		size := arenaKeyChunkSize
+		if need > size {
+			size = need
+		}
+		ai.keyChunks = append(ai.keyChunks, make([]byte, 0, size))
+		last++
+	}
+	chunk := ai.keyChunks[last]
+	ref := uint64(last)<<32 | uint64(len(chunk))
+	chunk = binary.AppendUvarint(chunk, uint64(len(key)))
+	ai.keyChunks[last] = append(chunk, key...)
+	ai.keyBytes += int64(need)
+	return ref
+}
+
+// uvarintLen 返回 x 进行 uvarint 编码之后的长度
+func uvarintLen(x uint64) int {
+	n := 1
+	for ; x >= 0x80; x >>= 7 {
+		n++
+	}
+	return n
+}
+
+// keyRefSize 返回引用的 key 占用的字节数
+func (ai *ArenaIndex) keyRefSize(ref uint64) int64 {
+	n, l := binary.Uvarint(ai.keyChunks[ref>>32][uint32(ref):])
+	return int64(n) + int64(l)
+}
+
+// block 返回块中的索引项
+func (ai *ArenaIndex) block(id uint32) []arenaEntry {
+	chunk := ai.entryChunks[id/arenaBlocksPerChunk]
+	start := (id % arenaBlocksPerChunk) * arenaBlockSize
+	return chunk[start : start+uint32(ai.blockLens[id]) : start+arenaBlockSize]
+}
+
+// newBlock 分配一个空的块
+func (ai *ArenaIndex) newBlock() uint32 {
+	if n := len(ai.freeBlocks); n > 0 {
+		id := ai.freeBlocks[n-1]
+		ai.freeBlocks = ai.freeBlocks[:n-1]
+		return id
+	}
+	id := uint32(len(ai.blockLens))
+	if id%arenaBlocksPerChunk == 0 {
+		ai.entryChunks = append(ai.entryChunks, make([]arenaEntry, arenaBlocksPerChunk*arenaBlockSize))
+	}
+	ai.blockLens = append(ai.blockLens, 0)
+	return id
+}
+
+// findBlock 返回 key 所在或者应该插入的块在 order 中的下标
+func (ai *ArenaIndex) findBlock(key []byte) int {
+	i := sort.Search(len(ai.order), func(i int) bool {
+		first := ai.block(ai.order[i])[0]
+		return bytes.Compare(arenaKey(ai.keyChunks, first.keyRef), key) > 0
+	})
+	if i > 0 {
+		i--
+	}
+	return i
+}
+
+// searchBlock 在块中查找第一个大于等于 key 的位置
+func (ai *ArenaIndex) searchBlock(entries []arenaEntry, key []byte) (int, bool) {
+	i := sort.Search(len(entries), func(i int) bool {
+		return bytes.Compare(arenaKey(ai.keyChunks, entries[i].keyRef), key) >= 0
+	})
+	return i, i < len(entries) && bytes.Equal(arenaKey(ai.keyChunks, entries[i].keyRef), key)
+}
+
+func (ai *ArenaIndex) Put(key []byte, pos *data.LogRecordPos) error {
+	ai.lock.Lock()
+	defer ai.lock.Unlock()
+	var bi int
+	if len(ai.order) == 0 {
+		ai.order = append(ai.order, ai.newBlock())
+	} else {
+		bi = ai.findBlock(key)
+	}
+	id := ai.order[bi]
+	entries := ai.block(id)
+	i, found := ai.searchBlock(entries, key)
+	if found {
+		entries[i].fid, entries[i].size, entries[i].offset = pos.Fid, pos.Size, pos.Offset
+		return nil
+	}
+
+	// 块已经满了，把后一半移动到新的块中
+	// 追加到块的末尾时只把新的 key 放到新的块中，按顺序写入时每个块都是满的
+	if len(entries) == arenaBlockSize {
+		next := ai.newBlock()
+		half := arenaBlockSize / 2
+		if i == arenaBlockSize {
+			half = arenaBlockSize
+		}
+		ai.blockLens[next] = uint16(arenaBlockSize - half)
+		copy(ai.block(next), entries[half:])
+		ai.blockLens[id] = uint16(half)
+		ai.order = append(ai.order, 0)
+		copy(ai.order[bi+2:], ai.order[bi+1:])
+		ai.order[bi+1] = next
+		if i > half || i == arenaBlockSize {
+			id, i = next, i-half
+		}
+		entries = ai.block(id)
+	}
+	ai.blockLens[id]++
+	entries = entries[:len(entries)+1]
+	copy(entries[i+1:], entries[i:])
+	entries[i] = arenaEntry{keyRef: ai.appendKey(key), fid: pos.Fid, size: pos.Size, offset: pos.Offset}
+	ai.count++
+	return nil
+}
+
+func (ai *ArenaIndex) Get(key []byte) (*data.LogRecordPos, error) {
+	ai.lock.RLock()
+	defer ai.lock.RUnlock()
+	if len(ai.order) == 0 {
+		return nil, nil
+	}
+	entries := ai.block(ai.order[ai.findBlock(key)])
+	i, found := ai.searchBlock(entries, key)
+	if !found {
+		return nil, nil
+	}
+	return entries[i].logRecordPos(), nil
+}
+
+func (ai *ArenaIndex) Delete(key []byte) (bool, error) {
+	ai.lock.Lock()
+	defer ai.lock.Unlock()
+	if len(ai.order) == 0 {
+		return false, nil
+	}
+	bi := ai.findBlock(key)
+	id := ai.order[bi]
+	entries := ai.block(id)
+	i, found := ai.searchBlock(entries, key)
+	if !found {
+		return false, nil
+	}
+	size := ai.keyRefSize(entries[i].keyRef)
+	ai.keyBytes -= size
+	ai.deadKeyBytes += size
+	copy(entries[i:], entries[i+1:])
+	ai.blockLens[id]--
+	ai.count--
+
+	// 数据太少的块合并到后一个块中，空的块被回收
+	if n := int(ai.blockLens[id]); n < arenaBlockSize/4 && bi+1 < len(ai.order) {
+		next := ai.order[bi+1]
+		if n+int(ai.blockLens[next]) <= arenaBlockSize*3/4 {
+			nextEntries := ai.block(next)
+			ai.blockLens[id] += ai.blockLens[next]
+			copy(ai.block(id)[n:], nextEntries)
+			ai.blockLens[next] = 0
+			ai.removeBlock(bi + 1)
+		}
+	}
+	if ai.blockLens[id] == 0 {
+		ai.removeBlock(bi)
+	}
+
+	if ai.deadKeyBytes > arenaKeyChunkSize && ai.deadKeyBytes > ai.keyBytes {
+		ai.compactKeys()
+	}
+	return true, nil
+}
+
+// removeBlock 从 order 中移除空的块并回收
+func (ai *ArenaIndex) removeBlock(bi int) {
+	ai.freeBlocks = append(ai.freeBlocks, ai.order[bi])
+	ai.order = append(ai.order[:bi], ai.order[bi+1:]...)
+}
+
+// compactKeys 把有效的 key 复制到新的内存块中
+// 旧的内存块不会被修改，正在使用的迭代器仍然可以读取
+func (ai *ArenaIndex) compactKeys() {
+	old := ai.keyChunks
+	ai.keyChunks = nil
+	ai.keyBytes = 0
+	ai.deadKeyBytes = 0
+	for _, id := range ai.order {
+		entries := ai.block(id)
+		for i := range entries {
+			entries[i].keyRef = ai.appendKey(arenaKey(old, entries[i].keyRef))
+		}
+	}
+}
+
+func (ai *ArenaIndex) Size() (int, error) {
+	ai.lock.RLock()
+	defer ai.lock.RUnlock()
+	return ai.count, nil
+}
+
+// MemoryUsage 返回索引分配的全部内存，包括内存块中没有使用的部分
+func (ai *ArenaIndex) MemoryUsage() int64 {
+	ai.lock.RLock()
+	defer ai.lock.RUnlock()
+	usage := int64(cap(ai.keyChunks)+cap(ai.entryChunks)) * arenaSliceHeader
+	for _, chunk := range ai.keyChunks {
+		usage += int64(cap(chunk))
+	}
+	usage += int64(len(ai.entryChunks)) * arenaBlocksPerChunk * arenaBlockSize * arenaEntrySize
+	usage += int64(cap(ai.blockLens))*2 + int64(cap(ai.order)+cap(ai.freeBlocks))*4
+	return usage
+}
+
+func (ai *ArenaIndex) Close() error {
+	return nil
+}
+
+// Iterator 按顺序复制全部索引项，每个 key 占用 24 字节，之后对索引的修改不可见
+// key 内存块中的数据不会被修改，迭代器直接引用创建时的内存块
+func (ai *ArenaIndex) Iterator(reverse bool) (Iterator, error) {
+	ai.lock.RLock()
+	entries := make([]arenaEntry, 0, ai.count)
+	for _, id := range ai.order {
+		entries = append(entries, ai.block(id)...)
+	}
+	chunks := append([][]byte(nil), ai.keyChunks...)
+	ai.lock.RUnlock()
+	iter := &arenaIterator{keyChunks: chunks, entries: entries, reverse: reverse}
+	iter.Rewind()
+	return iter, nil
+}
+
+func (e *arenaEntry) logRecordPos() *data.LogRecordPos {
+	return &data.LogRecordPos{Fid: e.fid, Offset: e.offset, Size: e.size}
+}
+
+// arenaIterator 在复制出来的有序索引项上遍历
+type arenaIterator struct {
+	keyChunks [][]byte
+	entries   []arenaEntry
+	reverse   bool
+	currIndex int // 正向遍历时为下标，反向遍历时从后往前数
+}
+
+func (ait *arenaIterator) Rewind() {
+	ait.currIndex = 0
+}
+
+// Seek 二分查找第一个大于（反向遍历时小于）等于 key 的位置
+func (ait *arenaIterator) Seek(key []byte) {
+	i := sort.Search(len(ait.entries), func(i int) bool {
+		return bytes.Compare(arenaKey(ait.keyChunks, ait.entries[i].keyRef), key) >= 0
+	})
+	if !ait.reverse {
+		ait.currIndex = i
+		return
+	}
+	// 反向遍历时定位到最后一个小于等于 key 的位置
+	if i < len(ait.entries) && bytes.Equal(arenaKey(ait.keyChunks, ait.entries[i].keyRef), key) {
+		i++
+	}
+	ait.currIndex = len(ait.entries) - i
+}
+
+func (ait *arenaIterator) Next() {
+	ait.currIndex++
+}
+
+func (ait *arenaIterator) Valid() bool {
+	return ait.currIndex < len(ait.entries)
+}
+
+// entry 返回当前位置的索引项
+func (ait *arenaIterator) entry() *arenaEntry {
+	if ait.reverse {
+		return &ait.entries[len(ait.entries)-1-ait.currIndex]
+	}
+	return &ait.entries[ait.currIndex]
+}
+
+func (ait *arenaIterator) Key() []byte {
+	return arenaKey(ait.keyChunks, ait.entry().keyRef)
+}
+
+func (ait *arenaIterator) Value() *data.LogRecordPos {
+	return ait.entry().logRecordPos()
+}
+
+func (ait *arenaIterator) Close() {
+	ait.keyChunks = nil
+	ait.entries = nil
+}
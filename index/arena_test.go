@@ -0,0 +1,111 @@
+package index
+
+import (
+	"bitcask/data"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"runtime"
+	"sort"
+	"testing"
+)
+
+// TestArenaIndex_Random 随机写入和删除，结果与 map 保持一致，并且遍历有序
+func TestArenaIndex_Random(t *testing.T) {
+	ai := NewArenaIndex()
+	expected := make(map[string]int64)
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 30000; i++ {
+			key := fmt.Sprintf("key-%d", r.Intn(10000))
+			// 第二轮以删除为主，块被合并和回收
+			if r.Intn(3) == 0 || (round == 1 && r.Intn(4) != 0) {
+				ok, err := ai.Delete([]byte(key))
+				assert.Nil(t, err)
+				_, exist := expected[key]
+				assert.Equal(t, exist, ok)
+				delete(expected, key)
+			} else {
+				assert.Nil(t, ai.Put([]byte(key), &data.LogRecordPos{Fid: 1, Offset: int64(i), Size: uint32(round)}))
+				expected[key] = int64(i)
+			}
+		}
+		size, err := ai.Size()
+		assert.Nil(t, err)
+		assert.Equal(t, len(expected), size)
+		for key, offset := range expected {
+			pos, err := ai.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, offset, pos.Offset)
+		}
+
+		var keys []string
+		for key := range expected {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		iter, err := ai.Iterator(false)
+		assert.Nil(t, err)
+		var got []string
+		for ; iter.Valid(); iter.Next() {
+			got = append(got, string(iter.Key()))
+		}
+		iter.Close()
+		assert.Equal(t, keys, got)
+	}
+}
+
+func TestArenaIndex_CompactKeys(t *testing.T) {
+	ai := NewArenaIndex()
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%01022d", i)) }
+	for i := 0; i < 10000; i++ {
+		assert.Nil(t, ai.Put(key(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)}))
+	}
+	iter, err := ai.Iterator(false)
+	assert.Nil(t, err)
+	defer iter.Close()
+
+	// 删除的 key 超过有效的 key 之后整理 key 内存块
+	for i := 0; i < 6000; i++ {
+		ok, err := ai.Delete(key(i))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+	}
+	// 删除第 5001 个 key 时整理，剩下的 4999 个 key 占用两个内存块
+	assert.Equal(t, 2, len(ai.keyChunks))
+	assert.Equal(t, int64(999*1024), ai.deadKeyBytes)
+	assert.Equal(t, int64(4000*1024), ai.keyBytes)
+	for i := 6000; i < 10000; i++ {
+		pos, err := ai.Get(key(i))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(i), pos.Offset)
+	}
+
+	// 整理之前创建的迭代器仍然可以读取所有 key
+	var count int
+	for ; iter.Valid(); iter.Next() {
+		assert.Equal(t, key(count), iter.Key())
+		count++
+	}
+	assert.Equal(t, 10000, count)
+}
+
+// TestArenaIndex_MemoryUsage MemoryUsage 与实际分配的内存一致
+func TestArenaIndex_MemoryUsage(t *testing.T) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	ai := NewArenaIndex()
+	for i := 0; i < 200000; i++ {
+		assert.Nil(t, ai.Put([]byte(fmt.Sprintf("bitcask-key-%09d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)}))
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	allocated := int64(after.HeapAlloc) - int64(before.HeapAlloc)
+	assert.InDelta(t, allocated, ai.MemoryUsage(), float64(allocated)/20)
+	runtime.KeepAlive(ai)
+}
+
+func TestArenaIndex_Iterator_Snapshot(t *testing.T) {
+	testIteratorSnapshot(t, NewArenaIndex())
+}
@@ -2,18 +2,21 @@ package index
 
 import (
 	"bitcask/data"
-	"bytes"
-	"sort"
 	"sync"
 )
-import art "github.com/plar/go-adaptive-radix-tree"
 
 // AdaptiveRadixTree 自适应基数树索引
+// 底层的树支持写时复制，迭代器可以在 O(1) 克隆得到的快照上遍历
 type AdaptiveRadixTree struct {
-	tree art.Tree
-	lock *sync.RWMutex
+	tree     *artTree
+	lock     *sync.RWMutex
+	keyBytes int64 // 所有 key 的总长度
 }
 
+// artItemOverhead 每个索引项除 key 之外的内存占用估算值
+// 保存 leaf 的节点 96 字节，leaf 40 字节，LogRecordPos 24 字节，平摊的内部节点约 40 字节
+const artItemOverhead = 200
+
 func (art *AdaptiveRadixTree) Close() error {
 	return nil
 }
@@ -21,150 +24,112 @@ func (art *AdaptiveRadixTree) Close() error {
 // NewART returns a new instance of AdaptiveRadixTree.
 func NewART() *AdaptiveRadixTree {
 	return &AdaptiveRadixTree{
-		tree: art.New(),
+		tree: newARTTree(),
 		lock: new(sync.RWMutex),
 	}
 }
 
 // Put inserts a key-value pair into the AdaptiveRadixTree.
-// It returns true if the insertion is successful.
-func (art *AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) bool {
+func (art *AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) error {
 	art.lock.Lock()
-	art.tree.Insert(key, pos)
+	if _, updated := art.tree.insert(key, pos); !updated {
+		art.keyBytes += int64(len(key))
+	}
 	art.lock.Unlock()
-	return true
+	return nil
 }
 
 // Get retrieves the value associated with the given key from the AdaptiveRadixTree.
 // If the key is not found, it returns nil.
-func (art *AdaptiveRadixTree) Get(key []byte) *data.LogRecordPos {
+func (art *AdaptiveRadixTree) Get(key []byte) (*data.LogRecordPos, error) {
 	art.lock.RLock()
 	defer art.lock.RUnlock()
-	value, found := art.tree.Search(key)
+	value, found := art.tree.search(key)
 	if !found {
-		return nil
+		return nil, nil
 	}
-	return value.(*data.LogRecordPos)
+	return value.(*data.LogRecordPos), nil
 }
 
 // Delete removes the key-value pair associated with the given key from the AdaptiveRadixTree.
-// It returns true if the deletion is successful.
-func (art *AdaptiveRadixTree) Delete(key []byte) bool {
+// It returns true if the key existed.
+func (art *AdaptiveRadixTree) Delete(key []byte) (bool, error) {
 	art.lock.Lock()
-	_, deleted := art.tree.Delete(key)
+	_, deleted := art.tree.delete(key)
+	if deleted {
+		art.keyBytes -= int64(len(key))
+	}
 	art.lock.Unlock()
-	return deleted
+	return deleted, nil
 }
 
 // Iterator returns an iterator for traversing the keys in the AdaptiveRadixTree.
 // The iterator can iterate in reverse order if the 'reverse' parameter is set to true.
-func (art *AdaptiveRadixTree) Iterator(reverse bool) Iterator {
-	art.lock.RLock()
-	defer art.lock.RUnlock()
-	return newARTIterator(art.tree, reverse)
+// Cloning the tree changes its copy-on-write context, so the write lock is required.
+func (art *AdaptiveRadixTree) Iterator(reverse bool) (Iterator, error) {
+	art.lock.Lock()
+	defer art.lock.Unlock()
+	return newARTIterator(art.tree, reverse), nil
 }
 
 // Size returns the number of keys in the AdaptiveRadixTree.
-func (art *AdaptiveRadixTree) Size() int {
+func (art *AdaptiveRadixTree) Size() (int, error) {
 	art.lock.RLock()
-	size := art.tree.Size()
+	size := art.tree.size
 	art.lock.RUnlock()
-	return size
+	return size, nil
 }
 
-// Art 索引迭代器
-type artIterator struct {
-	currIndex int     // 当前遍历的下标位置
-	reverse   bool    // 是否是反向遍历
-	values    []*Item // key+位置索引信息
-}
-
-// newARTIterator creates a new artIterator object.
-// It takes an art.Tree object and a boolean value indicating whether to iterate in reverse order.
-// It returns a pointer to the artIterator object.
-func newARTIterator(tree art.Tree, reverse bool) *artIterator {
-	// Initialize the index variable
-	var idx int
-	if reverse {
-		idx = tree.Size() - 1
-	}
-
-	// Create a slice to store the values of each node
-	values := make([]*Item, tree.Size())
-
-	// Define the saveValues function to save the values of each node
-	saveValues := func(node art.Node) bool {
-		// Create a new Item object with the key and position of the node
-		item := &Item{
-			key: node.Key(),
-			pos: node.Value().(*data.LogRecordPos),
-		}
-
-		// Save the item in the values slice at the current index
-		values[idx] = item
-
-		// Update the index based on the reverse flag
-		if reverse {
-			idx--
-		} else {
-			idx++
-		}
-
-		// Return true to indicate that the node should be saved
-		return true
-	}
+// MemoryUsage 估算索引占用的内存
+func (art *AdaptiveRadixTree) MemoryUsage() int64 {
+	art.lock.RLock()
+	defer art.lock.RUnlock()
+	return int64(art.tree.size)*artItemOverhead + art.keyBytes
+}
 
-	// Iterate over each node in the tree and save its value
-	tree.ForEach(saveValues)
+// Art 索引迭代器，在创建时的快照上按需遍历，不复制数据
+type artIterator struct {
+	iter *artTreeIterator
+}
 
-	// Create and return the artIterator object
-	return &artIterator{
-		currIndex: 0,
-		reverse:   reverse,
-		values:    values,
-	}
+// newARTIterator creates an iterator over a snapshot of the tree.
+// The snapshot is an O(1) copy-on-write clone, so later writes to the index are not visible.
+func newARTIterator(tree *artTree, reverse bool) *artIterator {
+	return &artIterator{iter: newARTTreeIterator(tree.clone().root, reverse)}
 }
 
-// Rewind resets the current index to 0.
+// Rewind moves the iterator to the first key, or the last key if reverse is true.
 func (ai *artIterator) Rewind() {
-	ai.currIndex = 0
+	ai.iter.rewind()
 }
 
-// Seek sets the current index to the position of the first value whose key is greater than or equal to the given key.
-// If reverse is true, it sets the current index to the position of the first value whose key is less than or equal to the given key.
+// Seek moves the iterator to the first key greater than or equal to the given key.
+// If reverse is true, it moves to the first key less than or equal to the given key.
 func (ai *artIterator) Seek(key []byte) {
-	if ai.reverse {
-		ai.currIndex = sort.Search(len(ai.values), func(i int) bool {
-			return bytes.Compare(ai.values[i].key, key) <= 0
-		})
-	} else {
-		ai.currIndex = sort.Search(len(ai.values), func(i int) bool {
-			return bytes.Compare(ai.values[i].key, key) >= 0
-		})
-	}
+	ai.iter.seek(key)
 }
 
-// Next increments the current index by 1.
+// Next moves the iterator to the next key.
 func (ai *artIterator) Next() {
-	ai.currIndex += 1
+	ai.iter.advance()
 }
 
-// Valid returns true if the current index is within the bounds of the values slice.
+// Valid returns true if the iterator points to a key.
 func (ai *artIterator) Valid() bool {
-	return ai.currIndex < len(ai.values)
+	return ai.iter.curr != nil
 }
 
 // Key returns the key of the current value.
 func (ai *artIterator) Key() []byte {
-	return ai.values[ai.currIndex].key
+	return ai.iter.curr.key
 }
 
 // Value returns the position of the current value.
 func (ai *artIterator) Value() *data.LogRecordPos {
-	return ai.values[ai.currIndex].pos
+	return ai.iter.curr.value.(*data.LogRecordPos)
 }
 
-// Close sets the values slice to nil.
+// Close releases the snapshot.
 func (ai *artIterator) Close() {
-	ai.values = nil
+	ai.iter = &artTreeIterator{}
 }
@@ -3,6 +3,7 @@ package index
 import (
 	"bitcask/data"
 	"github.com/stretchr/testify/assert"
+	"math/rand"
 	"testing"
 )
 
@@ -12,16 +13,13 @@ func TestNewART(t *testing.T) {
 	art := NewART()
 
 	// Put a key-value pair into the ART.
-	res1 := art.Put([]byte("key-1"), &data.LogRecordPos{Fid: 1, Offset: 12})
-	assert.NotNil(t, res1)
+	assert.Nil(t, art.Put([]byte("key-1"), &data.LogRecordPos{Fid: 1, Offset: 12}))
 
 	// Put another key-value pair into the ART.
-	res2 := art.Put([]byte("key-2"), &data.LogRecordPos{Fid: 1, Offset: 12})
-	assert.NotNil(t, res2)
+	assert.Nil(t, art.Put([]byte("key-2"), &data.LogRecordPos{Fid: 1, Offset: 12}))
 
 	// Put a third key-value pair into the ART.
-	res3 := art.Put([]byte("key-3"), &data.LogRecordPos{Fid: 1, Offset: 12})
-	assert.NotNil(t, res3)
+	assert.Nil(t, art.Put([]byte("key-3"), &data.LogRecordPos{Fid: 1, Offset: 12}))
 }
 
 // TestAdaptiveRadixTree_Get is a test function for the Get method of the AdaptiveRadixTree struct.
@@ -33,17 +31,20 @@ func TestAdaptiveRadixTree_Get(t *testing.T) {
 	art.Put([]byte("key-1"), &data.LogRecordPos{Fid: 1, Offset: 12})
 
 	// Get the value associated with the key "key-1"
-	pos := art.Get([]byte("key-1"))
+	pos, err := art.Get([]byte("key-1"))
+	assert.Nil(t, err)
 	assert.NotNil(t, pos)
 	// Get the value associated with the key "not exist"
-	pos1 := art.Get([]byte("not exist"))
+	pos1, err := art.Get([]byte("not exist"))
+	assert.Nil(t, err)
 	assert.Nil(t, pos1)
 
 	// Put a new key-value pair into the tree
 	art.Put([]byte("key-1"), &data.LogRecordPos{Fid: 1123, Offset: 990})
 
 	// Get the updated value associated with the key "key-1"
-	pos2 := art.Get([]byte("key-1"))
+	pos2, err := art.Get([]byte("key-1"))
+	assert.Nil(t, err)
 	assert.NotNil(t, pos2)
 }
 
@@ -53,18 +54,21 @@ func TestAdaptiveRadixTree_Delete(t *testing.T) {
 	art := NewART()
 
 	// Delete a non-existent key from the ART.
-	res1 := art.Delete([]byte("not exist"))
+	res1, err := art.Delete([]byte("not exist"))
+	assert.Nil(t, err)
 	assert.False(t, res1)
 
 	// Put a key-value pair into the ART.
 	art.Put([]byte("key-1"), &data.LogRecordPos{Fid: 1, Offset: 12})
 
 	// Delete the key from the ART.
-	res2 := art.Delete([]byte("key-1"))
+	res2, err := art.Delete([]byte("key-1"))
+	assert.Nil(t, err)
 	assert.True(t, res2)
 
 	// Get the position of the deleted key from the ART.
-	pos := art.Get([]byte("key-1"))
+	pos, err := art.Get([]byte("key-1"))
+	assert.Nil(t, err)
 	assert.Nil(t, pos)
 }
 
@@ -73,7 +77,9 @@ func TestAdaptiveRadixTree_Size(t *testing.T) {
 	art := NewART()
 
 	// Check if the size of the tree is 0.
-	assert.Equal(t, 0, art.Size())
+	size, err := art.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, size)
 
 	// Add some key-value pairs to the tree.
 	art.Put([]byte("key-1"), &data.LogRecordPos{Fid: 1, Offset: 12})
@@ -81,7 +87,29 @@ func TestAdaptiveRadixTree_Size(t *testing.T) {
 	art.Put([]byte("key-1"), &data.LogRecordPos{Fid: 1, Offset: 12})
 
 	// Check if the size of the tree is 2.
-	assert.Equal(t, 2, art.Size())
+	size, err = art.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, size)
+}
+
+// TestAdaptiveRadixTree_MemoryUsage tests the MemoryUsage method of AdaptiveRadixTree.
+func TestAdaptiveRadixTree_MemoryUsage(t *testing.T) {
+	art := NewART()
+	assert.Equal(t, int64(0), art.MemoryUsage())
+
+	art.Put([]byte("key-1"), &data.LogRecordPos{Fid: 1, Offset: 12})
+	art.Put([]byte("key-22"), &data.LogRecordPos{Fid: 1, Offset: 12})
+	art.Put([]byte("key-1"), &data.LogRecordPos{Fid: 1, Offset: 24})
+	assert.Equal(t, int64(2*artItemOverhead+11), art.MemoryUsage())
+
+	art.Delete([]byte("key-22"))
+	art.Delete([]byte("key-1"))
+	assert.Equal(t, int64(0), art.MemoryUsage())
+}
+
+// TestAdaptiveRadixTree_Iterator_Snapshot verifies that the iterator walks a snapshot of the tree.
+func TestAdaptiveRadixTree_Iterator_Snapshot(t *testing.T) {
+	testIteratorSnapshot(t, NewART())
 }
 
 func TestAdaptiveRadixTree_Iterator(t *testing.T) {
@@ -92,9 +120,189 @@ func TestAdaptiveRadixTree_Iterator(t *testing.T) {
 	art.Put([]byte("bbde"), &data.LogRecordPos{Fid: 1, Offset: 12})
 	art.Put([]byte("bade"), &data.LogRecordPos{Fid: 1, Offset: 12})
 
-	iter := art.Iterator(false)
+	iter, err := art.Iterator(false)
+	assert.Nil(t, err)
 	for iter.Rewind(); iter.Valid(); iter.Next() {
 		assert.NotNil(t, iter.Key())
 		assert.NotNil(t, iter.Value())
 	}
 }
+
+// randomARTKey 随机生成 key：同一个前缀下全部 256 个字节使节点增长为大节点，
+// 共享长前缀、只在末尾不同或者互为前缀的 key 覆盖路径压缩的拆分与合并
+func randomARTKey(rnd *rand.Rand) []byte {
+	switch rnd.Intn(4) {
+	case 0:
+		return []byte{'f', byte(rnd.Intn(256))}
+	case 1:
+		return append([]byte("shared/long/prefix/"), byte(rnd.Intn(4)), byte(rnd.Intn(256)))
+	case 2:
+		return []byte("shared/long/prefix/")[:[]int{6, 12}[rnd.Intn(2)]]
+	default:
+		key := make([]byte, 1+rnd.Intn(6))
+		for i := range key {
+			key[i] = byte(rnd.Intn(256))
+		}
+		return key
+	}
+}
+
+// artNodeStats 统计大节点的数量和最长的压缩前缀
+func artNodeStats(n *artNode) (fullNodes int, maxPrefix int) {
+	if n == nil {
+		return 0, 0
+	}
+	if n.isFull() {
+		fullNodes++
+	}
+	maxPrefix = len(n.prefix)
+	for _, child := range n.children {
+		full, prefix := artNodeStats(child)
+		fullNodes += full
+		if prefix > maxPrefix {
+			maxPrefix = prefix
+		}
+	}
+	return fullNodes, maxPrefix
+}
+
+// checkSameIndex 两个索引中的 key、位置、顺序和 seek 的结果都一致
+func checkSameIndex(t *testing.T, rnd *rand.Rand, expected, actual Indexer) {
+	expectedSize, _ := expected.Size()
+	actualSize, _ := actual.Size()
+	assert.Equal(t, expectedSize, actualSize)
+	for _, reverse := range []bool{false, true} {
+		want, _ := expected.Iterator(reverse)
+		got, _ := actual.Iterator(reverse)
+		got.Rewind()
+		for want.Rewind(); want.Valid(); want.Next() {
+			if !assert.True(t, got.Valid()) {
+				break
+			}
+			assert.Equal(t, want.Key(), got.Key())
+			assert.Equal(t, want.Value(), got.Value())
+			got.Next()
+		}
+		assert.False(t, got.Valid())
+		for i := 0; i < 100; i++ {
+			key := randomARTKey(rnd)
+			want.Seek(key)
+			got.Seek(key)
+			assert.Equal(t, want.Valid(), got.Valid())
+			if want.Valid() && got.Valid() {
+				assert.Equal(t, want.Key(), got.Key())
+			}
+		}
+		want.Close()
+		got.Close()
+	}
+}
+
+// TestAdaptiveRadixTree_DiffBTree 随机写入和删除，结果与 BTree 逐一比较
+// 先写入使节点增长为大节点，再删除到大节点全部收缩回小节点
+func TestAdaptiveRadixTree_DiffBTree(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	art, bt := NewART(), NewBTree()
+	maxFull, maxPrefix := 0, 0
+	for i := 0; i < 40000; i++ {
+		key := randomARTKey(rnd)
+		switch op := rnd.Intn(10); {
+		case op < 6 || i < 5000:
+			pos := &data.LogRecordPos{Fid: uint32(i), Offset: int64(i)}
+			assert.Nil(t, art.Put(key, pos))
+			assert.Nil(t, bt.Put(key, pos))
+		case op < 9:
+			deleted, _ := art.Delete(key)
+			expected, _ := bt.Delete(key)
+			assert.Equal(t, expected, deleted)
+		default:
+			got, _ := art.Get(key)
+			want, _ := bt.Get(key)
+			assert.Equal(t, want, got)
+		}
+		if i%4000 == 0 {
+			checkSameIndex(t, rnd, bt, art)
+			full, prefix := artNodeStats(art.tree.root)
+			maxFull = max(maxFull, full)
+			maxPrefix = max(maxPrefix, prefix)
+		}
+	}
+	checkSameIndex(t, rnd, bt, art)
+	assert.True(t, maxFull > 0)
+	assert.True(t, maxPrefix > 4)
+
+	// 删除到只剩少量 key，大节点收缩回小节点
+	iter, _ := bt.Iterator(false)
+	var keys [][]byte
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, iter.Key())
+	}
+	iter.Close()
+	rnd.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	for i, key := range keys[:len(keys)-20] {
+		deleted, _ := art.Delete(key)
+		assert.True(t, deleted)
+		_, _ = bt.Delete(key)
+		if i%500 == 0 {
+			checkSameIndex(t, rnd, bt, art)
+		}
+	}
+	checkSameIndex(t, rnd, bt, art)
+	full, _ := artNodeStats(art.tree.root)
+	assert.Equal(t, 0, full)
+}
+
+// TestAdaptiveRadixTree_IteratorConcurrentWrites 迭代期间并发写入，迭代器仍然看到创建时的快照
+func TestAdaptiveRadixTree_IteratorConcurrentWrites(t *testing.T) {
+	rnd := rand.New(rand.NewSource(3))
+	art, bt := NewART(), NewBTree()
+	for i := 0; i < 5000; i++ {
+		key := randomARTKey(rnd)
+		pos := &data.LogRecordPos{Fid: uint32(i), Offset: int64(i)}
+		assert.Nil(t, art.Put(key, pos))
+		assert.Nil(t, bt.Put(key, pos))
+	}
+	for round := 0; round < 5; round++ {
+		// 快照之后 bt 不再修改，作为迭代器应该看到的结果
+		expected := NewBTree()
+		iter, _ := bt.Iterator(false)
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			assert.Nil(t, expected.Put(iter.Key(), iter.Value()))
+		}
+		iter.Close()
+		snapshot, _ := art.Iterator(false)
+
+		done := make(chan struct{})
+		go func(seed int64) {
+			defer close(done)
+			rnd := rand.New(rand.NewSource(seed))
+			for i := 0; i < 5000; i++ {
+				key := randomARTKey(rnd)
+				if rnd.Intn(3) == 0 {
+					_, _ = art.Delete(key)
+					_, _ = bt.Delete(key)
+				} else {
+					pos := &data.LogRecordPos{Fid: uint32(round), Offset: int64(i)}
+					_ = art.Put(key, pos)
+					_ = bt.Put(key, pos)
+				}
+			}
+		}(int64(round))
+
+		want, _ := expected.Iterator(false)
+		snapshot.Rewind()
+		for want.Rewind(); want.Valid(); want.Next() {
+			if !assert.True(t, snapshot.Valid()) {
+				break
+			}
+			assert.Equal(t, want.Key(), snapshot.Key())
+			assert.Equal(t, want.Value(), snapshot.Value())
+			snapshot.Next()
+		}
+		assert.False(t, snapshot.Valid())
+		want.Close()
+		snapshot.Close()
+		<-done
+		checkSameIndex(t, rnd, bt, art)
+	}
+}
@@ -0,0 +1,430 @@
+package index
+
+import (
+	"bytes"
+	"sort"
+)
+
+// artNodeMaxSmall 小节点最多保存的子节点数量，超过之后转换为 256 个槽位的大节点
+// artNodeMinFull 大节点的子节点数量小于该值时转换回小节点
+const (
+	artNodeMaxSmall = 48
+	artNodeMinFull  = 32
+)
+
+// cowContext 标识节点属于哪一棵树，与 google/btree 的 copyOnWriteContext 类似
+// 修改不属于当前树的节点之前需要先复制，克隆之后的两棵树因此可以共享未修改的节点
+type cowContext struct {
+	_ byte // 保证每次分配的地址不同
+}
+
+// artLeaf 保存完整的 key 和 value，创建之后不会再被修改
+type artLeaf struct {
+	key   []byte
+	value interface{}
+}
+
+// artNode 自适应基数树的节点
+// 节点对应的路径为所有祖先节点的 prefix 与边上的字节拼接，再加上自身的 prefix
+// 路径恰好等于某个 key 时，这个 key 保存在 leaf 中
+type artNode struct {
+	cow         *cowContext
+	prefix      []byte     // 路径压缩之后的公共前缀
+	leaf        *artLeaf   // 在当前节点结束的 key
+	keys        []byte     // 小节点中有序排列的子节点字节
+	children    []*artNode // 小节点中与 keys 一一对应，大节点中按字节下标保存
+	numChildren int
+}
+
+// artTree 支持写时复制的自适应基数树，调用方负责并发控制
+type artTree struct {
+	root *artNode
+	size int
+	cow  *cowContext
+}
+
+func newARTTree() *artTree {
+	return &artTree{cow: new(cowContext)}
+}
+
+// clone 以 O(1) 的代价克隆一棵树
+// 两棵树都会使用新的 cowContext，之后任意一方修改共享的节点时都会先复制
+func (t *artTree) clone() *artTree {
+	t.cow = new(cowContext)
+	return &artTree{root: t.root, size: t.size, cow: new(cowContext)}
+}
+
+func (t *artTree) search(key []byte) (interface{}, bool) {
+	n, depth := t.root, 0
+	for n != nil {
+		if !bytes.HasPrefix(key[depth:], n.prefix) {
+			return nil, false
+		}
+		depth += len(n.prefix)
+		if depth == len(key) {
+			if n.leaf == nil {
+				return nil, false
+			}
+			return n.leaf.value, true
+		}
+		n = n.child(key[depth])
+		depth++
+	}
+	return nil, false
+}
+
+// insert 插入数据，key 已经存在时返回旧的 value 和 true
+func (t *artTree) insert(key []byte, value interface{}) (interface{}, bool) {
+	root, old, updated := t.insertNode(t.root, key, 0, value)
+	t.root = root
+	if !updated {
+		t.size++
+	}
+	return old, updated
+}
+
+func (t *artTree) insertNode(n *artNode, key []byte, depth int, value interface{}) (*artNode, interface{}, bool) {
+	leaf := &artLeaf{key: key, value: value}
+	if n == nil {
+		return &artNode{cow: t.cow, prefix: key[depth:], leaf: leaf}, nil, false
+	}
+	p := commonPrefixLen(n.prefix, key[depth:])
+	if p < len(n.prefix) {
+		// 前缀不完全匹配，在不匹配的位置分裂出新的节点
+		split := &artNode{cow: t.cow, prefix: n.prefix[:p]}
+		edge := n.prefix[p]
+		child := t.mutable(n)
+		child.prefix = n.prefix[p+1:]
+		split.setChild(edge, child)
+		if depth+p == len(key) {
+			split.leaf = leaf
+		} else {
+			split.setChild(key[depth+p], &artNode{cow: t.cow, prefix: key[depth+p+1:], leaf: leaf})
+		}
+		return split, nil, false
+	}
+	n = t.mutable(n)
+	depth += p
+	if depth == len(key) {
+		old := n.leaf
+		n.leaf = leaf
+		if old != nil {
+			return n, old.value, true
+		}
+		return n, nil, false
+	}
+	c := key[depth]
+	child, old, updated := t.insertNode(n.child(c), key, depth+1, value)
+	n.setChild(c, child)
+	return n, old, updated
+}
+
+// delete 删除数据，key 存在时返回旧的 value 和 true
+func (t *artTree) delete(key []byte) (interface{}, bool) {
+	root, old, deleted := t.deleteNode(t.root, key, 0)
+	if deleted {
+		t.root = root
+		t.size--
+	}
+	return old, deleted
+}
+
+func (t *artTree) deleteNode(n *artNode, key []byte, depth int) (*artNode, interface{}, bool) {
+	if n == nil || !bytes.HasPrefix(key[depth:], n.prefix) {
+		return n, nil, false
+	}
+	depth += len(n.prefix)
+	if depth == len(key) {
+		if n.leaf == nil {
+			return n, nil, false
+		}
+		old := n.leaf.value
+		n = t.mutable(n)
+		n.leaf = nil
+		return t.compact(n), old, true
+	}
+	c := key[depth]
+	child := n.child(c)
+	if child == nil {
+		return n, nil, false
+	}
+	child, old, deleted := t.deleteNode(child, key, depth+1)
+	if !deleted {
+		return n, nil, false
+	}
+	n = t.mutable(n)
+	n.setChild(c, child)
+	return t.compact(n), old, true
+}
+
+// compact 删除之后收缩节点
+// 没有数据的节点被删除，没有 leaf 且只有一个子节点的节点与子节点合并
+func (t *artTree) compact(n *artNode) *artNode {
+	if n.leaf != nil || n.numChildren > 1 {
+		return n
+	}
+	if n.numChildren == 0 {
+		return nil
+	}
+	c, child := n.firstChild()
+	merged := t.mutable(child)
+	prefix := make([]byte, 0, len(n.prefix)+1+len(child.prefix))
+	prefix = append(prefix, n.prefix...)
+	prefix = append(prefix, c)
+	merged.prefix = append(prefix, child.prefix...)
+	return merged
+}
+
+// mutable 返回可以修改的节点，节点属于其他树时先复制
+func (t *artTree) mutable(n *artNode) *artNode {
+	if n.cow == t.cow {
+		return n
+	}
+	c := &artNode{
+		cow:         t.cow,
+		prefix:      n.prefix,
+		leaf:        n.leaf,
+		numChildren: n.numChildren,
+	}
+	if len(n.keys) > 0 {
+		c.keys = append(make([]byte, 0, cap(n.keys)), n.keys...)
+	}
+	if len(n.children) > 0 {
+		c.children = append(make([]*artNode, 0, cap(n.children)), n.children...)
+	}
+	return c
+}
+
+func (n *artNode) isFull() bool {
+	return len(n.children) == 256 && len(n.keys) == 0
+}
+
+// lowerBound 返回第一个字节不小于 c 的子节点槽位
+func (n *artNode) lowerBound(c byte) int {
+	if n.isFull() {
+		return int(c)
+	}
+	return sort.Search(len(n.keys), func(i int) bool {
+		return n.keys[i] >= c
+	})
+}
+
+func (n *artNode) child(c byte) *artNode {
+	if n.isFull() {
+		return n.children[c]
+	}
+	if i := n.lowerBound(c); i < len(n.keys) && n.keys[i] == c {
+		return n.children[i]
+	}
+	return nil
+}
+
+func (n *artNode) firstChild() (byte, *artNode) {
+	if !n.isFull() {
+		return n.keys[0], n.children[0]
+	}
+	for c, child := range n.children {
+		if child != nil {
+			return byte(c), child
+		}
+	}
+	return 0, nil
+}
+
+// setChild 设置字节 c 对应的子节点，child 为 nil 时删除，节点需要是可修改的
+func (n *artNode) setChild(c byte, child *artNode) {
+	if n.isFull() {
+		if n.children[c] == nil && child != nil {
+			n.numChildren++
+		} else if n.children[c] != nil && child == nil {
+			n.numChildren--
+		}
+		n.children[c] = child
+		if n.numChildren < artNodeMinFull {
+			n.shrink()
+		}
+		return
+	}
+	i := n.lowerBound(c)
+	exists := i < len(n.keys) && n.keys[i] == c
+	switch {
+	case exists && child != nil:
+		n.children[i] = child
+	case exists:
+		n.keys = append(n.keys[:i], n.keys[i+1:]...)
+		n.children = append(n.children[:i], n.children[i+1:]...)
+		n.numChildren--
+	case child != nil:
+		n.keys = append(n.keys, 0)
+		copy(n.keys[i+1:], n.keys[i:])
+		n.keys[i] = c
+		n.children = append(n.children, nil)
+		copy(n.children[i+1:], n.children[i:])
+		n.children[i] = child
+		n.numChildren++
+		if n.numChildren > artNodeMaxSmall {
+			n.grow()
+		}
+	}
+}
+
+// grow 小节点转换为大节点
+func (n *artNode) grow() {
+	children := make([]*artNode, 256)
+	for i, c := range n.keys {
+		children[c] = n.children[i]
+	}
+	n.keys = nil
+	n.children = children
+}
+
+// shrink 大节点转换为小节点
+func (n *artNode) shrink() {
+	keys := make([]byte, 0, n.numChildren)
+	children := make([]*artNode, 0, n.numChildren)
+	for c, child := range n.children {
+		if child != nil {
+			keys = append(keys, byte(c))
+			children = append(children, child)
+		}
+	}
+	n.keys = keys
+	n.children = children
+}
+
+func commonPrefixLen(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// artTreeFrame 迭代器栈中的一层
+type artTreeFrame struct {
+	node     *artNode
+	next     int  // 下一个要访问的子节点槽位
+	leafDone bool // 当前节点的 leaf 是否已经访问过
+}
+
+// artTreeIterator 按 key 的顺序遍历树中的数据，按需访问节点，不复制数据
+// 遍历的树不能被修改，通常是 clone 得到的快照
+type artTreeIterator struct {
+	root    *artNode
+	reverse bool
+	stack   []artTreeFrame
+	curr    *artLeaf
+}
+
+func newARTTreeIterator(root *artNode, reverse bool) *artTreeIterator {
+	it := &artTreeIterator{root: root, reverse: reverse}
+	it.rewind()
+	return it
+}
+
+// firstSlot 节点中第一个要访问的子节点槽位
+func (it *artTreeIterator) firstSlot(n *artNode) int {
+	if it.reverse {
+		return len(n.children) - 1
+	}
+	return 0
+}
+
+func (it *artTreeIterator) rewind() {
+	it.stack = it.stack[:0]
+	if it.root != nil {
+		it.stack = append(it.stack, artTreeFrame{node: it.root, next: it.firstSlot(it.root)})
+	}
+	it.advance()
+}
+
+// seek 正向遍历时定位到第一个大于等于 key 的数据，反向遍历时定位到第一个小于等于 key 的数据
+func (it *artTreeIterator) seek(key []byte) {
+	it.stack = it.stack[:0]
+	n, depth := it.root, 0
+	for n != nil {
+		rest := key[depth:]
+		if p := commonPrefixLen(n.prefix, rest); p < len(n.prefix) {
+			// 前缀不匹配时，整棵子树都大于或者都小于 key
+			greater := p == len(rest) || n.prefix[p] > rest[p]
+			if greater != it.reverse {
+				it.stack = append(it.stack, artTreeFrame{node: n, next: it.firstSlot(n)})
+			}
+			break
+		}
+		depth += len(n.prefix)
+		if depth == len(key) {
+			// 子节点都大于 key，只有 leaf 可能等于 key
+			if it.reverse {
+				it.stack = append(it.stack, artTreeFrame{node: n, next: -1})
+			} else {
+				it.stack = append(it.stack, artTreeFrame{node: n, next: 0})
+			}
+			break
+		}
+		c := key[depth]
+		slot := n.lowerBound(c)
+		child := n.child(c)
+		if it.reverse {
+			it.stack = append(it.stack, artTreeFrame{node: n, next: slot - 1})
+		} else {
+			// leaf 比 key 短，一定小于 key
+			next := slot
+			if child != nil {
+				next++
+			}
+			it.stack = append(it.stack, artTreeFrame{node: n, next: next, leafDone: true})
+		}
+		n = child
+		depth++
+	}
+	it.advance()
+}
+
+// advance 移动到下一个 leaf
+// 正向遍历时先访问节点的 leaf 再访问子节点，反向遍历时顺序相反
+func (it *artTreeIterator) advance() {
+	for len(it.stack) > 0 {
+		f := &it.stack[len(it.stack)-1]
+		if !it.reverse && !f.leafDone {
+			f.leafDone = true
+			if f.node.leaf != nil {
+				it.curr = f.node.leaf
+				return
+			}
+		}
+		if child := it.nextChild(f); child != nil {
+			it.stack = append(it.stack, artTreeFrame{node: child, next: it.firstSlot(child)})
+			continue
+		}
+		if it.reverse && !f.leafDone {
+			f.leafDone = true
+			if f.node.leaf != nil {
+				it.curr = f.node.leaf
+				return
+			}
+		}
+		it.stack = it.stack[:len(it.stack)-1]
+	}
+	it.curr = nil
+}
+
+func (it *artTreeIterator) nextChild(f *artTreeFrame) *artNode {
+	children := f.node.children
+	if it.reverse {
+		for ; f.next >= 0; f.next-- {
+			if child := children[f.next]; child != nil {
+				f.next--
+				return child
+			}
+		}
+		return nil
+	}
+	for ; f.next < len(children); f.next++ {
+		if child := children[f.next]; child != nil {
+			f.next++
+			return child
+		}
+	}
+	return nil
+}
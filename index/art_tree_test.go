@@ -0,0 +1,106 @@
+package index
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// TestARTTree_Random compares the tree with a map under random inserts and deletes,
+// using short keys over a small alphabet so that prefixes, splits and node growth are exercised.
+func TestARTTree_Random(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	randomKey := func() []byte {
+		key := make([]byte, 1+rnd.Intn(4))
+		for i := range key {
+			key[i] = byte(rnd.Intn(60))
+		}
+		return key
+	}
+	tree := newARTTree()
+	model := make(map[string]int)
+	var snapshot *artTree
+	var snapshotModel map[string]int
+	for i := 0; i < 20000; i++ {
+		key := randomKey()
+		if rnd.Intn(3) == 0 {
+			_, deleted := tree.delete(key)
+			_, exists := model[string(key)]
+			assert.Equal(t, exists, deleted)
+			delete(model, string(key))
+		} else {
+			old, updated := tree.insert(key, i)
+			prev, exists := model[string(key)]
+			assert.Equal(t, exists, updated)
+			if exists {
+				assert.Equal(t, prev, old)
+			}
+			model[string(key)] = i
+		}
+		if i == 10000 {
+			snapshot = tree.clone()
+			snapshotModel = make(map[string]int, len(model))
+			for k, v := range model {
+				snapshotModel[k] = v
+			}
+		}
+	}
+	checkARTTree(t, tree, model)
+	// 克隆之后的修改不影响快照
+	checkARTTree(t, snapshot, snapshotModel)
+
+	for key := range model {
+		tree.delete([]byte(key))
+	}
+	assert.Nil(t, tree.root)
+	assert.Equal(t, 0, tree.size)
+}
+
+func checkARTTree(t *testing.T, tree *artTree, model map[string]int) {
+	assert.Equal(t, len(model), tree.size)
+	keys := make([]string, 0, len(model))
+	for key, value := range model {
+		keys = append(keys, key)
+		v, found := tree.search([]byte(key))
+		assert.True(t, found)
+		assert.Equal(t, value, v)
+	}
+	sort.Strings(keys)
+
+	var got []string
+	for it := newARTTreeIterator(tree.root, false); it.curr != nil; it.advance() {
+		got = append(got, string(it.curr.key))
+	}
+	assert.Equal(t, keys, got)
+	got = got[:0]
+	for it := newARTTreeIterator(tree.root, true); it.curr != nil; it.advance() {
+		got = append(got, string(it.curr.key))
+	}
+	for i := range got {
+		assert.Equal(t, keys[len(keys)-1-i], got[i])
+	}
+
+	// seek 到任意位置都与有序数组的二分查找结果一致
+	for target := 0; target < 200; target++ {
+		key := []byte{byte(target / 4), byte(target % 4 * 20)}[:1+target%2]
+		i := sort.SearchStrings(keys, string(key))
+		it := newARTTreeIterator(tree.root, false)
+		it.seek(key)
+		if i < len(keys) {
+			assert.Equal(t, keys[i], string(it.curr.key))
+		} else {
+			assert.Nil(t, it.curr)
+		}
+		it = newARTTreeIterator(tree.root, true)
+		it.seek(key)
+		if i < len(keys) && keys[i] == string(key) {
+			assert.True(t, bytes.Equal(key, it.curr.key))
+		} else if i > 0 {
+			assert.Equal(t, keys[i-1], string(it.curr.key))
+		} else {
+			assert.Nil(t, it.curr)
+		}
+	}
+}
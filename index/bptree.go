@@ -2,97 +2,183 @@ package index
 
 import (
 	"bitcask/data"
+	"bytes"
+	"encoding/binary"
+	"fmt"
 	"go.etcd.io/bbolt"
+	"os"
 	"path/filepath"
 )
 
 const bptreeIndexFileName = "bptree-index"
 
-var indexBucketName = []byte("bitcask-index")
+var (
+	indexBucketName = []byte("bitcask-index")
+	// metaBucketName 保存检查点等元数据
+	metaBucketName = []byte("bitcask-meta")
+	checkpointKey  = []byte("checkpoint")
+	seqNoKey       = []byte("seq-no")
+	cleanKey       = []byte("clean")
+)
 
 type BPlusTree struct {
 	tree *bbolt.DB
 }
 
 // NewBPlusTree 初始化 B+ 树索引
-func NewBPlusTree(dirPath string, syncWrites bool) *BPlusTree {
+func NewBPlusTree(dirPath string, syncWrites bool) (*BPlusTree, error) {
 	opts := bbolt.DefaultOptions
 	opts.NoSync = !syncWrites
 	bptree, err := bbolt.Open(filepath.Join(dirPath, bptreeIndexFileName), 0644, opts)
 	if err != nil {
-		panic("failed to open bptree")
+		return nil, fmt.Errorf("failed to open bptree: %w", err)
 	}
 
 	// 创建对应的 bucket
 	if err := bptree.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(indexBucketName)
+		if _, err := tx.CreateBucketIfNotExists(indexBucketName); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(metaBucketName)
 		return err
 	}); err != nil {
-		panic("failed to create bucket in bptree")
+		_ = bptree.Close()
+		return nil, fmt.Errorf("failed to create bucket in bptree: %w", err)
 	}
 
-	return &BPlusTree{tree: bptree}
+	return &BPlusTree{tree: bptree}, nil
 }
 
 // Put 将给定的键值对存储到BPlusTree中
-func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) bool {
-	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket(indexBucketName)
-		return bucket.Put(key, data.EncodeLogRecordPos(pos))
-	}); err != nil {
-		panic("failed to put value to bptree")
-	}
-	return true
+func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) error {
+	return bpt.Batch(func(w BatchWriter) error {
+		return w.Put(key, pos)
+	})
 }
 
 // Get 从BPlusTree中获取给定键对应的值
-func (bpt *BPlusTree) Get(key []byte) (pos *data.LogRecordPos) {
+func (bpt *BPlusTree) Get(key []byte) (pos *data.LogRecordPos, err error) {
+	err = bpt.tree.View(func(tx *bbolt.Tx) error {
+		pos, err = (&bptreeBatch{bucket: tx.Bucket(indexBucketName)}).Get(key)
+		return err
+	})
+	return pos, err
+}
 
-	if err := bpt.tree.View(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket(indexBucketName)
-		value := bucket.Get(key)
-		if len(value) != 0 {
-			pos = data.DecodeLogRecordPos(value)
-		}
-		return nil
-	}); err != nil {
-		panic("failed to get value from bptree")
+// Delete 从BPlusTree中删除给定键对应的值
+func (bpt *BPlusTree) Delete(key []byte) (ok bool, err error) {
+	err = bpt.Batch(func(w BatchWriter) error {
+		ok, err = w.Delete(key)
+		return err
+	})
+	return ok, err
+}
+
+// Batch 在一个 bbolt 事务中执行所有修改，只需要提交和持久化一次
+func (bpt *BPlusTree) Batch(fn func(w BatchWriter) error) error {
+	return bpt.tree.Update(func(tx *bbolt.Tx) error {
+		return fn(&bptreeBatch{bucket: tx.Bucket(indexBucketName)})
+	})
+}
+
+// bptreeBatch 在 bbolt 事务中读写索引
+type bptreeBatch struct {
+	bucket *bbolt.Bucket
+}
+
+func (b *bptreeBatch) Get(key []byte) (*data.LogRecordPos, error) {
+	if value := b.bucket.Get(key); len(value) != 0 {
+		return data.DecodeLogRecordPos(value), nil
 	}
-	return pos
+	return nil, nil
 }
 
-// Delete 从BPlusTree中删除给定键对应的值
-func (bpt *BPlusTree) Delete(key []byte) bool {
-	var ok bool
-	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket(indexBucketName)
-		if value := bucket.Get(key); len(value) != 0 {
-			ok = true
-			return bucket.Delete(key)
-		}
-		return nil
-	}); err != nil {
-		panic("failed to delete value in bptree")
+func (b *bptreeBatch) Put(key []byte, pos *data.LogRecordPos) error {
+	return b.bucket.Put(key, data.EncodeLogRecordPos(pos))
+}
+
+func (b *bptreeBatch) Delete(key []byte) (bool, error) {
+	if value := b.bucket.Get(key); len(value) == 0 {
+		return false, nil
 	}
-	return ok
+	return true, b.bucket.Delete(key)
 }
 
 // Size 返回BPlusTree中存储的键值对数量
-func (bpt *BPlusTree) Size() (size int) {
-	if err := bpt.tree.View(func(tx *bbolt.Tx) error {
+func (bpt *BPlusTree) Size() (size int, err error) {
+	err = bpt.tree.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
 		size = bucket.Stats().KeyN
 		return nil
-	}); err != nil {
-		panic("failed to get size from bptree")
+	})
+	return size, err
+}
+
+// RemoveBPlusTree 删除数据目录中的 b+树索引文件，文件不存在时不返回错误
+func RemoveBPlusTree(dirPath string) error {
+	if err := os.Remove(filepath.Join(dirPath, bptreeIndexFileName)); err != nil && !os.IsNotExist(err) {
+		return err
 	}
-	return size
+	return nil
+}
+
+// Checkpoint 返回上一次保存的检查点，没有保存过时返回 nil
+func (bpt *BPlusTree) Checkpoint() (cp *Checkpoint, err error) {
+	err = bpt.tree.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(metaBucketName)
+		value := bucket.Get(checkpointKey)
+		if len(value) == 0 {
+			return nil
+		}
+		cp = &Checkpoint{Pos: data.DecodeLogRecordPos(value), Clean: bucket.Get(cleanKey) != nil}
+		if value := bucket.Get(seqNoKey); len(value) != 0 {
+			cp.SeqNo, _ = binary.Uvarint(value)
+		}
+		return nil
+	})
+	return cp, err
+}
+
+// SaveCheckpoint 记录检查点，调用 Sync 之后才会持久化
+func (bpt *BPlusTree) SaveCheckpoint(cp *Checkpoint) error {
+	return bpt.tree.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(metaBucketName)
+		if err := bucket.Put(checkpointKey, data.EncodeLogRecordPos(cp.Pos)); err != nil {
+			return err
+		}
+		if err := bucket.Put(seqNoKey, binary.AppendUvarint(nil, cp.SeqNo)); err != nil {
+			return err
+		}
+		if cp.Clean {
+			return bucket.Put(cleanKey, []byte{1})
+		}
+		return bucket.Delete(cleanKey)
+	})
+}
+
+// Reset 清空索引和检查点
+func (bpt *BPlusTree) Reset() error {
+	return bpt.tree.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{indexBucketName, metaBucketName} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Sync 将索引数据持久化到磁盘
+func (bpt *BPlusTree) Sync() error {
+	return bpt.tree.Sync()
 }
 func (bpt *BPlusTree) Close() error {
 	return bpt.tree.Close()
 }
-func (bpt *BPlusTree) Iterator(reverse bool) Iterator {
-
+func (bpt *BPlusTree) Iterator(reverse bool) (Iterator, error) {
 	return newBptreeIterator(bpt.tree, reverse)
 }
 
@@ -106,18 +192,18 @@ type bptreeIterator struct {
 	currPos   *data.LogRecordPos // 缓存解码后的位置信息
 }
 
-func newBptreeIterator(tree *bbolt.DB, reverse bool) (bpi *bptreeIterator) {
+func newBptreeIterator(tree *bbolt.DB, reverse bool) (*bptreeIterator, error) {
 	tx, err := tree.Begin(false)
 	if err != nil {
-		panic("failed to begin transaction")
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
-	bpi = &bptreeIterator{
+	bpi := &bptreeIterator{
 		tx:      tx,
 		cursor:  tx.Bucket(indexBucketName).Cursor(),
 		reverse: reverse,
 	}
 	bpi.Rewind()
-	return
+	return bpi, nil
 }
 func (b *bptreeIterator) Rewind() {
 	if b.reverse {
@@ -130,6 +216,14 @@ func (b *bptreeIterator) Rewind() {
 
 func (b *bptreeIterator) Seek(key []byte) {
 	b.currKey, b.currValue = b.cursor.Seek(key)
+	// 反向遍历时需要定位到第一个小于等于 key 的位置
+	if b.reverse {
+		if b.currKey == nil {
+			b.currKey, b.currValue = b.cursor.Last()
+		} else if !bytes.Equal(b.currKey, key) {
+			b.currKey, b.currValue = b.cursor.Prev()
+		}
+	}
 	b.decodeCurrPos()
 }
 
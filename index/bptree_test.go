@@ -13,7 +13,8 @@ func TestNewBPlusTree(t *testing.T) {
 	// 获取临时目录路径
 	path := os.TempDir()
 	// 创建BPlusTree对象
-	tree := NewBPlusTree(path, false)
+	tree, err := NewBPlusTree(path, false)
+	assert.Nil(t, err)
 
 	// 在函数结束时删除临时目录
 	defer func() {
@@ -22,6 +23,7 @@ func TestNewBPlusTree(t *testing.T) {
 
 	// 断言BPlusTree对象不为nil
 	assert.NotNil(t, tree)
+	assert.Nil(t, tree.Close())
 }
 
 // TestBPlusTree_Put 测试函数用于测试BPlusTree的Put方法
@@ -30,7 +32,8 @@ func TestBPlusTree_Put(t *testing.T) {
 	path := filepath.Join(os.TempDir(), "bptree-put")
 	_ = os.MkdirAll(path, os.ModePerm)
 	// 创建BPlusTree对象
-	tree := NewBPlusTree(path, false)
+	tree, err := NewBPlusTree(path, false)
+	assert.Nil(t, err)
 	// 在函数结束时删除临时目录
 	defer func() {
 		_ = os.RemoveAll(path)
@@ -40,19 +43,19 @@ func TestBPlusTree_Put(t *testing.T) {
 	assert.NotNil(t, tree)
 
 	// 调用Put方法，将"aac"和LogRecordPos对象插入BPlusTree
-	res1 := tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 999})
-	// 断言返回结果不为nil
-	assert.NotNil(t, res1)
+	err = tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 999})
+	// 断言没有返回错误
+	assert.Nil(t, err)
 
 	// 调用Put方法，将"abc"和LogRecordPos对象插入BPlusTree
-	res2 := tree.Put([]byte("abc"), &data.LogRecordPos{Fid: 123, Offset: 999})
-	// 断言返回结果不为nil
-	assert.NotNil(t, res2)
+	err = tree.Put([]byte("abc"), &data.LogRecordPos{Fid: 123, Offset: 999})
+	// 断言没有返回错误
+	assert.Nil(t, err)
 
 	// 调用Put方法，将"acc"和LogRecordPos对象插入BPlusTree
-	res3 := tree.Put([]byte("acc"), &data.LogRecordPos{Fid: 123, Offset: 999})
-	// 断言返回结果不为nil
-	assert.NotNil(t, res3)
+	err = tree.Put([]byte("acc"), &data.LogRecordPos{Fid: 123, Offset: 999})
+	// 断言没有返回错误
+	assert.Nil(t, err)
 }
 
 // TestBPlusTree_Get 测试BPlusTree的Get方法
@@ -62,20 +65,24 @@ func TestBPlusTree_Get(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(path)
 	}()
-	tree := NewBPlusTree(path, false)
+	tree, err := NewBPlusTree(path, false)
+	assert.Nil(t, err)
 
 	// 获取不存在的元素
-	pos := tree.Get([]byte("not exist"))
+	pos, err := tree.Get([]byte("not exist"))
+	assert.Nil(t, err)
 	assert.Nil(t, pos)
 
 	// 添加元素并获取
 	tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 999})
-	pos1 := tree.Get([]byte("aac"))
+	pos1, err := tree.Get([]byte("aac"))
+	assert.Nil(t, err)
 	assert.NotNil(t, pos1)
 
 	// 更新元素并获取
 	tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 9884, Offset: 1232})
-	pos2 := tree.Get([]byte("aac"))
+	pos2, err := tree.Get([]byte("aac"))
+	assert.Nil(t, err)
 	assert.NotNil(t, pos2)
 }
 
@@ -86,19 +93,23 @@ func TestBPlusTree_Delete(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(path)
 	}()
-	tree := NewBPlusTree(path, false)
+	tree, err := NewBPlusTree(path, false)
+	assert.Nil(t, err)
 
 	// 删除不存在的元素
-	ok1 := tree.Delete([]byte("not exist"))
+	ok1, err := tree.Delete([]byte("not exist"))
+	assert.Nil(t, err)
 	assert.False(t, ok1)
 
 	// 添加元素并删除
 	tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 999})
-	ok2 := tree.Delete([]byte("aac"))
+	ok2, err := tree.Delete([]byte("aac"))
+	assert.Nil(t, err)
 	assert.True(t, ok2)
 
 	// 获取已删除的元素
-	pos1 := tree.Get([]byte("aac"))
+	pos1, err := tree.Get([]byte("aac"))
+	assert.Nil(t, err)
 	assert.Nil(t, pos1)
 }
 func TestBPlusTree_Size(t *testing.T) {
@@ -107,15 +118,20 @@ func TestBPlusTree_Size(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(path)
 	}()
-	tree := NewBPlusTree(path, false)
+	tree, err := NewBPlusTree(path, false)
+	assert.Nil(t, err)
 
-	assert.Equal(t, 0, tree.Size())
+	size, err := tree.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, size)
 
 	tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 999})
 	tree.Put([]byte("abc"), &data.LogRecordPos{Fid: 123, Offset: 999})
 	tree.Put([]byte("acc"), &data.LogRecordPos{Fid: 123, Offset: 999})
 
-	assert.Equal(t, 3, tree.Size())
+	size, err = tree.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, size)
 }
 func TestBPlusTree_Iterator(t *testing.T) {
 	path := filepath.Join(os.TempDir(), "bptree-iter")
@@ -123,7 +139,8 @@ func TestBPlusTree_Iterator(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(path)
 	}()
-	tree := NewBPlusTree(path, false)
+	tree, err := NewBPlusTree(path, false)
+	assert.Nil(t, err)
 
 	tree.Put([]byte("caac"), &data.LogRecordPos{Fid: 123, Offset: 999})
 	tree.Put([]byte("bbca"), &data.LogRecordPos{Fid: 123, Offset: 999})
@@ -131,9 +148,69 @@ func TestBPlusTree_Iterator(t *testing.T) {
 	tree.Put([]byte("ccec"), &data.LogRecordPos{Fid: 123, Offset: 999})
 	tree.Put([]byte("bbba"), &data.LogRecordPos{Fid: 123, Offset: 999})
 
-	iter := tree.Iterator(false)
+	iter, err := tree.Iterator(false)
+	assert.Nil(t, err)
 	for iter.Rewind(); iter.Valid(); iter.Next() {
 		assert.NotNil(t, iter.Key())
 		assert.NotNil(t, iter.Value())
 	}
 }
+
+func TestBPlusTree_Iterator_Seek(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bptree-iter-seek")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	tree, err := NewBPlusTree(path, false)
+	assert.Nil(t, err)
+	for _, key := range []string{"aa", "bb", "cc"} {
+		tree.Put([]byte(key), &data.LogRecordPos{Fid: 1, Offset: 10})
+	}
+
+	iter, err := tree.Iterator(false)
+	assert.Nil(t, err)
+	iter.Seek([]byte("b"))
+	assert.Equal(t, []byte("bb"), iter.Key())
+	iter.Close()
+
+	// 反向遍历时定位到第一个小于等于 key 的位置
+	iter, err = tree.Iterator(true)
+	assert.Nil(t, err)
+	iter.Seek([]byte("bc"))
+	assert.Equal(t, []byte("bb"), iter.Key())
+	iter.Seek([]byte("bb"))
+	assert.Equal(t, []byte("bb"), iter.Key())
+	iter.Seek([]byte("zz"))
+	assert.Equal(t, []byte("cc"), iter.Key())
+	iter.Seek([]byte("a"))
+	assert.False(t, iter.Valid())
+	iter.Close()
+}
+
+func TestBPlusTree_Closed(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bptree-closed")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	tree, err := NewBPlusTree(path, false)
+	assert.Nil(t, err)
+	assert.Nil(t, tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 999}))
+	assert.Nil(t, tree.Close())
+
+	// 关闭之后的操作返回错误而不是 panic
+	assert.NotNil(t, tree.Put([]byte("abc"), &data.LogRecordPos{Fid: 123, Offset: 999}))
+	_, err = tree.Get([]byte("aac"))
+	assert.NotNil(t, err)
+	_, err = tree.Delete([]byte("aac"))
+	assert.NotNil(t, err)
+	_, err = tree.Size()
+	assert.NotNil(t, err)
+	_, err = tree.Iterator(false)
+	assert.NotNil(t, err)
+
+	// 目录不存在时创建失败
+	_, err = NewBPlusTree(filepath.Join(path, "not-exist"), false)
+	assert.NotNil(t, err)
+}
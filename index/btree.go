@@ -3,7 +3,6 @@ package index
 import (
 	"bitcask/data"
 	"bytes"
-	"sort"
 	"sync"
 )
 import "github.com/google/btree"
@@ -11,18 +10,21 @@ import "github.com/google/btree"
 // BTree 索引，主要封装了 google 的 btree ku
 // https://github.com/google/btree
 type BTree struct {
-	tree *btree.BTree
-	lock *sync.RWMutex // 写操作并发不安全，读操作并发安全
+	tree     *btree.BTree
+	lock     *sync.RWMutex // 写操作并发不安全，读操作并发安全
+	keyBytes int64         // 所有 key 的总长度
 }
 
-func (bt *BTree) Iterator(reverse bool) Iterator {
-	if bt == nil {
-		return nil
-	}
-	bt.lock.RLock()
-	defer bt.lock.RUnlock()
-	return newBTreeIterator(bt.tree, reverse)
+// btreeItemOverhead 每个索引项除 key 之外的内存占用估算值
+// Item 结构体 32 字节，LogRecordPos 24 字节，btree 节点中的 interface 16 字节
+const btreeItemOverhead = 72
 
+func (bt *BTree) Iterator(reverse bool) (Iterator, error) {
+	// Clone 会修改原来的树的写时复制标识，需要持有写锁
+	bt.lock.Lock()
+	snapshot := bt.tree.Clone()
+	bt.lock.Unlock()
+	return newBTreeIterator(snapshot, reverse), nil
 }
 
 // NewBTree 初始化 BTree 索引结构
@@ -34,117 +36,155 @@ func NewBTree() *BTree {
 }
 
 // Put 将 key-value 对添加到 BTree 中
-func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) bool {
+func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) error {
 	it := &Item{key: key, pos: pos}
 	bt.lock.Lock()
-	bt.tree.ReplaceOrInsert(it)
+	if bt.tree.ReplaceOrInsert(it) == nil {
+		bt.keyBytes += int64(len(key))
+	}
 	bt.lock.Unlock()
-	return true
+	return nil
 }
 
 // Get 根据 key 从 BTree 中获取对应的 value
-func (bt *BTree) Get(key []byte) *data.LogRecordPos {
+func (bt *BTree) Get(key []byte) (*data.LogRecordPos, error) {
 	it := &Item{key: key}
+	bt.lock.RLock()
 	btreeItem := bt.tree.Get(it)
+	bt.lock.RUnlock()
 	//空直接返回
 	if btreeItem == nil {
-		return nil
+		return nil, nil
 	}
 	// 转换结构
-	return btreeItem.(*Item).pos
+	return btreeItem.(*Item).pos, nil
 }
 
 // Delete 从 BTree 中删除指定的 key
-func (bt *BTree) Delete(key []byte) bool {
+func (bt *BTree) Delete(key []byte) (bool, error) {
 	it := &Item{key: key}
 	bt.lock.Lock()
 	oldItem := bt.tree.Delete(it)
+	if oldItem != nil {
+		bt.keyBytes -= int64(len(key))
+	}
 	bt.lock.Unlock()
 	// 如果原本不存在，则本次删除为一次无效的操作
-	if oldItem == nil {
-		return false
-	}
-	return true
+	return oldItem != nil, nil
 }
 
 // Size 获取数据量
-func (bt *BTree) Size() int {
-	return bt.tree.Len()
+func (bt *BTree) Size() (int, error) {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
+	return bt.tree.Len(), nil
+}
+
+// MemoryUsage 估算索引占用的内存
+func (bt *BTree) MemoryUsage() int64 {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
+	return int64(bt.tree.Len())*btreeItemOverhead + bt.keyBytes
 }
 func (bt *BTree) Close() error {
 	return nil
 }
 
-// BTree 迭代器
+// btreeIteratorBatch 迭代器每次从快照中读取的数据量
+const btreeIteratorBatch = 64
+
+// BTree 迭代器，在 Clone 得到的快照上按需遍历，每次只读取一批数据
 type btreeIterator struct {
-	// 当前遍历的下标位置
-	currIndex int
+	// 创建迭代器时的快照，之后对索引的修改不可见
+	tree *btree.BTree
 	// 是否反向遍历
 	reverse bool
-	// key+位置索引信息
-	values []*Item
+	// 当前批次的数据
+	items []*Item
+	// 当前遍历的下标位置
+	currIndex int
+	// 快照中是否还有当前批次之后的数据
+	hasMore bool
 }
 
 func newBTreeIterator(tree *btree.BTree, reverse bool) *btreeIterator {
-	var idx int
-	values := make([]*Item, tree.Len())
-	saveValues := func(it btree.Item) bool {
-		values[idx] = it.(*Item)
-		idx++
-		return true
+	bti := &btreeIterator{
+		tree:    tree,
+		reverse: reverse,
+		items:   make([]*Item, 0, btreeIteratorBatch),
 	}
-	if reverse {
-		tree.Descend(saveValues)
-	} else {
-		tree.Ascend(saveValues)
+	bti.Rewind()
+	return bti
+}
 
+// load 从 pivot 开始读取一批数据，pivot 为空时从头开始
+// skipPivot 为 true 时跳过与 pivot 相等的数据，用于接着上一批继续读取
+func (bt *btreeIterator) load(pivot *Item, skipPivot bool) {
+	bt.items = bt.items[:0]
+	bt.currIndex = 0
+	bt.hasMore = false
+	if bt.tree == nil {
+		return
 	}
-	return &btreeIterator{
-		currIndex: 0,
-		reverse:   reverse,
-		values:    values,
+	collect := func(it btree.Item) bool {
+		item := it.(*Item)
+		if skipPivot && bytes.Equal(item.key, pivot.key) {
+			return true
+		}
+		bt.items = append(bt.items, item)
+		return len(bt.items) < btreeIteratorBatch
 	}
+	switch {
+	case pivot == nil && bt.reverse:
+		bt.tree.Descend(collect)
+	case pivot == nil:
+		bt.tree.Ascend(collect)
+	case bt.reverse:
+		bt.tree.DescendLessOrEqual(pivot, collect)
+	default:
+		bt.tree.AscendGreaterOrEqual(pivot, collect)
+	}
+	bt.hasMore = len(bt.items) == btreeIteratorBatch
 }
 
 // Rewind rewinds the iterator to the beginning of the BTree.
 func (bt *btreeIterator) Rewind() {
-	bt.currIndex = 0
+	bt.load(nil, false)
 }
 
+// Seek moves to the first key greater than or equal to the given key,
+// or less than or equal to it when iterating in reverse.
 func (bt *btreeIterator) Seek(key []byte) {
-	//btree 有序，使用二分查找加速
-	if bt.reverse {
-		bt.currIndex = sort.Search(len(bt.values), func(i int) bool {
-			return bytes.Compare(bt.values[i].key, key) <= 0
-		})
-	} else {
-		bt.currIndex = sort.Search(len(bt.values), func(i int) bool {
-			return bytes.Compare(bt.values[i].key, key) >= 0
-		})
-	}
+	bt.load(&Item{key: key}, false)
 }
 
 // Next moves the iterator to the next element in the BTree.
 func (bt *btreeIterator) Next() {
 	bt.currIndex++
+	if bt.currIndex == len(bt.items) && bt.hasMore {
+		bt.load(bt.items[len(bt.items)-1], true)
+	}
 }
 
 // Valid returns true if the iterator is still valid, false otherwise.
 func (bt *btreeIterator) Valid() bool {
-	return bt.currIndex < len(bt.values)
+	return bt.currIndex < len(bt.items)
 }
 
 // Key returns the key of the current element in the BTree.
 func (bt *btreeIterator) Key() []byte {
-	return bt.values[bt.currIndex].key
+	return bt.items[bt.currIndex].key
 }
 
 // Value returns the value of the current element in the BTree.
 func (bt *btreeIterator) Value() *data.LogRecordPos {
-	return bt.values[bt.currIndex].pos
+	return bt.items[bt.currIndex].pos
 }
 
-// Close closes the iterator and releases any resources it was using.
+// Close closes the iterator and releases the snapshot.
 func (bt *btreeIterator) Close() {
-	bt.values = nil
+	bt.tree = nil
+	bt.items = nil
+	bt.currIndex = 0
+	bt.hasMore = false
 }
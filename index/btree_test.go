@@ -2,6 +2,7 @@ package index
 
 import (
 	"bitcask/data"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -12,11 +13,10 @@ func TestBTree_Put(t *testing.T) {
 	bt := NewBTree()
 
 	// Add a key-value pair to the BTree.
-	res := bt.Put(nil, &data.LogRecordPos{
+	assert.Nil(t, bt.Put(nil, &data.LogRecordPos{
 		Fid:    1,
 		Offset: 100,
-	})
-	assert.True(t, res)
+	}))
 }
 
 // TestBTree_Get is a unit test for the Get method of the BTree struct.
@@ -25,38 +25,38 @@ func TestBTree_Get(t *testing.T) {
 	bt := NewBTree()
 
 	// Add a key-value pair to the BTree.
-	res1 := bt.Put(nil, &data.LogRecordPos{
+	assert.Nil(t, bt.Put(nil, &data.LogRecordPos{
 		Fid:    1,
 		Offset: 100,
-	})
-	assert.True(t, res1)
+	}))
 
 	// Retrieve the value associated with the key from the BTree.
-	pos1 := bt.Get(nil)
+	pos1, err := bt.Get(nil)
+	assert.Nil(t, err)
 	assert.Equal(t, uint32(1), pos1.Fid)
 	assert.Equal(t, int64(100), pos1.Offset)
 
 	// Add another key-value pair to the BTree.
-	res2 := bt.Put([]byte("a"), &data.LogRecordPos{
+	assert.Nil(t, bt.Put([]byte("a"), &data.LogRecordPos{
 		Fid:    2,
 		Offset: 101,
-	})
-	assert.True(t, res2)
+	}))
 
 	// Retrieve the value associated with the key from the BTree.
-	pos2 := bt.Get([]byte("a"))
+	pos2, err := bt.Get([]byte("a"))
+	assert.Nil(t, err)
 	assert.Equal(t, uint32(2), pos2.Fid)
 	assert.Equal(t, int64(101), pos2.Offset)
 
 	// Add another key-value pair to the BTree.
-	res3 := bt.Put([]byte("b"), &data.LogRecordPos{
+	assert.Nil(t, bt.Put([]byte("b"), &data.LogRecordPos{
 		Fid:    3,
 		Offset: 102,
-	})
-	assert.True(t, res3)
+	}))
 
 	// Retrieve the value associated with the key from the BTree.
-	pos3 := bt.Get([]byte("b"))
+	pos3, err := bt.Get([]byte("b"))
+	assert.Nil(t, err)
 	assert.Equal(t, uint32(3), pos3.Fid)
 	assert.Equal(t, int64(102), pos3.Offset)
 }
@@ -67,18 +67,37 @@ func TestBTree_Delete(t *testing.T) {
 	bt := NewBTree()
 
 	// Add a key-value pair to the BTree.
-	res := bt.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
-	assert.True(t, res)
+	assert.Nil(t, bt.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100}))
 
 	// Delete the key-value pair from the BTree.
-	assert.True(t, bt.Delete(nil))
+	ok, err := bt.Delete(nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
 
 	// Add another key-value pair to the BTree.
-	res2 := bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 100})
-	assert.True(t, res2)
+	assert.Nil(t, bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 100}))
 
 	// Delete the key-value pair from the BTree.
-	assert.True(t, bt.Delete([]byte("a")))
+	ok, err = bt.Delete([]byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+// TestBTree_MemoryUsage checks that the memory estimate follows puts and deletes.
+func TestBTree_MemoryUsage(t *testing.T) {
+	bt := NewBTree()
+	assert.Equal(t, int64(0), bt.MemoryUsage())
+
+	bt.Put([]byte("key-1"), &data.LogRecordPos{Fid: 1, Offset: 12})
+	usage := bt.MemoryUsage()
+	assert.Equal(t, int64(btreeItemOverhead+5), usage)
+
+	// 更新已经存在的 key 不会增加内存占用
+	bt.Put([]byte("key-1"), &data.LogRecordPos{Fid: 1, Offset: 24})
+	assert.Equal(t, usage, bt.MemoryUsage())
+
+	bt.Delete([]byte("key-1"))
+	assert.Equal(t, int64(0), bt.MemoryUsage())
 }
 
 // TestBTree_Iterator is a test function for the BTree iterator.
@@ -87,12 +106,14 @@ func TestBTree_Iterator(t *testing.T) {
 	bt1 := NewBTree()
 
 	// BTree is empty.
-	iter1 := bt1.Iterator(false)
+	iter1, err := bt1.Iterator(false)
+	assert.Nil(t, err)
 	assert.Equal(t, iter1.Valid(), false)
 
 	// BTree has one data.
 	bt1.Put([]byte("key"), &data.LogRecordPos{Fid: 1, Offset: 100})
-	iter2 := bt1.Iterator(false)
+	iter2, err := bt1.Iterator(false)
+	assert.Nil(t, err)
 	assert.Equal(t, iter2.Valid(), true)
 	iter2.Next()
 	assert.Equal(t, iter2.Valid(), false)
@@ -101,24 +122,90 @@ func TestBTree_Iterator(t *testing.T) {
 	bt1.Put([]byte("key1"), &data.LogRecordPos{Fid: 1, Offset: 100})
 	bt1.Put([]byte("key2"), &data.LogRecordPos{Fid: 1, Offset: 100})
 	bt1.Put([]byte("key3"), &data.LogRecordPos{Fid: 1, Offset: 100})
-	iter3 := bt1.Iterator(false)
+	iter3, err := bt1.Iterator(false)
+	assert.Nil(t, err)
 	for iter3.Rewind(); iter3.Valid(); iter3.Next() {
 		assert.NotNil(t, iter3.Key())
 		assert.NotNil(t, iter3.Value())
 	}
-	iter4 := bt1.Iterator(true)
+	iter4, err := bt1.Iterator(true)
+	assert.Nil(t, err)
 	for iter4.Rewind(); iter4.Valid(); iter4.Next() {
 		assert.NotNil(t, iter4.Key())
 		assert.NotNil(t, iter4.Value())
 	}
 
 	// Seek test.
-	iter5 := bt1.Iterator(false)
+	iter5, err := bt1.Iterator(false)
+	assert.Nil(t, err)
 	for iter5.Seek([]byte("key2")); iter5.Valid(); iter5.Next() {
 		assert.NotNil(t, iter5.Key())
 	}
-	iter6 := bt1.Iterator(true)
+	iter6, err := bt1.Iterator(true)
+	assert.Nil(t, err)
 	for iter6.Seek([]byte("key2")); iter6.Valid(); iter6.Next() {
 		assert.NotNil(t, iter6.Key())
 	}
 }
+
+// testIteratorSnapshot checks ordering, seeking and snapshot isolation of an index iterator
+// over more keys than a single iterator batch.
+func testIteratorSnapshot(t *testing.T, idx Indexer) {
+	var keys []string
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key-%04d", i*2)
+		keys = append(keys, key)
+		assert.Nil(t, idx.Put([]byte(key), &data.LogRecordPos{Fid: 1, Offset: int64(i)}))
+	}
+	forward, err := idx.Iterator(false)
+	assert.Nil(t, err)
+	defer forward.Close()
+	reverse, err := idx.Iterator(true)
+	assert.Nil(t, err)
+	defer reverse.Close()
+
+	// 创建迭代器之后的修改不可见
+	for i := 0; i < 500; i += 2 {
+		idx.Delete([]byte(keys[i]))
+	}
+	idx.Put([]byte("key-0001"), &data.LogRecordPos{Fid: 2})
+	idx.Put([]byte(keys[1]), &data.LogRecordPos{Fid: 3})
+
+	var got []string
+	for forward.Rewind(); forward.Valid(); forward.Next() {
+		got = append(got, string(forward.Key()))
+		assert.Equal(t, uint32(1), forward.Value().Fid)
+	}
+	assert.Equal(t, keys, got)
+	got = got[:0]
+	for reverse.Rewind(); reverse.Valid(); reverse.Next() {
+		got = append(got, string(reverse.Key()))
+	}
+	assert.Equal(t, len(keys), len(got))
+	assert.Equal(t, keys[len(keys)-1], got[0])
+	assert.Equal(t, keys[0], got[len(got)-1])
+
+	forward.Seek([]byte("key-0101"))
+	assert.Equal(t, "key-0102", string(forward.Key()))
+	forward.Seek([]byte("key-0102"))
+	assert.Equal(t, "key-0102", string(forward.Key()))
+	reverse.Seek([]byte("key-0101"))
+	assert.Equal(t, "key-0100", string(reverse.Key()))
+	reverse.Seek([]byte("key-0998"))
+	assert.Equal(t, "key-0998", string(reverse.Key()))
+	forward.Seek([]byte("key-9"))
+	assert.False(t, forward.Valid())
+	reverse.Seek([]byte("a"))
+	assert.False(t, reverse.Valid())
+
+	// 新的迭代器可以看到修改
+	iter, err := idx.Iterator(false)
+	assert.Nil(t, err)
+	defer iter.Close()
+	assert.Equal(t, "key-0001", string(iter.Key()))
+}
+
+// TestBTree_Iterator_Snapshot verifies that the iterator reads lazily from a snapshot.
+func TestBTree_Iterator_Snapshot(t *testing.T) {
+	testIteratorSnapshot(t, NewBTree())
+}
@@ -0,0 +1,114 @@
+package index
+
+import (
+	"bitcask/data"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+// TestHashIndex_Random 随机写入和删除，结果与 map 保持一致
+func TestHashIndex_Random(t *testing.T) {
+	hi := NewHashIndex()
+	expected := make(map[string]int64)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 50000; i++ {
+		key := fmt.Sprintf("key-%d", r.Intn(5000))
+		if r.Intn(3) == 0 {
+			ok, err := hi.Delete([]byte(key))
+			assert.Nil(t, err)
+			_, exist := expected[key]
+			assert.Equal(t, exist, ok)
+			delete(expected, key)
+		} else {
+			assert.Nil(t, hi.Put([]byte(key), &data.LogRecordPos{Fid: 1, Offset: int64(i)}))
+			expected[key] = int64(i)
+		}
+	}
+	size, err := hi.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, len(expected), size)
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		pos, err := hi.Get([]byte(key))
+		assert.Nil(t, err)
+		if offset, ok := expected[key]; ok {
+			assert.Equal(t, offset, pos.Offset)
+		} else {
+			assert.Nil(t, pos)
+		}
+	}
+}
+
+func TestHashIndex_CompactKeys(t *testing.T) {
+	hi := NewHashIndex()
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%01024d", i)) }
+	for i := 0; i < 3000; i++ {
+		assert.Nil(t, hi.Put(key(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)}))
+	}
+	iter, err := hi.Iterator(false)
+	assert.Nil(t, err)
+	defer iter.Close()
+
+	// 删除的 key 超过一半之后整理内存
+	for i := 0; i < 1501; i++ {
+		ok, err := hi.Delete(key(i))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+	}
+	assert.Equal(t, int64(0), hi.deadBytes)
+	assert.Equal(t, 1499*1024, len(hi.keys))
+	assert.Equal(t, int64(4096*hashSlotSize+1499*1024), hi.MemoryUsage())
+	for i := 1501; i < 3000; i++ {
+		pos, err := hi.Get(key(i))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(i), pos.Offset)
+	}
+
+	// 整理之前创建的迭代器仍然可以读取所有 key
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, key(count), iter.Key())
+		count++
+	}
+	assert.Equal(t, 3000, count)
+}
+
+// TestHashIndex_Shrink 删除大部分 key 之后哈希表缩容，剩余的 key 仍然可以读取
+func TestHashIndex_Shrink(t *testing.T) {
+	hi := NewHashIndex()
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key-%d", i)) }
+	for i := 0; i < 10000; i++ {
+		assert.Nil(t, hi.Put(key(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)}))
+	}
+	assert.Equal(t, 16384, len(hi.slots))
+
+	for i := 0; i < 9900; i++ {
+		ok, err := hi.Delete(key(i))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.True(t, hi.count*8 >= len(hi.slots) || len(hi.slots) == hashInitSlots)
+	}
+	assert.Equal(t, 512, len(hi.slots))
+	for i := 9900; i < 10000; i++ {
+		pos, err := hi.Get(key(i))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(i), pos.Offset)
+	}
+
+	// 全部删除之后回到初始大小
+	for i := 9900; i < 10000; i++ {
+		ok, err := hi.Delete(key(i))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+	}
+	assert.Equal(t, hashInitSlots, len(hi.slots))
+	size, err := hi.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, size)
+}
+
+func TestHashIndex_Iterator_Snapshot(t *testing.T) {
+	testIteratorSnapshot(t, NewHashIndex())
+}
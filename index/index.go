@@ -3,27 +3,81 @@ package index
 import (
 	"bitcask/data"
 	"bytes"
+	"errors"
 	"github.com/google/btree"
+	"sync"
+)
+
+var (
+	ErrUnsupportedIndexType = errors.New("unsupported index type")
 )
 
 // Indexer TODO 添加art实现
 // Indexer 抽象索引接口，后续如果想要接入其他的数据结构，则直接实现这个接口即可
+// 磁盘索引的读写可能失败，所有方法都通过 error 返回错误，不会 panic
 type Indexer interface {
 	// Put 向索引中存储 key 对应的数据位置信息
-	Put(key []byte, pos *data.LogRecordPos) bool
+	Put(key []byte, pos *data.LogRecordPos) error
 
-	// Get 根据 key 取出对应的索引位置信息
-	Get(key []byte) *data.LogRecordPos
+	// Get 根据 key 取出对应的索引位置信息，key 不存在时返回 nil
+	Get(key []byte) (*data.LogRecordPos, error)
 
-	// Delete 根据 key 删除对应的索引位置信息
-	Delete(key []byte) bool
+	// Delete 根据 key 删除对应的索引位置信息，返回 key 是否存在
+	Delete(key []byte) (bool, error)
 	// Iterator 索引迭代器
-	Iterator(reverse bool) Iterator
+	Iterator(reverse bool) (Iterator, error)
 	//Size 索引中的数据量
-	Size() int
+	Size() (int, error)
 	Close() error
 }
 
+// MemorySizer 可以统计内存占用的索引
+type MemorySizer interface {
+	// MemoryUsage 返回索引占用的内存字节数
+	MemoryUsage() int64
+}
+
+// BatchWriter 在批量操作中读写索引
+type BatchWriter interface {
+	Get(key []byte) (*data.LogRecordPos, error)
+	Put(key []byte, pos *data.LogRecordPos) error
+	Delete(key []byte) (bool, error)
+}
+
+// Batcher 可以把多个修改合并到一次操作中的索引，例如 b+树在一个事务中完成所有修改
+type Batcher interface {
+	// Batch 执行 fn 中的所有修改，fn 返回错误时所有修改都不会生效
+	Batch(fn func(w BatchWriter) error) error
+}
+
+// Batch 批量修改索引，索引没有实现 Batcher 时直接逐个执行，出错时已经执行的修改不会撤销
+func Batch(idx Indexer, fn func(w BatchWriter) error) error {
+	if batcher, ok := idx.(Batcher); ok {
+		return batcher.Batch(fn)
+	}
+	return fn(idx)
+}
+
+// Checkpointer 持久化到磁盘的索引，记录已经应用到索引中的最后一条数据的位置
+// 重新打开时从检查点开始重放数据文件，恢复崩溃时没有持久化的修改
+type Checkpointer interface {
+	// Checkpoint 返回上一次保存的检查点，没有保存过时返回 nil
+	Checkpoint() (*Checkpoint, error)
+	// SaveCheckpoint 记录检查点
+	SaveCheckpoint(cp *Checkpoint) error
+	// Reset 清空索引和检查点，用于检查点失效时重新构建索引
+	Reset() error
+}
+
+// Checkpoint 索引的检查点
+type Checkpoint struct {
+	Pos   *data.LogRecordPos // Pos 之前的数据都已经应用到索引中
+	SeqNo uint64             // 保存检查点时的事务序列号
+	// Clean 表示保存检查点之后索引没有再被修改，也就是上一次是正常关闭的
+	// 保存 Clean 为 true 的检查点之后不能再修改索引，直到重新记录 Clean 为 false 的检查点
+	Clean bool
+}
+
 // IndexType 索引类型
 type IndexType = int8
 
@@ -33,21 +87,75 @@ const (
 	// ART 自适应基数树索引
 	ART
 	BPTree //B+树
+	// Sharded 按 key 的哈希分片的 BTree 索引
+	Sharded
+	// Hash 哈希索引
+	Hash
+	// Arena 把 key 和位置信息保存在大块内存中的有序索引
+	Arena
+)
+
+// Factory 创建索引，dir 为数据目录，sync 表示每次写入之后是否持久化
+type Factory func(dir string, sync bool) (Indexer, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+	// builtinNames 内置索引类型注册时使用的名称
+	builtinNames = map[IndexType]string{
+		Btree:   "btree",
+		ART:     "art",
+		BPTree:  "bptree",
+		Sharded: "sharded",
+		Hash:    "hash",
+		Arena:   "arena",
+	}
 )
 
-// NewIndexer 初试化索引
-func NewIndexer(tp IndexType, dir string, sync bool) Indexer {
-	switch tp {
-	case Btree:
-		return NewBTree()
-	case ART:
-		//todo
-		return NewART()
-	case BPTree:
-		return NewBPlusTree(dir, sync)
-	default:
-		panic("unsupported index type")
+func init() {
+	Register(builtinNames[Btree], func(string, bool) (Indexer, error) { return NewBTree(), nil })
+	Register(builtinNames[ART], func(string, bool) (Indexer, error) { return NewART(), nil })
+	Register(builtinNames[BPTree], func(dir string, sync bool) (Indexer, error) { return NewBPlusTree(dir, sync) })
+	Register(builtinNames[Sharded], func(string, bool) (Indexer, error) { return NewShardedIndex(DefaultShardCount), nil })
+	Register(builtinNames[Hash], func(string, bool) (Indexer, error) { return NewHashIndex(), nil })
+	Register(builtinNames[Arena], func(string, bool) (Indexer, error) { return NewArenaIndex(), nil })
+}
+
+// Register 以 name 注册索引实现，通常在 init 函数中调用
+// 和 database/sql.Register 一样，factory 为 nil 或者 name 重复注册时 panic
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if factory == nil {
+		panic("index: Register factory is nil")
+	}
+	if _, dup := factories[name]; dup {
+		panic("index: Register called twice for index " + name)
+	}
+	factories[name] = factory
+}
+
+// Lookup 返回以 name 注册的索引实现
+func Lookup(name string) (Factory, bool) {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	factory, ok := factories[name]
+	return factory, ok
+}
+
+// TypeName 返回内置索引类型注册时使用的名称
+func TypeName(tp IndexType) (string, bool) {
+	name, ok := builtinNames[tp]
+	return name, ok
+}
+
+// NewIndexer 初试化内置类型的索引
+func NewIndexer(tp IndexType, dir string, sync bool) (Indexer, error) {
+	factory, ok := Lookup(builtinNames[tp])
+	if !ok {
+		return nil, ErrUnsupportedIndexType
 	}
+	return factory(dir, sync)
 }
 
 // Item 索引项
@@ -0,0 +1,248 @@
+// Package indextest 提供检查 index.Indexer 实现是否符合存储引擎要求的测试用例
+package indextest
+
+import (
+	"bitcask/data"
+	"bitcask/index"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// Run 对 newIndex 创建的索引运行全部一致性测试，每个子测试使用新创建的索引
+// 测试之后会调用索引的 Close；索引使用的目录由 newIndex 负责创建和清理，例如使用 t.TempDir()
+func Run(t *testing.T, newIndex func(t *testing.T) index.Indexer) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, idx index.Indexer)
+	}{
+		{"PutGet", testPutGet},
+		{"Delete", testDelete},
+		{"Size", testSize},
+		{"Iterator", testIterator},
+		{"ReverseIterator", testReverseIterator},
+		{"Seek", testSeek},
+		{"ReverseSeek", testReverseSeek},
+		{"EmptyIterator", testEmptyIterator},
+		{"Batch", testBatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idx := newIndex(t)
+			defer func() {
+				assert.Nil(t, idx.Close())
+			}()
+			tt.fn(t, idx)
+		})
+	}
+}
+
+func testKey(i int) []byte {
+	return []byte(fmt.Sprintf("key-%04d", i))
+}
+
+// putKeys 写入 key-0000、key-0002 ... 共 n 个偶数编号的 key
+func putKeys(t *testing.T, idx index.Indexer, n int) [][]byte {
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = testKey(i * 2)
+		assert.Nil(t, idx.Put(keys[i], &data.LogRecordPos{Fid: 1, Offset: int64(i), Size: 10}))
+	}
+	return keys
+}
+
+func testPutGet(t *testing.T, idx index.Indexer) {
+	pos, err := idx.Get([]byte("not exist"))
+	assert.Nil(t, err)
+	assert.Nil(t, pos)
+
+	assert.Nil(t, idx.Put([]byte("key"), &data.LogRecordPos{Fid: 1, Offset: 100, Size: 10}))
+	pos, err = idx.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 100, Size: 10}, pos)
+
+	// 覆盖已经存在的 key
+	assert.Nil(t, idx.Put([]byte("key"), &data.LogRecordPos{Fid: 2, Offset: 200, Size: 20}))
+	pos, err = idx.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, &data.LogRecordPos{Fid: 2, Offset: 200, Size: 20}, pos)
+}
+
+func testDelete(t *testing.T, idx index.Indexer) {
+	ok, err := idx.Delete([]byte("not exist"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	assert.Nil(t, idx.Put([]byte("key"), &data.LogRecordPos{Fid: 1, Offset: 100}))
+	ok, err = idx.Delete([]byte("key"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	pos, err := idx.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Nil(t, pos)
+
+	// 重复删除
+	ok, err = idx.Delete([]byte("key"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func testSize(t *testing.T, idx index.Indexer) {
+	size, err := idx.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, size)
+
+	keys := putKeys(t, idx, 100)
+	assert.Nil(t, idx.Put(keys[0], &data.LogRecordPos{Fid: 2}))
+	size, err = idx.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, 100, size)
+
+	_, err = idx.Delete(keys[0])
+	assert.Nil(t, err)
+	size, err = idx.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, 99, size)
+}
+
+// collect 从当前位置开始遍历，返回剩余的 key
+func collect(t *testing.T, iter index.Iterator) [][]byte {
+	var keys [][]byte
+	for ; iter.Valid(); iter.Next() {
+		assert.NotNil(t, iter.Value())
+		keys = append(keys, append([]byte(nil), iter.Key()...))
+	}
+	return keys
+}
+
+func reversed(keys [][]byte) [][]byte {
+	res := make([][]byte, len(keys))
+	for i, key := range keys {
+		res[len(keys)-1-i] = key
+	}
+	return res
+}
+
+func testIterator(t *testing.T, idx index.Indexer) {
+	keys := putKeys(t, idx, 500)
+	iter, err := idx.Iterator(false)
+	assert.Nil(t, err)
+	defer iter.Close()
+
+	// 创建之后就指向第一个 key
+	assert.Equal(t, keys, collect(t, iter))
+	iter.Rewind()
+	assert.Equal(t, keys, collect(t, iter))
+
+	iter.Rewind()
+	assert.Equal(t, keys[0], iter.Key())
+	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 0, Size: 10}, iter.Value())
+}
+
+func testReverseIterator(t *testing.T, idx index.Indexer) {
+	keys := putKeys(t, idx, 500)
+	iter, err := idx.Iterator(true)
+	assert.Nil(t, err)
+	defer iter.Close()
+
+	assert.Equal(t, reversed(keys), collect(t, iter))
+	iter.Rewind()
+	assert.Equal(t, reversed(keys), collect(t, iter))
+}
+
+func testSeek(t *testing.T, idx index.Indexer) {
+	keys := putKeys(t, idx, 500)
+	iter, err := idx.Iterator(false)
+	assert.Nil(t, err)
+	defer iter.Close()
+
+	// 正向遍历定位到第一个大于等于 key 的位置
+	iter.Seek(testKey(101))
+	assert.Equal(t, keys[51:], collect(t, iter))
+	iter.Seek(testKey(102))
+	assert.Equal(t, keys[51:], collect(t, iter))
+	iter.Seek([]byte("a"))
+	assert.Equal(t, keys, collect(t, iter))
+	iter.Seek([]byte("z"))
+	assert.False(t, iter.Valid())
+}
+
+func testReverseSeek(t *testing.T, idx index.Indexer) {
+	keys := putKeys(t, idx, 500)
+	iter, err := idx.Iterator(true)
+	assert.Nil(t, err)
+	defer iter.Close()
+
+	// 反向遍历定位到第一个小于等于 key 的位置
+	iter.Seek(testKey(101))
+	assert.Equal(t, reversed(keys[:51]), collect(t, iter))
+	iter.Seek(testKey(102))
+	assert.Equal(t, reversed(keys[:52]), collect(t, iter))
+	iter.Seek([]byte("z"))
+	assert.Equal(t, reversed(keys), collect(t, iter))
+	iter.Seek([]byte("a"))
+	assert.False(t, iter.Valid())
+}
+
+func testEmptyIterator(t *testing.T, idx index.Indexer) {
+	for _, reverse := range []bool{false, true} {
+		iter, err := idx.Iterator(reverse)
+		assert.Nil(t, err)
+		assert.False(t, iter.Valid())
+		iter.Seek([]byte("key"))
+		assert.False(t, iter.Valid())
+		iter.Close()
+	}
+}
+
+// testBatch 通过 index.Batch 批量修改，实现了 index.Batcher 的索引出错时所有修改都不会生效
+func testBatch(t *testing.T, idx index.Indexer) {
+	keys := putKeys(t, idx, 100)
+	err := index.Batch(idx, func(w index.BatchWriter) error {
+		for i, key := range keys {
+			if i%2 == 0 {
+				if _, err := w.Delete(key); err != nil {
+					return err
+				}
+			} else if err := w.Put(key, &data.LogRecordPos{Fid: 2, Offset: int64(i)}); err != nil {
+				return err
+			}
+		}
+		// 批量操作中可以读取之前的修改
+		pos, err := w.Get(keys[1])
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(2), pos.Fid)
+		pos, err = w.Get(keys[0])
+		assert.Nil(t, err)
+		assert.Nil(t, pos)
+		return nil
+	})
+	assert.Nil(t, err)
+	size, err := idx.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, 50, size)
+	pos, err := idx.Get(keys[99])
+	assert.Nil(t, err)
+	assert.Equal(t, &data.LogRecordPos{Fid: 2, Offset: 99}, pos)
+
+	if _, ok := idx.(index.Batcher); !ok {
+		return
+	}
+	errBatch := errors.New("batch failed")
+	err = index.Batch(idx, func(w index.BatchWriter) error {
+		for _, key := range keys {
+			if err := w.Put(key, &data.LogRecordPos{Fid: 3}); err != nil {
+				return err
+			}
+		}
+		return errBatch
+	})
+	assert.Equal(t, errBatch, err)
+	size, err = idx.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, 50, size)
+	pos, err = idx.Get(keys[99])
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), pos.Fid)
+}
@@ -0,0 +1,58 @@
+package index
+
+import (
+	"bitcask/data"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"runtime"
+	"testing"
+)
+
+// memoryTestKeys 测量内存占用时写入的 key 数量，每个 key 21 字节
+const memoryTestKeys = 200000
+
+// measureMemoryPerKey 写入 memoryTestKeys 个 key 之后索引平均每个 key 占用的堆内存，包括 key 本身
+// random 为 true 时按随机顺序写入
+func measureMemoryPerKey(newIndex func() Indexer, random bool) float64 {
+	order := make([]int, memoryTestKeys)
+	for i := range order {
+		order[i] = i
+	}
+	if random {
+		rand.New(rand.NewSource(1)).Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+	}
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	idx := newIndex()
+	for _, i := range order {
+		_ = idx.Put([]byte(fmt.Sprintf("bitcask-key-%09d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i), Size: 64})
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(idx)
+	return float64(int64(after.HeapAlloc)-int64(before.HeapAlloc)) / memoryTestKeys
+}
+
+// TestIndex_MemoryPerKey 测量各种内存索引每个 key 占用的内存，索引类型的文档中引用这里的结果
+// 写入 20 万个 21 字节的 key，expected 为顺序写入和随机写入时每个 key 占用的字节数（包括 key 本身）
+func TestIndex_MemoryPerKey(t *testing.T) {
+	indexes := []struct {
+		name     string
+		newIndex func() Indexer
+		expected [2]float64
+	}{
+		{"btree", func() Indexer { return NewBTree() }, [2]float64{112, 100}},
+		{"art", func() Indexer { return NewART() }, [2]float64{211, 211}},
+		{"hash", func() Indexer { return NewHashIndex() }, [2]float64{56, 56}},
+		{"arena", func() Indexer { return NewArenaIndex() }, [2]float64{60, 67}},
+	}
+	for _, index := range indexes {
+		for i, random := range []bool{false, true} {
+			usage := measureMemoryPerKey(index.newIndex, random)
+			t.Logf("%s random=%v: %.1f bytes per key", index.name, random, usage)
+			assert.InDelta(t, index.expected[i], usage, index.expected[i]/10, index.name)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package index_test
+
+import (
+	"bitcask/index"
+	"bitcask/index/indextest"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	for _, name := range []string{"btree", "art", "bptree", "sharded", "hash", "arena"} {
+		t.Run(name, func(t *testing.T) {
+			factory, ok := index.Lookup(name)
+			assert.True(t, ok)
+			indextest.Run(t, func(t *testing.T) index.Indexer {
+				idx, err := factory(t.TempDir(), false)
+				assert.Nil(t, err)
+				return idx
+			})
+		})
+	}
+}
+
+func TestRegister(t *testing.T) {
+	index.Register("test-btree", func(string, bool) (index.Indexer, error) {
+		return index.NewBTree(), nil
+	})
+	factory, ok := index.Lookup("test-btree")
+	assert.True(t, ok)
+	idx, err := factory("", false)
+	assert.Nil(t, err)
+	assert.IsType(t, &index.BTree{}, idx)
+
+	_, ok = index.Lookup("not-exist")
+	assert.False(t, ok)
+	assert.Panics(t, func() {
+		index.Register("btree", func(string, bool) (index.Indexer, error) { return index.NewBTree(), nil })
+	})
+	assert.Panics(t, func() { index.Register("nil", nil) })
+
+	_, err = index.NewIndexer(index.IndexType(100), "", false)
+	assert.Equal(t, index.ErrUnsupportedIndexType, err)
+}
@@ -0,0 +1,173 @@
+package index
+
+import (
+	"bitcask/data"
+	"bytes"
+	"container/heap"
+)
+
+// DefaultShardCount 分片索引默认的分片数量
+const DefaultShardCount = 16
+
+// ShardedIndex 分片索引，按照 key 的哈希值把数据分散到多个独立加锁的 BTree 中
+// 不同分片上的读写互不阻塞，迭代器按顺序合并所有分片的数据
+type ShardedIndex struct {
+	shards []*BTree
+}
+
+// NewShardedIndex 初始化有 n 个分片的索引，n 不大于 0 时使用 DefaultShardCount
+func NewShardedIndex(n int) *ShardedIndex {
+	if n <= 0 {
+		n = DefaultShardCount
+	}
+	shards := make([]*BTree, n)
+	for i := range shards {
+		shards[i] = NewBTree()
+	}
+	return &ShardedIndex{shards: shards}
+}
+
+// shard 返回 key 所在的分片
+func (si *ShardedIndex) shard(key []byte) *BTree {
+	return si.shards[hashKey(key)%uint32(len(si.shards))]
+}
+
+func (si *ShardedIndex) Put(key []byte, pos *data.LogRecordPos) error {
+	return si.shard(key).Put(key, pos)
+}
+
+func (si *ShardedIndex) Get(key []byte) (*data.LogRecordPos, error) {
+	return si.shard(key).Get(key)
+}
+
+func (si *ShardedIndex) Delete(key []byte) (bool, error) {
+	return si.shard(key).Delete(key)
+}
+
+// Size 返回所有分片的数据量之和
+func (si *ShardedIndex) Size() (int, error) {
+	var size int
+	for _, shard := range si.shards {
+		n, _ := shard.Size()
+		size += n
+	}
+	return size, nil
+}
+
+// MemoryUsage 估算所有分片占用的内存
+func (si *ShardedIndex) MemoryUsage() int64 {
+	var usage int64
+	for _, shard := range si.shards {
+		usage += shard.MemoryUsage()
+	}
+	return usage
+}
+
+func (si *ShardedIndex) Close() error {
+	return nil
+}
+
+// Iterator 返回合并所有分片的有序迭代器
+// 同时持有所有分片的写锁创建快照，迭代器看到的是同一时刻的全部数据
+func (si *ShardedIndex) Iterator(reverse bool) (Iterator, error) {
+	// Clone 会修改原来的树的写时复制标识，需要持有写锁
+	for _, shard := range si.shards {
+		shard.lock.Lock()
+	}
+	iters := make([]Iterator, len(si.shards))
+	for i, shard := range si.shards {
+		iters[i] = newBTreeIterator(shard.tree.Clone(), reverse)
+	}
+	for _, shard := range si.shards {
+		shard.lock.Unlock()
+	}
+	mi := &mergeIterator{iters: iters, reverse: reverse}
+	mi.Rewind()
+	return mi, nil
+}
+
+// mergeIterator 按顺序合并多个 key 互不重复的迭代器
+// 堆中保存所有有效的子迭代器，堆顶是当前位置
+type mergeIterator struct {
+	iters   []Iterator
+	heap    []Iterator
+	reverse bool
+}
+
+func (mi *mergeIterator) Len() int { return len(mi.heap) }
+
+func (mi *mergeIterator) Less(i, j int) bool {
+	cmp := bytes.Compare(mi.heap[i].Key(), mi.heap[j].Key())
+	if mi.reverse {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func (mi *mergeIterator) Swap(i, j int) { mi.heap[i], mi.heap[j] = mi.heap[j], mi.heap[i] }
+
+func (mi *mergeIterator) Push(x any) { mi.heap = append(mi.heap, x.(Iterator)) }
+
+func (mi *mergeIterator) Pop() any {
+	last := mi.heap[len(mi.heap)-1]
+	mi.heap = mi.heap[:len(mi.heap)-1]
+	return last
+}
+
+// rebuild 在所有子迭代器重新定位之后重建堆
+func (mi *mergeIterator) rebuild() {
+	mi.heap = mi.heap[:0]
+	for _, iter := range mi.iters {
+		if iter.Valid() {
+			mi.heap = append(mi.heap, iter)
+		}
+	}
+	heap.Init(mi)
+}
+
+func (mi *mergeIterator) Rewind() {
+	for _, iter := range mi.iters {
+		iter.Rewind()
+	}
+	mi.rebuild()
+}
+
+func (mi *mergeIterator) Seek(key []byte) {
+	for _, iter := range mi.iters {
+		iter.Seek(key)
+	}
+	mi.rebuild()
+}
+
+func (mi *mergeIterator) Next() {
+	if len(mi.heap) == 0 {
+		return
+	}
+	top := mi.heap[0]
+	top.Next()
+	if top.Valid() {
+		heap.Fix(mi, 0)
+	} else {
+		heap.Pop(mi)
+	}
+}
+
+func (mi *mergeIterator) Valid() bool {
+	return len(mi.heap) > 0
+}
+
+func (mi *mergeIterator) Key() []byte {
+	return mi.heap[0].Key()
+}
+
+func (mi *mergeIterator) Value() *data.LogRecordPos {
+	return mi.heap[0].Value()
+}
+
+func (mi *mergeIterator) Close() {
+	for _, iter := range mi.iters {
+		iter.Close()
+	}
+	mi.iters = nil
+	mi.heap = nil
+}
@@ -0,0 +1,131 @@
+package index
+
+import (
+	"bitcask/data"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestShardedIndex_Distribution(t *testing.T) {
+	si := NewShardedIndex(4)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, si.Put([]byte(fmt.Sprintf("key-%04d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)}))
+	}
+	// 数据分散到所有分片中
+	for _, shard := range si.shards {
+		size, err := shard.Size()
+		assert.Nil(t, err)
+		assert.Greater(t, size, 100)
+	}
+	size, err := si.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, size)
+	assert.Equal(t, int64(1000*(btreeItemOverhead+8)), si.MemoryUsage())
+}
+
+func TestShardedIndex_Concurrent(t *testing.T) {
+	si := NewShardedIndex(8)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := []byte(fmt.Sprintf("key-%d-%04d", g, i))
+				assert.Nil(t, si.Put(key, &data.LogRecordPos{Fid: uint32(g), Offset: int64(i)}))
+				pos, err := si.Get(key)
+				assert.Nil(t, err)
+				assert.Equal(t, int64(i), pos.Offset)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	var keys []string
+	iter, err := si.Iterator(false)
+	assert.Nil(t, err)
+	for ; iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	iter.Close()
+	assert.Equal(t, 4000, len(keys))
+	assert.True(t, sort.StringsAreSorted(keys))
+}
+
+func TestShardedIndex_Iterator_Snapshot(t *testing.T) {
+	testIteratorSnapshot(t, NewShardedIndex(4))
+}
+
+// TestShardedIndex_Iterator_Consistent 迭代器的快照是同一时刻的全部分片
+// 写入方先写入另一个 key 再删除当前的 key，任何时刻至少有一个 key 存在
+func TestShardedIndex_Iterator_Consistent(t *testing.T) {
+	si := NewShardedIndex(16)
+	keys := [][]byte{[]byte("key-a"), []byte("key-b")}
+	assert.NotEqual(t, si.shard(keys[0]), si.shard(keys[1]))
+	pos := &data.LogRecordPos{Fid: 1}
+	assert.Nil(t, si.Put(keys[0], pos))
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			assert.Nil(t, si.Put(keys[(i+1)%2], pos))
+			_, err := si.Delete(keys[i%2])
+			assert.Nil(t, err)
+		}
+	}()
+	for i := 0; i < 2000; i++ {
+		iter, err := si.Iterator(i%2 == 0)
+		assert.Nil(t, err)
+		var count int
+		for ; iter.Valid(); iter.Next() {
+			count++
+		}
+		iter.Close()
+		assert.True(t, count == 1 || count == 2)
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// benchmarkIndexParallel 在并发读写下测试索引的性能，四分之一的操作是写入
+func benchmarkIndexParallel(b *testing.B, idx Indexer) {
+	keys := make([][]byte, 100000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("bitcask-key-%09d", i))
+		_ = idx.Put(keys[i], &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		pos := &data.LogRecordPos{Fid: 2}
+		for pb.Next() {
+			key := keys[r.Intn(len(keys))]
+			if r.Intn(4) == 0 {
+				_ = idx.Put(key, pos)
+			} else {
+				_, _ = idx.Get(key)
+			}
+		}
+	})
+}
+
+func BenchmarkIndex_Parallel(b *testing.B) {
+	b.Run("btree", func(b *testing.B) { benchmarkIndexParallel(b, NewBTree()) })
+	b.Run("art", func(b *testing.B) { benchmarkIndexParallel(b, NewART()) })
+	b.Run("sharded", func(b *testing.B) { benchmarkIndexParallel(b, NewShardedIndex(DefaultShardCount)) })
+	b.Run("hash", func(b *testing.B) { benchmarkIndexParallel(b, NewHashIndex()) })
+	b.Run("arena", func(b *testing.B) { benchmarkIndexParallel(b, NewArenaIndex()) })
+}
@@ -3,6 +3,7 @@ package bitcask
 import (
 	"bitcask/index"
 	"bytes"
+	"context"
 )
 
 // Iterator represents an iterator for the DB.
@@ -10,43 +11,109 @@ type Iterator struct {
 	indexIter index.Iterator
 	db        *DB
 	cfg       IteratorConfig
+	gen       *fileGeneration // 创建时的数据文件集合，merge 之后仍然可以读取旧位置
+	lower     []byte          // 由 LowerBound 和 Prefix 得到的下界（包含）
+	upper     []byte          // 由 UpperBound 和 Prefix 得到的上界（不包含）
+	err       error           // 创建迭代器时的错误
 }
 
 // NewIterator creates a new Iterator for the DB.
+// The iterator keeps the data files it was created with alive until Close,
+// so a concurrent Merge does not invalidate the positions it has already seen.
+// If the index cannot be read, or the DB is closed, it returns an empty iterator
+// whose Err reports the failure.
 func (db *DB) NewIterator(cfg IteratorConfig) *Iterator {
-	return &Iterator{
-		indexIter: db.index.Iterator(cfg.Reverse),
+	// 后台加载完成之前索引中的数据不完整
+	if err := db.WaitReady(context.Background()); err != nil {
+		return newErrIterator(db, cfg, err)
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed.Load() {
+		return newErrIterator(db, cfg, ErrDBClosed)
+	}
+	indexIter, err := db.index.Iterator(cfg.Reverse)
+	if err != nil {
+		return newErrIterator(db, cfg, err)
+	}
+	db.metrics.iteratorsCreated.Add(1)
+	db.metrics.iteratorsOpen.Add(1)
+	iter := &Iterator{
+		indexIter: indexIter,
 		db:        db,
 		cfg:       cfg,
+		gen:       db.acquireGeneration(),
+		lower:     cfg.LowerBound,
+		upper:     cfg.UpperBound,
+	}
+	// 前缀等价于 [Prefix, prefixSuccessor(Prefix)) 的范围，与上下界取交集
+	if len(cfg.Prefix) > 0 {
+		if iter.lower == nil || bytes.Compare(cfg.Prefix, iter.lower) > 0 {
+			iter.lower = cfg.Prefix
+		}
+		if end := prefixSuccessor(cfg.Prefix); end != nil && (iter.upper == nil || bytes.Compare(end, iter.upper) < 0) {
+			iter.upper = end
+		}
 	}
+	return iter
+}
+
+// newErrIterator 返回没有数据的迭代器，Err 返回创建失败的原因
+func newErrIterator(db *DB, cfg IteratorConfig, err error) *Iterator {
+	indexIter, _ := index.NewBTree().Iterator(cfg.Reverse)
+	return &Iterator{indexIter: indexIter, db: db, cfg: cfg, err: err}
 }
 
 // Rewind rewinds the Iterator to the beginning.
+// A forward iterator starts at the lower bound, a reverse iterator at the last key below the upper bound.
 func (i *Iterator) Rewind() {
-	// Rewind the index iterator to the beginning.
-	i.indexIter.Rewind()
-
-	// Skip to the next element in the iterator.
-	i.skipToNext()
+	i.seek(nil)
 }
 
-// Seek sets the Iterator to the first key greater than or equal to the specified key.
+// Seek sets the Iterator to the first key greater than or equal to the specified key,
+// or less than or equal to it for a reverse iterator. The key is clamped to the bounds.
 func (i *Iterator) Seek(key []byte) {
-	i.indexIter.Seek(key)
+	i.seek(key)
+}
+
+// seek 定位到 key，key 为空时从头开始，超出范围的 key 会被限制到边界
+func (i *Iterator) seek(key []byte) {
+	if i.cfg.Reverse {
+		if i.upper != nil && (key == nil || bytes.Compare(key, i.upper) >= 0) {
+			// 上界不包含在范围内，跳过与上界相等的 key
+			i.indexIter.Seek(i.upper)
+			if i.indexIter.Valid() && bytes.Equal(i.indexIter.Key(), i.upper) {
+				i.indexIter.Next()
+			}
+			return
+		}
+	} else if i.lower != nil && (key == nil || bytes.Compare(key, i.lower) < 0) {
+		key = i.lower
+	}
+	if key == nil {
+		i.indexIter.Rewind()
+	} else {
+		i.indexIter.Seek(key)
+	}
 }
 
 // Next advances the iterator to the next element.
 func (i *Iterator) Next() {
 	// Advance the underlying index iterator.
 	i.indexIter.Next()
-
-	// Skip to the next element if necessary.
-	i.skipToNext()
 }
 
 // Valid returns true if the Iterator is valid, false otherwise.
+// The iteration stops as soon as the key leaves the bounds.
 func (i *Iterator) Valid() bool {
-	return i.indexIter.Valid()
+	if !i.indexIter.Valid() {
+		return false
+	}
+	key := i.indexIter.Key()
+	if i.lower != nil && bytes.Compare(key, i.lower) < 0 {
+		return false
+	}
+	return i.upper == nil || bytes.Compare(key, i.upper) < 0
 }
 
 // Key returns the current key of the Iterator.
@@ -55,38 +122,73 @@ func (i *Iterator) Key() []byte {
 }
 
 // Value returns the value associated with the current key of the Iterator.
-// It first retrieves the position of the value from the index iterator.
-// Then it acquires a read lock on the database's mutex to ensure thread safety.
-// Finally, it calls the getValueByPosition function to retrieve the value
-// associated with the position.
+// It reads from the data files captured when the iterator was created,
+// without taking the database lock.
 func (i *Iterator) Value() ([]byte, error) {
+	if i.err != nil {
+		return nil, i.err
+	}
 	pos := i.indexIter.Value()
-	i.db.mu.RLock()
-	defer i.db.mu.RUnlock()
-	return i.db.getValueByPosition(pos)
+	return i.db.getValueFromGeneration(i.gen, pos)
+}
+
+// Err returns the error that occurred when the Iterator was created.
+func (i *Iterator) Err() error {
+	return i.err
 }
 
 // Close closes the Iterator and releases any resources associated with it.
-// It simply calls the Close method on the index iterator.
+// Data files replaced by a merge are removed once the last iterator using them is closed.
 func (i *Iterator) Close() {
 	i.indexIter.Close()
+	if i.gen != nil {
+		i.db.releaseGeneration(i.gen)
+		i.gen = nil
+		i.db.metrics.iteratorsOpen.Add(-1)
+	}
 }
 
-// skipToNext skips to the next key that matches the given prefix.
-// It iterates over the index iterator and compares the key with the prefix.
-// If a match is found, it returns. If no match is found, it continues iterating.
-func (i *Iterator) skipToNext() {
-	prefixLen := len(i.cfg.Prefix)
-	// If there is no prefix, skip to the next key.
-	if prefixLen == 0 {
-		return
+// prefixSuccessor 返回大于所有以 prefix 开头的 key 的最小值
+// prefix 全部为 0xff 时没有这样的值，返回 nil
+func prefixSuccessor(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
 	}
-	// Iterate over the index iterator.
-	for ; i.indexIter.Valid(); i.indexIter.Next() {
-		key := i.indexIter.Key()
-		// If the key matches the prefix, return.
-		if prefixLen <= len(key) && bytes.Compare(i.cfg.Prefix, key[:prefixLen]) == 0 {
-			return
+	return nil
+}
+
+// KeyValue 键值对
+type KeyValue struct {
+	Key   []byte
+	Value []byte
+}
+
+// Scan 按顺序返回 [start, end) 范围内的数据，start 或 end 为空表示没有对应的边界
+// limit 不大于 0 时返回范围内的全部数据
+func (db *DB) Scan(start, end []byte, limit int) ([]KeyValue, error) {
+	iter := db.NewIterator(IteratorConfig{LowerBound: start, UpperBound: end})
+	defer iter.Close()
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	var result []KeyValue
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+		value, err := iter.Value()
+		if err != nil {
+			return nil, err
 		}
+		// 索引中的 key 可能在迭代器关闭之后失效，需要拷贝
+		key := make([]byte, len(iter.Key()))
+		copy(key, iter.Key())
+		result = append(result, KeyValue{Key: key, Value: value})
 	}
+	return result, nil
 }
@@ -4,6 +4,7 @@ import (
 	"bitcask/utils"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"strconv"
 	"testing"
 )
 
@@ -132,3 +133,76 @@ func TestDB_NewIterator_Multi_Values(t *testing.T) {
 		assert.NotNil(t, it3.Key())
 	}
 }
+
+// TestDB_Iterator_Bounds verifies prefix and range iteration in both directions for every index type.
+func TestDB_Iterator_Bounds(t *testing.T) {
+	for _, indexType := range []IndexerType{Btree, ART, BPTree, Sharded, Hash, Arena} {
+		cfg := DefaultConfig
+		dir, err := os.MkdirTemp("", "bitcask-test-iterator-bounds")
+		assert.Nil(t, err)
+		cfg.DirPath = dir
+		cfg.IndexType = indexType
+		db, err := Open(cfg)
+		assert.Nil(t, err)
+		for _, key := range []string{"a", "ab", "abc", "b", "ba", "c", "d"} {
+			assert.Nil(t, db.Put([]byte(key), []byte(key)))
+		}
+
+		collect := func(cfg IteratorConfig, seek []byte) []string {
+			iter := db.NewIterator(cfg)
+			defer iter.Close()
+			var keys []string
+			if seek != nil {
+				iter.Seek(seek)
+			} else {
+				iter.Rewind()
+			}
+			for ; iter.Valid(); iter.Next() {
+				keys = append(keys, string(iter.Key()))
+			}
+			return keys
+		}
+		assert.Equal(t, []string{"a", "ab", "abc"}, collect(IteratorConfig{Prefix: []byte("a")}, nil))
+		assert.Equal(t, []string{"abc", "ab", "a"}, collect(IteratorConfig{Prefix: []byte("a"), Reverse: true}, nil))
+		assert.Equal(t, []string{"ab", "abc", "b", "ba"}, collect(IteratorConfig{LowerBound: []byte("ab"), UpperBound: []byte("c")}, nil))
+		assert.Equal(t, []string{"ba", "b", "abc", "ab"}, collect(IteratorConfig{LowerBound: []byte("ab"), UpperBound: []byte("c"), Reverse: true}, nil))
+		// 前缀与上下界取交集
+		assert.Equal(t, []string{"ab"}, collect(IteratorConfig{Prefix: []byte("a"), LowerBound: []byte("aa"), UpperBound: []byte("abc")}, nil))
+		// Seek 的位置被限制在范围内
+		assert.Equal(t, []string{"b", "ba"}, collect(IteratorConfig{LowerBound: []byte("ab"), UpperBound: []byte("c")}, []byte("az")))
+		assert.Equal(t, []string{"ab", "abc", "b", "ba"}, collect(IteratorConfig{LowerBound: []byte("ab"), UpperBound: []byte("c")}, []byte("a")))
+		assert.Equal(t, []string{"ba", "b"}, collect(IteratorConfig{LowerBound: []byte("b"), UpperBound: []byte("c"), Reverse: true}, []byte("bb")))
+		assert.Equal(t, []string{"ba", "b", "abc", "ab", "a"}, collect(IteratorConfig{UpperBound: []byte("c"), Reverse: true}, []byte("zz")))
+		assert.Nil(t, collect(IteratorConfig{Prefix: []byte("x")}, nil))
+		destroyDB(db)
+	}
+}
+
+// TestDB_Scan verifies range scans with limits.
+func TestDB_Scan(t *testing.T) {
+	cfg := DefaultConfig
+	dir, err := os.MkdirTemp("", "bitcask-test-scan")
+	assert.Nil(t, err)
+	cfg.DirPath = dir
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte(strconv.Itoa(i))))
+	}
+
+	kvs, err := db.Scan(utils.GetTestKey(10), utils.GetTestKey(20), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(kvs))
+	assert.Equal(t, utils.GetTestKey(10), kvs[0].Key)
+	assert.Equal(t, []byte("19"), kvs[9].Value)
+
+	kvs, err = db.Scan(utils.GetTestKey(90), nil, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(kvs))
+	assert.Equal(t, utils.GetTestKey(92), kvs[2].Key)
+
+	kvs, err = db.Scan(nil, nil, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(kvs))
+}
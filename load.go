@@ -0,0 +1,209 @@
+package bitcask
+
+import (
+	"bitcask/data"
+	"bitcask/index"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// fileLoad 打开时需要加载到索引中的一个数据文件
+type fileLoad struct {
+	dataFile *data.DataFile
+	offset   int64 // 开始读取的位置
+	size     int64 // 只读取到这个位置，后台加载时不读取打开之后写入的数据
+	sealed   bool  // 不会再写入的旧文件，从头读取时可以使用 hint 文件
+}
+
+// loadedFile 从一个数据文件中读取出来的一批记录，只保留 key 和类型，不保留 value
+type loadedFile struct {
+	records   []*data.LogRecord
+	positions []*data.LogRecordPos
+	end       int64 // 最后一条完整读取的记录的结束位置
+	err       error // 读取到 end 之后遇到的错误，只有最后一批记录会有
+}
+
+const (
+	// loadChunkRecords 读取数据文件时每批交给索引更新的记录数量
+	loadChunkRecords = 4096
+	// loadChunkBuffer 每个读取中的文件最多缓存的批次，读取超前于索引更新时等待
+	loadChunkBuffer = 2
+)
+
+// loadConcurrency 打开时同时读取的数据文件数量
+func (db *DB) loadConcurrency() int {
+	n := db.cfg.LoadConcurrency
+	if n == 0 {
+		n = runtime.NumCPU()
+	}
+	// 每个读取中的文件都需要打开，不超过同时打开的文件数量上限
+	if db.cfg.MaxOpenFiles > 0 && n > db.cfg.MaxOpenFiles {
+		n = db.cfg.MaxOpenFiles
+	}
+	return n
+}
+
+// loadIndexFromFileLoads 并发读取数据文件，按照文件的顺序把记录更新到索引中
+// 后面的文件中的记录覆盖前面的记录，跨越多个文件的事务在读取到提交标识之后才更新到索引中
+// 每个文件的记录更新完成之后调用 done，返回错误时停止加载；同时最多有 loadConcurrency 个文件正在读取，
+// 每个文件最多缓存 loadChunkBuffer 批没有更新到索引中的记录，内存占用和数据文件的大小无关
+// 后台加载时每批记录和调用 done 分别持有写锁
+func (db *DB) loadIndexFromFileLoads(loads []fileLoad, done func(load fileLoad, end int64, err error) error) error {
+	results := make([]chan *loadedFile, len(loads))
+	for i := range results {
+		results[i] = make(chan *loadedFile, loadChunkBuffer)
+	}
+	// 更新完一个文件的索引之后才开始读取新的文件
+	tokens := make(chan struct{}, db.loadConcurrency())
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	// 出错返回之前等待正在读取的文件，之后数据文件可能会被关闭
+	defer func() {
+		close(stop)
+		readers.Wait()
+	}()
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for i, load := range loads {
+			select {
+			case tokens <- struct{}{}:
+			case <-stop:
+				return
+			}
+			readers.Add(1)
+			go func() {
+				defer readers.Done()
+				defer close(results[i])
+				db.readFileLoad(load, func(chunk *loadedFile) bool {
+					select {
+					case results[i] <- chunk:
+						return true
+					case <-stop:
+						return false
+					}
+				})
+			}()
+		}
+	}()
+
+	for i, load := range loads {
+		err := db.applyFileLoad(load, results[i], done)
+		<-tokens
+		if err != nil {
+			return err
+		}
+		if l := db.loadingIndex(); l != nil {
+			l.loadedFiles.Add(1)
+		}
+	}
+	return nil
+}
+
+// applyFileLoad 把一个数据文件读取出来的每批记录依次更新到索引中，全部更新完成之后调用 done
+func (db *DB) applyFileLoad(load fileLoad, chunks <-chan *loadedFile, done func(load fileLoad, end int64, err error) error) error {
+	end, readErr := load.offset, error(nil)
+	for chunk := range chunks {
+		end, readErr = chunk.end, chunk.err
+		unlock, err := db.lockForLoad()
+		if err != nil {
+			return err
+		}
+		err = db.applyLoadedFile(load.dataFile, chunk)
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+	unlock, err := db.lockForLoad()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return done(load, end, readErr)
+}
+
+// readFileLoad 依次读取一个数据文件中的记录，每 loadChunkRecords 条交给 emit，不修改数据库的状态，可以并发调用
+// 最后一批记录的 end 和 err 是整个文件的读取结果；emit 返回 false 时停止读取
+func (db *DB) readFileLoad(load fileLoad, emit func(chunk *loadedFile) bool) {
+	res := &loadedFile{end: load.offset}
+	if load.sealed && load.offset == 0 {
+		if hints, ok := data.OpenHintReader(db.cfg.DirPath, load.dataFile.FileID, load.dataFile.WriteOff); ok {
+			// hint 文件中间损坏时，从最后一条有效的 hint 之后继续读取数据文件
+			for {
+				if len(res.records) == loadChunkRecords {
+					if !emit(res) {
+						_ = hints.Close()
+						return
+					}
+					res = &loadedFile{end: res.end}
+				}
+				record, pos, err := hints.Next()
+				if err != nil {
+					break
+				}
+				res.records = append(res.records, record)
+				res.positions = append(res.positions, pos)
+				res.end = pos.Offset + int64(pos.Size)
+			}
+			_ = hints.Close()
+		}
+	}
+	for res.end < load.size {
+		if len(res.records) == loadChunkRecords {
+			if !emit(res) {
+				return
+			}
+			res = &loadedFile{end: res.end}
+		}
+		record, size, err := load.dataFile.ReadLogRecord(res.end)
+		if err != nil {
+			//说明文件读取完成
+			if err != io.EOF {
+				db.metrics.observeReadError(err)
+				res.err = err
+			}
+			break
+		}
+		// key 和 value 共用读取时分配的内存，复制 key 之后不再引用 value
+		res.records = append(res.records, &data.LogRecord{
+			Key:  append([]byte(nil), record.Key...),
+			Type: record.Type,
+		})
+		res.positions = append(res.positions, &data.LogRecordPos{
+			Fid:    load.dataFile.FileID,
+			Offset: res.end,
+			Size:   uint32(size),
+		})
+		res.end += size
+	}
+	emit(res)
+}
+
+// applyLoadedFile 把从数据文件中读取的一批记录依次更新到索引中
+// b+树索引每批记录只需要一个事务，重放和重新构建时不会每条记录提交一次
+func (db *DB) applyLoadedFile(dataFile *data.DataFile, res *loadedFile) error {
+	if len(res.records) == 0 {
+		return nil
+	}
+	err := index.Batch(db.index, func(w index.BatchWriter) error {
+		for i, record := range res.records {
+			pos := res.positions[i]
+			// 从头读取的活跃文件，切换时可以写入 hint 文件
+			if dataFile == db.activeFile && pos.Offset == db.hintOff && !db.readOnly {
+				db.appendHint(record, pos)
+			}
+			if err := db.indexLogRecord(w, record, pos); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrIndexUpdateFailed) {
+		return fmt.Errorf("%w: %w", ErrIndexUpdateFailed, err)
+	}
+	return err
+}
@@ -0,0 +1,139 @@
+package bitcask
+
+import (
+	"bitcask/data"
+	"bitcask/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+// TestDB_LoadConcurrency 并发读取数据文件之后按照文件顺序更新索引
+func TestDB_LoadConcurrency(t *testing.T) {
+	cfg := DefaultConfig
+	dir, err := os.MkdirTemp("", "bitcask-test-load")
+	assert.Nil(t, err)
+	cfg.DirPath = dir
+	cfg.DataFileSize = 16 * 1024
+	cfg.IndexType = Btree
+	cfg.LoadConcurrency = 1
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	values := make(map[string][]byte)
+	for round := 0; round < 5; round++ {
+		// 后面的文件覆盖和删除前面文件中的 key
+		for i := 0; i < 300; i++ {
+			key := utils.GetTestKey(i)
+			values[string(key)] = utils.GetTestValue(32)
+			assert.Nil(t, db.Put(key, values[string(key)]))
+		}
+		for i := round * 20; i < round*20+20; i++ {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+			delete(values, string(utils.GetTestKey(i)))
+		}
+		// 跨越多个数据文件的事务
+		wb := db.NewWriteBatch(DefaultWriteBatchConfig)
+		for i := 300; i < 500; i++ {
+			key := utils.GetTestKey(i)
+			values[string(key)] = utils.GetTestValue(64)
+			assert.Nil(t, wb.Put(key, values[string(key)]))
+		}
+		assert.Nil(t, wb.Commit())
+	}
+	// 没有提交的事务，序列号仍然不能再被使用
+	seqNo := db.seqNo + 1
+	_, err = db.appendLogRecordWithLock(&data.LogRecord{
+		Key:   logRecordKeyWriteWithSeq(utils.GetTestKey(1000), seqNo),
+		Value: utils.GetTestValue(64),
+	})
+	assert.Nil(t, err)
+	activeFileID := db.activeFile.FileID
+	assert.True(t, activeFileID > 10)
+	assert.Nil(t, db.Close())
+	removeIndexSnapshot(t, dir)
+	// 一部分旧文件没有 hint 文件
+	for fid := uint32(0); fid < activeFileID; fid += 3 {
+		assert.Nil(t, os.Remove(data.GetHintFileName(dir, fid)))
+	}
+
+	for _, concurrency := range []int{1, 3, 0} {
+		cfg.LoadConcurrency = concurrency
+		db, err = Open(cfg)
+		assert.Nil(t, err)
+		assert.Equal(t, seqNo, db.seqNo)
+		assert.Equal(t, len(values), len(listKeys(t, db)))
+		for key, value := range values {
+			val, err := db.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, value, val)
+		}
+		_, err = db.Get(utils.GetTestKey(1000))
+		assert.Equal(t, ErrKeyNotFound, err)
+		assert.Nil(t, db.Close())
+		removeIndexSnapshot(t, dir)
+	}
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+
+	cfg.LoadConcurrency = -1
+	_, err = Open(cfg)
+	assert.NotNil(t, err)
+}
+
+// TestDB_LoadChunks 数据文件和 hint 文件中的记录分成多批更新到索引中，事务可以跨越两批记录
+func TestDB_LoadChunks(t *testing.T) {
+	cfg := DefaultConfig
+	dir, err := os.MkdirTemp("", "bitcask-test-load-chunks")
+	assert.Nil(t, err)
+	cfg.DirPath = dir
+	cfg.DataFileSize = 1024 * 1024
+	cfg.IndexType = Btree
+	cfg.LoadConcurrency = 2
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	values := make(map[string][]byte)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 3*loadChunkRecords; i++ {
+			key := utils.GetTestKey(i % 5000)
+			values[string(key)] = utils.GetTestValue(8)
+			assert.Nil(t, db.Put(key, values[string(key)]))
+		}
+		wb := db.NewWriteBatch(DefaultWriteBatchConfig)
+		for i := 4000; i < 7000; i++ {
+			key := utils.GetTestKey(i)
+			values[string(key)] = utils.GetTestValue(8)
+			assert.Nil(t, wb.Put(key, values[string(key)]))
+		}
+		assert.Nil(t, wb.Commit())
+		for i := round * 100; i < round*100+100; i++ {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+			delete(values, string(utils.GetTestKey(i)))
+		}
+	}
+	assert.True(t, db.activeFile.FileID > 0)
+	assert.Nil(t, db.Close())
+	removeIndexSnapshot(t, dir)
+
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	checkTestValues(t, db, values)
+
+	// 后台加载完成之前按批读取数据文件查找 key
+	l := restartLoading(db)
+	for _, i := range []int{0, 150, 299, 300, 3999, 4000, 4999, 6999, 7000} {
+		key := utils.GetTestKey(i)
+		val, err := db.Get(key)
+		if value, ok := values[string(key)]; ok {
+			assert.Nil(t, err)
+			assert.Equal(t, value, val)
+		} else {
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+	}
+	db.loadInBackground(l)
+	checkTestValues(t, db, values)
+}
@@ -0,0 +1,299 @@
+package bitcask
+
+import (
+	"bitcask/data"
+	"bitcask/index"
+	"bytes"
+	"context"
+	"sync/atomic"
+)
+
+// maxLoadingScans 后台加载期间最多从数据文件中查找的次数，之后的读取等待加载完成
+// 每次查找都要读取打开时的全部数据文件，只用来在刚打开时服务少量读取
+const maxLoadingScans = 64
+
+// indexLoading 后台加载内存索引的状态
+// 加载期间写入的 key 直接更新索引，加载时跳过这些 key，索引中其余 key 的位置在加载完成之前不一定是最新的
+type indexLoading struct {
+	files       []fileLoad          // 打开时的全部数据文件，活跃文件只加载打开时已经写入的数据
+	written     map[string]struct{} // 打开之后写入或删除过的 key，需要持有锁；加载结束之后释放
+	ready       atomic.Bool         // 加载完成，之后索引和不使用后台加载时一致
+	loadedFiles atomic.Int64
+	scans       atomic.Int64  // 剩余可以从数据文件中查找的次数
+	stop        chan struct{} // 关闭数据库时停止加载
+	done        chan struct{} // 加载结束，成功或者失败
+	err         error         // 加载失败的原因，done 关闭之后才能读取
+}
+
+// LoadProgress 后台加载索引的进度
+type LoadProgress struct {
+	Ready      bool  // 索引已经加载完成
+	FilesDone  int   // 已经加载到索引中的数据文件数量
+	FilesTotal int   // 打开时需要加载的数据文件数量
+	Err        error // 加载失败的原因，失败之后读写都返回这个错误
+}
+
+// LoadProgress 返回后台加载索引的进度，没有使用后台加载时总是加载完成的
+func (db *DB) LoadProgress() LoadProgress {
+	l := db.loading.Load()
+	if l == nil {
+		return LoadProgress{Ready: true}
+	}
+	progress := LoadProgress{
+		Ready:      l.ready.Load(),
+		FilesDone:  int(l.loadedFiles.Load()),
+		FilesTotal: len(l.files),
+	}
+	select {
+	case <-l.done:
+		progress.Err = l.err
+	default:
+	}
+	return progress
+}
+
+// WaitReady 等待后台加载索引完成，返回加载失败的原因
+// ctx 取消或者超时之后不再等待；没有使用后台加载时直接返回
+func (db *DB) WaitReady(ctx context.Context) error {
+	l := db.loading.Load()
+	if l == nil {
+		return nil
+	}
+	select {
+	case <-l.done:
+		return l.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// loadingIndex 正在后台加载的索引状态，没有使用后台加载或者已经加载完成时返回 nil
+func (db *DB) loadingIndex() *indexLoading {
+	if l := db.loading.Load(); l != nil && !l.ready.Load() {
+		return l
+	}
+	return nil
+}
+
+// prepareBackgroundLoad 记录打开时的数据文件，Open 返回之后在后台加载索引
+// 活跃文件之后的写入追加在打开时的位置之后，加载时不会读取到
+func (db *DB) prepareBackgroundLoad() {
+	l := &indexLoading{
+		files:   db.indexFiles(),
+		written: make(map[string]struct{}),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	l.scans.Store(maxLoadingScans)
+	db.loading.Store(l)
+}
+
+// loadInBackground 加载索引并统计有效数据量，完成之后不再记录写入的 key
+func (db *DB) loadInBackground(l *indexLoading) {
+	err := db.loadIndex()
+	db.mu.Lock()
+	// 加载期间的写入改变了数据文件，关闭时保存的计数不能再使用
+	if err == nil {
+		err = db.countDeadBytes()
+	}
+	// 失败之后不再需要区分加载期间写入的 key
+	l.written = nil
+	if err == nil {
+		db.txnRecords = nil
+		l.loadedFiles.Store(int64(len(l.files)))
+		l.ready.Store(true)
+	}
+	l.err = err
+	db.mu.Unlock()
+	close(l.done)
+}
+
+// failed 加载失败或者被停止时返回原因，之后索引不会再加载完成
+func (l *indexLoading) failed() error {
+	select {
+	case <-l.done:
+		return l.err
+	default:
+		return nil
+	}
+}
+
+// loadError 后台加载失败时返回原因，索引不完整，不能继续写入；需要持有锁
+func (db *DB) loadError() error {
+	if l := db.loadingIndex(); l != nil {
+		return l.err
+	}
+	return nil
+}
+
+// stopLoading 关闭数据库之前停止后台加载，等待加载结束之后才能关闭数据文件
+func (db *DB) stopLoading() {
+	if l := db.loadingIndex(); l != nil {
+		close(l.stop)
+		<-l.done
+	}
+}
+
+// lockForLoad 后台加载时获取写锁，和写入互斥地更新索引，返回释放锁的函数
+// 打开时加载或者只读模式下 Refresh 时不需要获取
+func (db *DB) lockForLoad() (func(), error) {
+	l := db.loadingIndex()
+	if l == nil {
+		return func() {}, nil
+	}
+	db.mu.Lock()
+	select {
+	case <-l.stop:
+		db.mu.Unlock()
+		return nil, ErrDBClosed
+	default:
+	}
+	return db.mu.Unlock, nil
+}
+
+// markWritten 记录后台加载期间写入或删除的 key，需要持有写锁
+func (db *DB) markWritten(key []byte) {
+	if l := db.loadingIndex(); l != nil && l.written != nil {
+		l.written[string(key)] = struct{}{}
+	}
+}
+
+// isWritten key 是否在后台加载期间被写入或删除过，需要持有锁
+// 索引中这些 key 的位置已经是最新的，加载时不能再被数据文件中更早的记录覆盖
+func (db *DB) isWritten(key []byte) bool {
+	l := db.loadingIndex()
+	if l == nil {
+		return false
+	}
+	_, ok := l.written[string(key)]
+	return ok
+}
+
+// indexFiles 需要加载到索引中的全部数据文件，后台加载时使用打开时的数据文件
+func (db *DB) indexFiles() []fileLoad {
+	if l := db.loadingIndex(); l != nil {
+		return l.files
+	}
+	loads := make([]fileLoad, 0, len(db.fileIDs))
+	for _, fid := range db.fileIDs {
+		fileID := uint32(fid)
+		if fileID == db.activeFile.FileID {
+			loads = append(loads, fileLoad{dataFile: db.activeFile, size: db.activeFile.WriteOff})
+		} else {
+			dataFile := db.oldFile[fileID]
+			loads = append(loads, fileLoad{dataFile: dataFile, size: dataFile.WriteOff, sealed: true})
+		}
+	}
+	return loads
+}
+
+// fileLoadsFrom 从 fid 文件的 offset 位置开始需要加载的数据文件
+func (db *DB) fileLoadsFrom(fid uint32, offset int64) []fileLoad {
+	files := db.indexFiles()
+	var loads []fileLoad
+	for _, load := range files {
+		if load.dataFile.FileID < fid {
+			continue
+		}
+		if load.dataFile.FileID == fid {
+			load.offset = offset
+		}
+		loads = append(loads, load)
+	}
+	// 之前的文件已经从快照或者 merge 的 hint 文件中加载
+	if l := db.loadingIndex(); l != nil {
+		l.loadedFiles.Store(int64(len(files) - len(loads)))
+	}
+	return loads
+}
+
+// resetIndex 丢弃已经加载的数据，使用新的索引重新加载
+// 后台加载时保留加载期间写入的 key，需要持有写锁
+func (db *DB) resetIndex() error {
+	newIndex, err := db.newIndexer(db.cfg.SyncWrite)
+	if err != nil {
+		return err
+	}
+	if l := db.loadingIndex(); l != nil {
+		err = index.Batch(newIndex, func(w index.BatchWriter) error {
+			for key := range l.written {
+				pos, err := db.index.Get([]byte(key))
+				if err != nil || pos == nil {
+					continue
+				}
+				if err := w.Put([]byte(key), pos); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	_ = db.index.Close()
+	db.index = newIndex
+	db.releaseGeneration(db.swapGeneration())
+	db.seqNo = nonTransactionSeqNo
+	return nil
+}
+
+// writtenWhileLoading 后台加载期间读取时判断索引中 key 的位置是否已经是最新的
+func (db *DB) writtenWhileLoading(key []byte) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.isWritten(key)
+}
+
+// scanValue 索引加载完成之前从新到旧读取打开时的数据文件查找 key
+// 每个文件中使用最后一条有效的记录，事务的数据需要在同一个或者之后的文件中有提交标识
+// 依次处理每批记录，只保留 key 匹配的位置，不需要缓存整个文件的记录
+func (db *DB) scanValue(gen *fileGeneration, l *indexLoading, key []byte) ([]byte, error) {
+	type match struct {
+		recordType data.LogRecordType
+		pos        *data.LogRecordPos
+	}
+	committed := make(map[uint64]bool)
+	for i := len(l.files) - 1; i >= 0; i-- {
+		var latest *match
+		txnMatches := make(map[uint64]*match)
+		var readErr error
+		db.readFileLoad(l.files[i], func(chunk *loadedFile) bool {
+			readErr = chunk.err
+			for j, record := range chunk.records {
+				realKey, seqNo := parseLogRecordKey(record.Key)
+				if record.Type == data.LogRecordTxnFinished {
+					committed[seqNo] = true
+					continue
+				}
+				if !bytes.Equal(realKey, key) {
+					continue
+				}
+				m := &match{recordType: record.Type, pos: chunk.positions[j]}
+				if seqNo == nonTransactionSeqNo {
+					latest = m
+				} else {
+					txnMatches[seqNo] = m
+				}
+			}
+			return true
+		})
+		if readErr != nil {
+			return nil, readErr
+		}
+		// 提交的事务中的记录和非事务的记录比较在文件中的位置
+		for seqNo, m := range txnMatches {
+			if committed[seqNo] && (latest == nil || m.pos.Offset > latest.pos.Offset) {
+				latest = m
+			}
+		}
+		if latest == nil {
+			continue
+		}
+		if latest.recordType == data.LogRecordDeleted {
+			return nil, ErrKeyNotFound
+		}
+		return db.getValueFromGeneration(gen, latest.pos)
+	}
+	return nil, ErrKeyNotFound
+}
@@ -0,0 +1,276 @@
+package bitcask
+
+import (
+	"bitcask/data"
+	"bitcask/utils"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeLoadingTestData 写入跨越多个数据文件的覆盖、删除和事务，返回每个 key 最新的 value
+func writeLoadingTestData(t *testing.T, db *DB) map[string][]byte {
+	values := make(map[string][]byte)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 300; i++ {
+			key := utils.GetTestKey(i)
+			values[string(key)] = utils.GetTestValue(64)
+			assert.Nil(t, db.Put(key, values[string(key)]))
+		}
+		for i := round * 30; i < round*30+30; i++ {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+			delete(values, string(utils.GetTestKey(i)))
+		}
+		wb := db.NewWriteBatch(DefaultWriteBatchConfig)
+		for i := 300; i < 400; i++ {
+			key := utils.GetTestKey(i)
+			values[string(key)] = utils.GetTestValue(64)
+			assert.Nil(t, wb.Put(key, values[string(key)]))
+		}
+		assert.Nil(t, wb.Commit())
+	}
+	// 写入过程中失败、没有提交的事务
+	_, err := db.appendLogRecordWithLock(&data.LogRecord{
+		Key:   logRecordKeyWriteWithSeq(utils.GetTestKey(1000), atomic.AddUint64(&db.seqNo, 1)),
+		Value: utils.GetTestValue(64),
+	})
+	assert.Nil(t, err)
+	return values
+}
+
+// restartLoading 丢弃已经加载的索引，模拟刚打开数据库、后台还没有开始加载的状态
+func restartLoading(db *DB) *indexLoading {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.waitIndexUpdates()
+	db.prepareBackgroundLoad()
+	db.index, _ = db.newIndexer(false)
+	db.releaseGeneration(db.swapGeneration())
+	db.seqNo = nonTransactionSeqNo
+	return db.loading.Load()
+}
+
+// TestDB_BackgroundLoad 后台加载完成之前从数据文件中读取，加载期间的写入不会被数据文件中更早的记录覆盖
+func TestDB_BackgroundLoad(t *testing.T) {
+	for _, useSnapshot := range []bool{false, true} {
+		db, cfg := openMergeTestDB(t, Btree)
+		values := writeLoadingTestData(t, db)
+		seqNo := db.seqNo
+		assert.Nil(t, db.Close())
+
+		cfg.BackgroundLoad = true
+		db, err := Open(cfg)
+		assert.Nil(t, err)
+		assert.Nil(t, db.WaitReady(context.Background()))
+		checkTestValues(t, db, values)
+
+		l := restartLoading(db)
+		// 每个 key 都从数据文件中查找
+		l.scans.Store(int64(len(values)) + 100)
+		if !useSnapshot {
+			removeIndexSnapshot(t, cfg.DirPath)
+		}
+		progress := db.LoadProgress()
+		assert.False(t, progress.Ready)
+		assert.True(t, progress.FilesTotal > 3)
+		// 索引为空，从数据文件中查找
+		for key, value := range values {
+			val, err := db.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, value, val)
+		}
+		for _, i := range []int{60, 89, 1000, 2000} {
+			_, err := db.Get(utils.GetTestKey(i))
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+
+		// 加载期间覆盖、删除和新写入的 key
+		for i := 200; i < 250; i++ {
+			key := utils.GetTestKey(i)
+			values[string(key)] = utils.GetTestValue(32)
+			assert.Nil(t, db.Put(key, values[string(key)]))
+		}
+		for i := 250; i < 260; i++ {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+			delete(values, string(utils.GetTestKey(i)))
+		}
+		for i := 2000; i < 2300; i++ {
+			key := utils.GetTestKey(i)
+			values[string(key)] = utils.GetTestValue(64)
+			assert.Nil(t, db.Put(key, values[string(key)]))
+		}
+		for _, i := range []int{200, 255, 2100} {
+			val, err := db.Get(utils.GetTestKey(i))
+			if value, ok := values[string(utils.GetTestKey(i))]; ok {
+				assert.Nil(t, err)
+				assert.Equal(t, value, val)
+			} else {
+				assert.Equal(t, ErrKeyNotFound, err)
+			}
+		}
+
+		// 事务和遍历需要等待加载完成
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		wb := db.NewWriteBatch(DefaultWriteBatchConfig)
+		assert.Nil(t, wb.Put(utils.GetTestKey(3000), utils.GetTestValue(64)))
+		assert.Equal(t, context.DeadlineExceeded, wb.CommitContext(ctx))
+		_, err = db.ListKeysContext(ctx)
+		assert.Equal(t, context.DeadlineExceeded, err)
+		assert.Equal(t, context.DeadlineExceeded, db.WaitReady(ctx))
+		cancel()
+
+		db.loadInBackground(l)
+		assert.Nil(t, db.WaitReady(context.Background()))
+		progress = db.LoadProgress()
+		assert.True(t, progress.Ready)
+		assert.Nil(t, progress.Err)
+		assert.Equal(t, progress.FilesTotal, progress.FilesDone)
+		assert.Equal(t, seqNo, db.seqNo)
+		checkTestValues(t, db, values)
+		assert.Nil(t, wb.Commit())
+		assert.Equal(t, seqNo+1, db.seqNo)
+		_, err = db.Get(utils.GetTestKey(3000))
+		assert.Nil(t, err)
+		delete(values, string(utils.GetTestKey(3000)))
+		assert.Nil(t, db.Delete(utils.GetTestKey(3000)))
+		assert.Nil(t, db.Close())
+
+		// 重新打开之后数据文件中的顺序和加载期间看到的一致
+		cfg.BackgroundLoad = false
+		removeIndexSnapshot(t, cfg.DirPath)
+		db, err = Open(cfg)
+		assert.Nil(t, err)
+		checkTestValues(t, db, values)
+		destroyDB(db)
+	}
+}
+
+// TestDB_BackgroundLoad_Concurrent 打开之后立即读写，同时关闭还没有加载完成的数据库
+func TestDB_BackgroundLoad_Concurrent(t *testing.T) {
+	db, cfg := openMergeTestDB(t, ART)
+	defer func() { destroyDB(db) }()
+	values := writeLoadingTestData(t, db)
+	assert.Nil(t, db.Close())
+	removeIndexSnapshot(t, cfg.DirPath)
+
+	cfg.BackgroundLoad = true
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+	// 关闭之前没有加载完成时停止加载，不完整的索引不会保存为快照
+	if err := db.WaitReady(context.Background()); err != nil {
+		assert.Equal(t, ErrDBClosed, err)
+		_, err = os.Stat(filepath.Join(cfg.DirPath, data.IndexSnapshotFileName))
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	for i := 0; i < 400; i++ {
+		key := utils.GetTestKey(i)
+		if i%2 == 0 {
+			values[string(key)] = utils.GetTestValue(16)
+			assert.Nil(t, db.Put(key, values[string(key)]))
+		}
+		val, err := db.Get(key)
+		if value, ok := values[string(key)]; ok {
+			assert.Nil(t, err)
+			assert.Equal(t, value, val)
+		} else {
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+	}
+	assert.Nil(t, db.WaitReady(context.Background()))
+	checkTestValues(t, db, values)
+	assert.Nil(t, db.Merge())
+	checkTestValues(t, db, values)
+}
+
+// TestDB_BackgroundLoad_BatchDelete 加载完成之前 WriteBatch 删除的 key 还不在索引中，提交之后同样被删除
+func TestDB_BackgroundLoad_BatchDelete(t *testing.T) {
+	db, cfg := openMergeTestDB(t, Btree)
+	defer func() { destroyDB(db) }()
+	values := writeLoadingTestData(t, db)
+	assert.Nil(t, db.Close())
+	removeIndexSnapshot(t, cfg.DirPath)
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+
+	l := restartLoading(db)
+	wb := db.NewWriteBatch(DefaultWriteBatchConfig)
+	for i := 100; i < 110; i++ {
+		assert.Nil(t, wb.Delete(utils.GetTestKey(i)))
+		delete(values, string(utils.GetTestKey(i)))
+	}
+	db.loadInBackground(l)
+	assert.Nil(t, db.WaitReady(context.Background()))
+	assert.Nil(t, wb.Commit())
+	checkTestValues(t, db, values)
+
+	assert.Nil(t, db.Close())
+	removeIndexSnapshot(t, cfg.DirPath)
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	checkTestValues(t, db, values)
+}
+
+// TestDB_BackgroundLoad_ScanLimit 从数据文件中查找的次数用完之后，读取等待加载完成
+func TestDB_BackgroundLoad_ScanLimit(t *testing.T) {
+	db, cfg := openMergeTestDB(t, Btree)
+	defer func() { destroyDB(db) }()
+	values := writeLoadingTestData(t, db)
+	assert.Nil(t, db.Close())
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+
+	l := restartLoading(db)
+	l.scans.Store(2)
+	for _, i := range []int{100, 200} {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[string(utils.GetTestKey(i))], val)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, err = db.GetContext(ctx, utils.GetTestKey(300))
+	assert.Equal(t, context.DeadlineExceeded, err)
+	cancel()
+
+	go db.loadInBackground(l)
+	val, err := db.Get(utils.GetTestKey(300))
+	assert.Nil(t, err)
+	assert.Equal(t, values[string(utils.GetTestKey(300))], val)
+	checkTestValues(t, db, values)
+}
+
+// TestDB_BackgroundLoad_Failed 加载失败之后读写都返回失败的原因，不再从数据文件中查找
+func TestDB_BackgroundLoad_Failed(t *testing.T) {
+	db, cfg := openMergeTestDB(t, Btree)
+	defer func() { destroyDB(db) }()
+	writeLoadingTestData(t, db)
+	assert.Nil(t, db.Close())
+	removeIndexSnapshot(t, cfg.DirPath)
+	// 没有 hint 文件的旧文件中间的数据损坏
+	assert.Nil(t, os.Remove(data.GetHintFileName(cfg.DirPath, 0)))
+	corruptDataFile(t, cfg.DirPath, 0, 100)
+
+	cfg.BackgroundLoad = true
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	loadErr := db.WaitReady(context.Background())
+	assert.NotNil(t, loadErr)
+	progress := db.LoadProgress()
+	assert.False(t, progress.Ready)
+	assert.Equal(t, loadErr, progress.Err)
+	assert.Nil(t, db.loading.Load().written)
+
+	_, err = db.Get(utils.GetTestKey(100))
+	assert.Equal(t, loadErr, err)
+	assert.Equal(t, loadErr, db.Put(utils.GetTestKey(100), utils.GetTestValue(16)))
+	assert.Equal(t, loadErr, db.Delete(utils.GetTestKey(100)))
+	_, err = db.ListKeysContext(context.Background())
+	assert.Equal(t, loadErr, err)
+}
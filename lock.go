@@ -0,0 +1,136 @@
+package bitcask
+
+import (
+	"context"
+	"sync"
+)
+
+// rwLock 读写锁，阻塞获取和带 ctx 的获取在同一个等待队列中竞争
+// 有写锁在等待时新的读锁也需要等待，避免持续的读取让写入一直拿不到锁
+type rwLock struct {
+	mu      sync.Mutex
+	readers int           // 持有读锁的数量
+	writer  bool          // 写锁已经被持有
+	writers int           // 等待写锁的数量
+	wake    chan struct{} // 锁的状态变化时关闭，唤醒所有等待者重新检查
+}
+
+// Lock 阻塞获取写锁
+func (l *rwLock) Lock() {
+	_ = l.lock(context.Background(), true)
+}
+
+// Unlock 释放写锁
+func (l *rwLock) Unlock() {
+	l.mu.Lock()
+	if !l.writer {
+		l.mu.Unlock()
+		panic("bitcask: unlock of unlocked rwLock")
+	}
+	l.writer = false
+	l.broadcast()
+	l.mu.Unlock()
+}
+
+// RLock 阻塞获取读锁
+func (l *rwLock) RLock() {
+	_ = l.lock(context.Background(), false)
+}
+
+// RUnlock 释放读锁
+func (l *rwLock) RUnlock() {
+	l.mu.Lock()
+	if l.readers <= 0 {
+		l.mu.Unlock()
+		panic("bitcask: runlock of unlocked rwLock")
+	}
+	l.readers--
+	if l.readers == 0 {
+		l.broadcast()
+	}
+	l.mu.Unlock()
+}
+
+// LockContext 获取写锁，ctx 取消或者超时之后放弃获取并返回 ctx 的错误
+func (l *rwLock) LockContext(ctx context.Context) error {
+	return l.lock(ctx, true)
+}
+
+// RLockContext 获取读锁，ctx 取消或者超时之后放弃获取并返回 ctx 的错误
+func (l *rwLock) RLockContext(ctx context.Context) error {
+	return l.lock(ctx, false)
+}
+
+func (l *rwLock) lock(ctx context.Context, write bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	waiting := false
+	for {
+		l.mu.Lock()
+		if write && !l.writer && l.readers == 0 {
+			l.writer = true
+			if waiting {
+				l.writers--
+			}
+			l.mu.Unlock()
+			return nil
+		}
+		if !write && !l.writer && l.writers == 0 {
+			l.readers++
+			l.mu.Unlock()
+			return nil
+		}
+		if write && !waiting {
+			l.writers++
+			waiting = true
+		}
+		if l.wake == nil {
+			l.wake = make(chan struct{})
+		}
+		wake := l.wake
+		l.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			l.mu.Lock()
+			// 放弃等待的写锁不再阻挡读锁
+			if waiting {
+				l.writers--
+				l.broadcast()
+			}
+			l.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+}
+
+// broadcast 唤醒所有等待者，需要持有 l.mu
+func (l *rwLock) broadcast() {
+	if l.wake != nil {
+		close(l.wake)
+		l.wake = nil
+	}
+}
+
+// keyLockShards 按 key 分片的写入锁数量
+const keyLockShards = 256
+
+// keyLocks 按 key 分片的写入锁，写入在释放数据库的锁之后才更新索引，
+// 同一个 key 的写入持有同一个分片的锁，保证按照追加到数据文件的顺序更新索引
+type keyLocks [keyLockShards]rwLock
+
+// lock 获取 key 所在分片的锁，ctx 取消或者超时之后放弃获取
+func (kl *keyLocks) lock(ctx context.Context, key []byte) (*rwLock, error) {
+	h := uint32(2166136261)
+	for _, c := range key {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	l := &kl[h%keyLockShards]
+	if err := l.LockContext(ctx); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,80 @@
+package bitcask
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRWLock_Context(t *testing.T) {
+	l := new(rwLock)
+	l.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	assert.Equal(t, context.DeadlineExceeded, l.LockContext(ctx))
+	assert.Equal(t, context.DeadlineExceeded, l.RLockContext(ctx))
+	cancel()
+
+	// 释放写锁之后，阻塞等待的和带 ctx 等待的都能获取到读锁
+	acquired := make(chan error, 2)
+	go func() {
+		l.RLock()
+		acquired <- nil
+	}()
+	go func() {
+		acquired <- l.RLockContext(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	l.Unlock()
+	assert.Nil(t, <-acquired)
+	assert.Nil(t, <-acquired)
+	l.RUnlock()
+	l.RUnlock()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, l.LockContext(ctx))
+	assert.Nil(t, l.LockContext(context.Background()))
+	l.Unlock()
+}
+
+// TestRWLock_WriterPreferred 有写锁在等待时，新的读锁排在写锁之后，放弃等待的写锁不再阻挡读锁
+func TestRWLock_WriterPreferred(t *testing.T) {
+	l := new(rwLock)
+	l.RLock()
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := make(chan error, 1)
+	go func() {
+		writer <- l.LockContext(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	readCtx, readCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	assert.Equal(t, context.DeadlineExceeded, l.RLockContext(readCtx))
+	readCancel()
+
+	reader := make(chan struct{})
+	go func() {
+		l.RLock()
+		close(reader)
+	}()
+	cancel()
+	assert.Equal(t, context.Canceled, <-writer)
+	<-reader
+	l.RUnlock()
+	l.RUnlock()
+
+	// 读锁全部释放之后写锁才能获取到
+	var wg sync.WaitGroup
+	l.RLock()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		l.Lock()
+		l.Unlock()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	l.RUnlock()
+	wg.Wait()
+}
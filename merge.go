@@ -2,163 +2,425 @@ package bitcask
 
 import (
 	"bitcask/data"
+	"bitcask/index"
+	"bitcask/utils"
+	"context"
+	"fmt"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	mergeDirName     = "-merge"
 	mergeFinishedKey = "merge.finished"
+	// mergeProgressBytes 处理一个数据文件的过程中每读取这么多数据报告一次进度
+	mergeProgressBytes = 4 * 1024 * 1024
 )
 
 // Merge 清理无效数据 生成Hint文件
+// merge 完成后直接在线安装新的数据文件，不需要重启数据库
 func (db *DB) Merge() error {
-	if db.activeFile == nil {
-		return nil
+	return db.MergeWithOptions(context.Background(), DefaultMergeOptions)
+}
+
+// MergeWithOptions 使用指定的配置进行 merge
+// ctx 取消时停止 merge 并清理 merge 目录，已经写入的数据不受影响
+func (db *DB) MergeWithOptions(ctx context.Context, opts MergeOptions) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := db.WaitReady(ctx); err != nil {
+		return err
+	}
+	defer db.metrics.mergeLatency.observeSince(time.Now())
+	mergeFiles, baseFileID, nonMergeFileID, err := db.prepareMerge(ctx)
+	if err != nil || mergeFiles == nil {
+		return err
+	}
+	defer db.finishMerge()
+	result, err := db.writeMergeFiles(ctx, opts, mergeFiles, baseFileID, nonMergeFileID)
+	if err != nil {
+		return err
 	}
+	return db.installMergeFiles(result)
+}
+
+// finishMerge 标记 merge 结束，等待 merge 的 Close 可以继续
+func (db *DB) finishMerge() {
 	db.mu.Lock()
+	db.isMerging = false
+	db.mu.Unlock()
+	db.merges.Done()
+}
+
+// prepareMerge 标记 merge 开始，并切换到新的活跃文件
+// 返回需要 merge 的文件、merge 生成文件的起始编号以及没有参与 merge 的文件编号
+func (db *DB) prepareMerge(ctx context.Context) ([]*data.DataFile, uint32, uint32, error) {
+	if err := db.lockContext(ctx); err != nil {
+		return nil, 0, 0, err
+	}
+	defer db.mu.Unlock()
+	if db.closed.Load() {
+		return nil, 0, 0, ErrDBClosed
+	}
+	// 数据库为空，不需要 merge
+	if db.activeFile == nil {
+		return nil, 0, 0, nil
+	}
 	// 一次只能有一个merge进程
 	if db.isMerging {
-		db.mu.Unlock()
-		return ErrMergeIsProgress
+		return nil, 0, 0, ErrMergeIsProgress
 	}
-	db.isMerging = true
-	defer func() {
-		db.isMerging = false
-	}()
 	// 持久化当前活跃文件
-	if err := db.activeFile.Sync(); err != nil {
-		return err
+	if err := db.syncActiveFile(); err != nil {
+		return nil, 0, 0, err
 	}
+	// 合并失败时这个文件仍然有效，同样写入 hint 文件
+	db.writeHintFile()
 	// 讲过当前活跃文件转化为旧的数据文件
 	db.oldFile[db.activeFile.FileID] = db.activeFile
-	// 打开新的活跃文件
-	if err := db.setActiveFile(); err != nil {
-		db.mu.Unlock()
-		return err
-	}
-	// 记录没有参与merge的文件
-	nonMergeFileId := db.activeFile.FileID
 
 	// 取出需要merge的文件
 	var mergeFiles []*data.DataFile
 	for _, file := range db.oldFile {
 		mergeFiles = append(mergeFiles, file)
 	}
-	db.mu.Unlock()
+	// 在活跃文件之后为 merge 生成的文件预留编号，保证 merge 后的文件位于旧文件与新写入的文件之间
+	baseFileID := db.activeFile.FileID + 1
+	nonMergeFileID := baseFileID + mergeFileIDCount(mergeFiles, db.cfg.DataFileSize)
+	// 打开新的活跃文件
+	if err := db.setActiveFileWithID(nonMergeFileID); err != nil {
+		return nil, 0, 0, err
+	}
+	db.isMerging = true
+	db.merges.Add(1)
 	// 从小到大进行merge
 	sort.Slice(mergeFiles, func(i, j int) bool {
 		return mergeFiles[i].FileID < mergeFiles[j].FileID
 	})
+	return mergeFiles, baseFileID, nonMergeFileID, nil
+}
+
+// mergeFileIDCount merge 最多生成的文件数量
+// 旧文件可能是在更大的 DataFileSize 下写入的，需要按照输入的数据量和当前的文件大小计算：
+// 重写的记录不会比原来的大，相邻的两个文件中的数据一定超过一个文件的大小，否则后一个文件的第一条记录可以写入前一个文件
+func mergeFileIDCount(mergeFiles []*data.DataFile, fileSize int64) uint32 {
+	var total int64
+	for _, file := range mergeFiles {
+		total += file.WriteOff
+	}
+	count := 2*((total+fileSize-1)/fileSize) + 1
+	if count < int64(len(mergeFiles)) {
+		count = int64(len(mergeFiles))
+	}
+	return uint32(count)
+}
+
+// mergeResult merge 目录中生成的文件
+type mergeResult struct {
+	mergePath string
+	files     []*data.DataFile // merge 生成的数据文件
+	hintFile  *data.DataFile
+	manifest  *data.Manifest // 安装之后新的 manifest
+}
+
+// close 关闭 merge 生成的文件
+func (mr *mergeResult) close() {
+	for _, file := range mr.files {
+		_ = file.Close()
+	}
+	_ = mr.hintFile.Close()
+}
+
+// writeMergeFiles 将有效数据重写到 merge 目录中
+// 所有文件持久化之后，在 merge 目录中写入新的 manifest 作为 merge 完成的标识
+func (db *DB) writeMergeFiles(ctx context.Context, opts MergeOptions, mergeFiles []*data.DataFile, baseFileID, nonMergeFileID uint32) (*mergeResult, error) {
 	mergePath := db.getMergePath()
 	//若存在merge目录，需要移除
 	if _, err := os.Stat(mergePath); err == nil {
 		if err := os.RemoveAll(mergePath); err != nil {
-			return err
+			return nil, err
 		}
 	}
 	//新建一个merge目录
 	if err := os.Mkdir(mergePath, os.ModePerm); err != nil {
-		return err
-	}
-	//打开用于merge 的 bitcask实例
-	mergeConfig := db.cfg
-	mergeConfig.DirPath = mergePath
-	mergeConfig.SyncWrite = false
-	mergeDB, err := Open(mergeConfig)
-	if err != nil {
-		return err
+		return nil, err
 	}
+	writer := newMergeWriter(mergePath, db.cfg.DataFileSize, baseFileID, nonMergeFileID)
 	// 打开 hint 文件存储索引
 	hintFile, err := data.OpenHintFile(mergePath)
 	if err != nil {
-		return err
+		_ = os.RemoveAll(mergePath)
+		return nil, err
+	}
+	var finished bool
+	defer func() {
+		if !finished {
+			writer.close()
+			_ = hintFile.Close()
+			_ = os.RemoveAll(mergePath)
+		}
+	}()
+	limiter := newRateLimiter(opts.BytesPerSecond)
+	progress := MergeProgress{FilesTotal: len(mergeFiles)}
+	var reportedBytes int64
+	reportProgress := func() {
+		if opts.Progress != nil {
+			progress.BytesWritten = writer.written + hintFile.WriteOff
+			opts.Progress(progress)
+		}
+		reportedBytes = progress.BytesRead
 	}
 	//取出记录 重写有效数据
 	for _, dataFile := range mergeFiles {
 		var offset int64 = 0
 		for {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
 			record, size, err := dataFile.ReadLogRecord(offset)
 			if err != nil {
 				if err == io.EOF {
 					break
 				}
-				return err
+				db.metrics.observeReadError(err)
+				return nil, err
+			}
+			progress.BytesRead += size
+			if err := limiter.wait(ctx, size); err != nil {
+				return nil, err
 			}
 			// 获取实际的key
 			realKey, _ := parseLogRecordKey(record.Key)
-			pos := db.index.Get(realKey)
+			pos, err := db.index.Get(realKey)
+			if err != nil {
+				return nil, err
+			}
 			//和内存中的索引位置进行比较
 			if pos != nil &&
 				pos.Fid == dataFile.FileID &&
 				pos.Offset == offset {
 				// 重写有效数据,清除事务标记
 				record.Key = logRecordKeyWriteWithSeq(realKey, nonTransactionSeqNo)
-				logRecordPos, err := mergeDB.appendLogRecord(record)
+				written := writer.written
+				logRecordPos, err := writer.append(record)
 				if err != nil {
-					return err
+					return nil, err
 				}
 				//将当前位置索引写入到hint文件中
 				if err := hintFile.WriteHintRecord(realKey, logRecordPos); err != nil {
-					return err
+					return nil, err
+				}
+				progress.KeysRewritten++
+				if err := limiter.wait(ctx, writer.written-written); err != nil {
+					return nil, err
 				}
-
 			}
 			offset += size
+			// 大文件在处理过程中也定期报告进度
+			if progress.BytesRead-reportedBytes >= mergeProgressBytes {
+				reportProgress()
+			}
 		}
+		progress.FilesDone++
+		reportProgress()
 	}
 	//持久化文件
 	if err := hintFile.Sync(); err != nil {
+		return nil, err
+	}
+	if err := writer.sync(); err != nil {
+		return nil, err
+	}
+	//添加merge完成标识
+	db.mu.RLock()
+	manifest := &data.Manifest{
+		Generation:     db.manifest.Generation + 1,
+		NonMergeFileID: nonMergeFileID,
+	}
+	db.mu.RUnlock()
+	for _, file := range writer.files {
+		manifest.MergedFileIDs = append(manifest.MergedFileIDs, file.FileID)
+	}
+	if err := data.WriteManifest(mergePath, manifest); err != nil {
+		return nil, err
+	}
+	reportProgress()
+	finished = true
+	return &mergeResult{
+		mergePath: mergePath,
+		files:     writer.files,
+		hintFile:  hintFile,
+		manifest:  manifest,
+	}, nil
+}
+
+// installMergeFiles 在线安装 merge 结果
+// 先持久化新的 manifest，之后才移动文件、更新索引，
+// 被替换的旧文件在没有迭代器使用之后关闭并删除
+func (db *DB) installMergeFiles(result *mergeResult) error {
+	defer func() {
+		_ = result.hintFile.Close()
+	}()
+	// 写入新的 manifest 之后 merge 结果即生效，之后崩溃时重启会继续完成安装
+	if err := data.WriteManifest(db.cfg.DirPath, result.manifest); err != nil {
+		result.close()
+		_ = os.RemoveAll(result.mergePath)
 		return err
 	}
-	if err := mergeDB.Sync(); err != nil {
+	// 发布之前出错时 merge 文件还不属于数据库，需要关闭
+	if err := db.moveMergeFiles(result.mergePath); err != nil {
+		result.close()
 		return err
 	}
-	//添加merge完成标识
-	mergeFinishedFile, err := data.OpenMergeFinishedFile(mergePath)
-	if err != nil {
+	// 在数据目录中重新打开 merge 文件，之后由 fileCache 管理文件描述符
+	for i, file := range result.files {
+		cached, err := data.OpenCachedDataFile(db.cfg.DirPath, file.FileID, db.fileCache)
+		if err != nil {
+			// 已经重新打开的文件和还没有重新打开的 merge 文件都在 result.files 中
+			result.close()
+			return err
+		}
+		cached.WriteOff = file.WriteOff
+		_ = file.Close()
+		result.files[i] = cached
+	}
+
+	db.mu.Lock()
+	db.waitIndexUpdates()
+	// 先发布同时包含新旧文件的集合，索引更新到 merge 后的位置时读取可以找到对应的文件
+	for _, file := range result.files {
+		db.oldFile[file.FileID] = file
+	}
+	db.releaseGeneration(db.swapGeneration())
+	// 仍指向参与 merge 的文件的 key 没有被再次修改过，更新为 merge 后的位置
+	if err := db.applyMergeHint(result.hintFile, result.manifest.NonMergeFileID); err != nil {
+		db.mu.Unlock()
 		return err
 	}
-	// 比当前文件编号小的都参与了merge操作
-	mergeFinishedRecord := &data.LogRecord{
-		Key:   []byte(mergeFinishedKey),
-		Value: []byte(strconv.Itoa(int(nonMergeFileId))),
-		Type:  data.LogRecordNormal,
+	// 参与 merge 的文件会被删除，检查点需要指向没有参与 merge 的文件
+	if err := db.checkpointIndex(false); err != nil {
+		db.mu.Unlock()
+		return err
 	}
-	encRecord, _ := data.EncodeLogRecord(mergeFinishedRecord)
-	if err := mergeFinishedFile.Write(encRecord); err != nil {
+	newFiles := make(map[uint32]*data.DataFile)
+	var obsolete []*data.DataFile
+	for fileID, file := range db.oldFile {
+		if result.manifest.IsLive(fileID) {
+			newFiles[fileID] = file
+		} else {
+			obsolete = append(obsolete, file)
+			db.deadBytes.remove(fileID)
+		}
+	}
+	db.oldFile = newFiles
+	oldGeneration := db.swapGeneration()
+	oldGeneration.obsolete = obsolete
+	db.manifest = result.manifest
+	db.mu.Unlock()
+
+	// 磁盘索引更新持久化之后才能删除 merge 目录
+	if err := db.syncIndex(); err != nil {
 		return err
 	}
-	if err := mergeFinishedFile.Sync(); err != nil {
+	if err := os.RemoveAll(result.mergePath); err != nil {
 		return err
 	}
+	// 释放数据库持有的引用，没有迭代器使用时旧文件会立即被删除
+	db.releaseGeneration(oldGeneration)
 	return nil
 }
 
-// getReclaimableSize 计算可回收的数据量
-func (db *DB) getReclaimableSize() int64 {
-	var reclaimableSize int64
-	for _, file := range db.oldFile {
-		var offset int64 = 0
-		for {
-			record, size, err := file.ReadLogRecord(offset)
-			if err != nil {
+// moveMergeFiles 将 merge 目录中的数据文件和 hint 文件移动到数据目录
+func (db *DB) moveMergeFiles(mergePath string) error {
+	dir, err := os.ReadDir(mergePath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dir {
+		if entry.Name() != data.HintFileName && !strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+			continue
+		}
+		src := filepath.Join(mergePath, entry.Name())
+		dst := filepath.Join(db.cfg.DirPath, entry.Name())
+		if err := os.Rename(src, dst); err != nil {
+			return err
+		}
+	}
+	return utils.SyncDir(db.cfg.DirPath)
+}
+
+// syncIndex 持久化磁盘索引
+func (db *DB) syncIndex() error {
+	if syncer, ok := db.index.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// indexBatchSize 批量更新索引时每次操作包含的记录数量
+const indexBatchSize = 10000
+
+// readHintRecords 从 offset 开始读取最多 indexBatchSize 条 hint 记录，返回下一条记录的位置
+func readHintRecords(hintFile *data.DataFile, offset int64) ([]*data.LogRecord, int64, error) {
+	var records []*data.LogRecord
+	for len(records) < indexBatchSize {
+		record, size, err := hintFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
 				break
 			}
-			realKey, _ := parseLogRecordKey(record.Key)
-			pos := db.index.Get(realKey)
-			// 如果索引中不存在，或者索引指向的文件/偏移与当前记录不同，说明该记录可回收
-			if pos == nil || pos.Fid != file.FileID || pos.Offset != offset {
-				reclaimableSize += size
+			return nil, 0, err
+		}
+		records = append(records, record)
+		offset += size
+	}
+	return records, offset, nil
+}
+
+// applyMergeHint 根据 hint 文件更新索引
+// 只有仍然指向参与 merge 的旧文件的 key 才会被更新
+func (db *DB) applyMergeHint(hintFile *data.DataFile, nonMergeFileID uint32) error {
+	var offset int64 = 0
+	for {
+		records, next, err := readHintRecords(hintFile, offset)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			return nil
+		}
+		offset = next
+		// b+树索引每批记录只需要一个事务
+		err = index.Batch(db.index, func(w index.BatchWriter) error {
+			for _, record := range records {
+				mergedPos := data.DecodeLogRecordPos(record.Value)
+				pos, err := w.Get(record.Key)
+				if err != nil {
+					return err
+				}
+				if pos != nil && pos.Fid < nonMergeFileID {
+					if err := w.Put(record.Key, mergedPos); err != nil {
+						return err
+					}
+				} else {
+					// merge 期间 key 被修改过，merge 重写的数据已经无效
+					db.markDead(mergedPos)
+				}
 			}
-			offset += size
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrIndexUpdateFailed, err)
 		}
 	}
-	return reclaimableSize
 }
 
 // getMergePath 获取merge目录
@@ -168,8 +430,94 @@ func (db *DB) getMergePath() string {
 	return path.Join(dir, base+mergeDirName)
 }
 
-// 加载merge 数据目录
+// loadMergeFile 加载 manifest，并处理上一次没有安装完成的 merge
+// merge 目录中的 manifest 与数据目录中的一致时，说明 merge 结果已经生效，需要继续完成安装；
+// 否则 merge 没有完成，直接丢弃 merge 目录
 func (db *DB) loadMergeFile() error {
+	manifest, err := data.ReadManifest(db.cfg.DirPath)
+	if err != nil {
+		return err
+	}
+	// 旧版本的数据目录中没有 manifest，根据 merge 完成标识生成
+	if manifest == nil {
+		if manifest, err = db.loadLegacyMergeFile(); err != nil {
+			return err
+		}
+	}
+	db.manifest = manifest
+
+	mergePath := db.getMergePath()
+	if _, err := os.Stat(mergePath); err != nil {
+		return nil
+	}
+	mergeManifest, err := data.ReadManifest(mergePath)
+	if err != nil || mergeManifest == nil || mergeManifest.Generation != manifest.Generation {
+		return os.RemoveAll(mergePath)
+	}
+	if err := db.moveMergeFiles(mergePath); err != nil {
+		return err
+	}
+	// b+树索引不会从 hint 文件中重建，需要把 merge 后的位置写入索引
+	if db.isBPTreeIndex() {
+		hintFile, err := data.OpenHintFile(db.cfg.DirPath)
+		if err != nil {
+			return err
+		}
+		defer hintFile.Close()
+		if err := db.applyMergeHint(hintFile, manifest.NonMergeFileID); err != nil {
+			return err
+		}
+		if err := db.syncIndex(); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(mergePath)
+}
+
+// loadLegacyMergeFile 处理旧版本的 merge 目录，并根据 merge 完成标识生成 manifest
+func (db *DB) loadLegacyMergeFile() (*data.Manifest, error) {
+	if err := db.installLegacyMergeDir(); err != nil {
+		return nil, err
+	}
+	manifest, err := db.legacyManifest()
+	if err != nil {
+		return nil, err
+	}
+	if err := data.WriteManifest(db.cfg.DirPath, manifest); err != nil {
+		return nil, err
+	}
+	finishedFile := filepath.Join(db.cfg.DirPath, data.MergeFinishedFileName)
+	if err := os.Remove(finishedFile); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// legacyManifest 根据旧版本数据目录中的 merge 完成标识生成 manifest
+func (db *DB) legacyManifest() (*data.Manifest, error) {
+	manifest := &data.Manifest{}
+	finishedFile := filepath.Join(db.cfg.DirPath, data.MergeFinishedFileName)
+	if _, err := os.Stat(finishedFile); err == nil {
+		nonMergeFileID, err := db.getNonMergeFileID(db.cfg.DirPath)
+		if err != nil {
+			return nil, err
+		}
+		manifest.NonMergeFileID = nonMergeFileID
+		fileIDs, err := db.listDataFileIDs()
+		if err != nil {
+			return nil, err
+		}
+		for _, fileID := range fileIDs {
+			if uint32(fileID) < nonMergeFileID {
+				manifest.MergedFileIDs = append(manifest.MergedFileIDs, uint32(fileID))
+			}
+		}
+	}
+	return manifest, nil
+}
+
+// installLegacyMergeDir 加载旧版本的merge 数据目录
+func (db *DB) installLegacyMergeDir() error {
 	mergePath := db.getMergePath()
 	if _, err := os.Stat(mergePath); err != nil {
 		return nil
@@ -202,10 +550,14 @@ func (db *DB) loadMergeFile() error {
 	if err != nil {
 		return err
 	}
+	baseFileID, err := db.getMergeBaseFileID(mergePath, nonMergeFileID)
+	if err != nil {
+		return err
+	}
 	// 删除对应的数据文件
-	// 删除id 相对于较小的id
+	// 删除id 相对于较小的id，merge 生成的文件可能已经被在线安装过程移动到了数据目录中
 	var fileID uint32 = 0
-	for ; fileID < nonMergeFileID; fileID++ {
+	for ; fileID < baseFileID; fileID++ {
 		fileName := data.GetDataFileName(db.cfg.DirPath, fileID)
 		if _, err := os.Stat(fileName); err == nil {
 			if err := os.Remove(fileName); err != nil {
@@ -213,7 +565,10 @@ func (db *DB) loadMergeFile() error {
 			}
 		}
 	}
-	// 将新的数据文件移动到数据目录中
+	// 将新的数据文件移动到数据目录中，标识文件最后移动
+	sort.SliceStable(mergeFileNames, func(i, j int) bool {
+		return mergeFileNames[i] != data.MergeFinishedFileName && mergeFileNames[j] == data.MergeFinishedFileName
+	})
 	for _, fileName := range mergeFileNames {
 		src := filepath.Join(mergePath, fileName)
 		dst := filepath.Join(db.cfg.DirPath, fileName)
@@ -221,6 +576,15 @@ func (db *DB) loadMergeFile() error {
 			return err
 		}
 	}
+	// b+树索引不会从 hint 文件中重建，需要把 merge 后的位置写入索引
+	if db.isBPTreeIndex() {
+		hintFile, err := data.OpenHintFile(db.cfg.DirPath)
+		if err != nil {
+			return err
+		}
+		defer hintFile.Close()
+		return db.applyMergeHint(hintFile, nonMergeFileID)
+	}
 	return nil
 }
 func (db *DB) getNonMergeFileID(dirPath string) (uint32, error) {
@@ -228,6 +592,7 @@ func (db *DB) getNonMergeFileID(dirPath string) (uint32, error) {
 	if err != nil {
 		return 0, err
 	}
+	defer file.Close()
 	record, _, err := file.ReadLogRecord(0)
 	if err != nil {
 		return 0, err
@@ -239,32 +604,254 @@ func (db *DB) getNonMergeFileID(dirPath string) (uint32, error) {
 	return uint32(fileID), nil
 }
 
+// getMergeBaseFileID 获取 merge 生成文件的起始编号
+// 旧版本的标识文件中没有该记录，此时 merge 生成的文件编号从 0 开始
+func (db *DB) getMergeBaseFileID(dirPath string, nonMergeFileID uint32) (uint32, error) {
+	file, err := data.OpenMergeFinishedFile(dirPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	_, size, err := file.ReadLogRecord(0)
+	if err != nil {
+		return 0, err
+	}
+	record, _, err := file.ReadLogRecord(size)
+	if err == io.EOF {
+		return nonMergeFileID, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	fileID, err := strconv.Atoi(string(record.Value))
+	if err != nil {
+		return 0, err
+	}
+	return uint32(fileID), nil
+}
+
 func (db *DB) loadIndexFromHintFile() error {
 	// 查询hint文件是否存在
 	hintPath := filepath.Join(db.cfg.DirPath, data.HintFileName)
-	if len(hintPath) == 0 {
+	if _, err := os.Stat(hintPath); os.IsNotExist(err) {
 		return nil
 	}
 	// 存在则打开
-	hintFile, err := data.OpenHintFile(db.cfg.DirPath)
+	hintFile, err := data.OpenHintFileReadOnly(db.cfg.DirPath)
 	if err != nil {
 		return err
 	}
+	defer hintFile.Close()
 	//直接存放到索引
 	var offset int64 = 0
 	for {
-		record, size, err := hintFile.ReadLogRecord(offset)
+		records, next, err := readHintRecords(hintFile, offset)
 		if err != nil {
-			if err == io.EOF {
-				break
+			return err
+		}
+		if len(records) == 0 {
+			return nil
+		}
+		offset = next
+		unlock, err := db.lockForLoad()
+		if err != nil {
+			return err
+		}
+		err = index.Batch(db.index, func(w index.BatchWriter) error {
+			for _, record := range records {
+				// 后台加载期间写入过的 key 在索引中已经是最新的位置
+				if db.isWritten(record.Key) {
+					continue
+				}
+				// 拿到实际的索引
+				if err := w.Put(record.Key, data.DecodeLogRecordPos(record.Value)); err != nil {
+					return err
+				}
 			}
+			return nil
+		})
+		unlock()
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrIndexUpdateFailed, err)
+		}
+	}
+}
+
+// mergeWriter 将有效数据写入 merge 目录
+// 文件编号从预留区间的起点开始分配，不能超过没有参与 merge 的文件编号
+type mergeWriter struct {
+	dirPath    string
+	fileSize   int64
+	nextFileID uint32
+	maxFileID  uint32
+	activeFile *data.DataFile
+	files      []*data.DataFile // merge 生成的所有数据文件
+	written    int64            // 已经写入的字节数
+}
+
+func newMergeWriter(dirPath string, fileSize int64, baseFileID, maxFileID uint32) *mergeWriter {
+	return &mergeWriter{
+		dirPath:    dirPath,
+		fileSize:   fileSize,
+		nextFileID: baseFileID,
+		maxFileID:  maxFileID,
+	}
+}
+
+// append 追加写入一条记录，写满时切换到新的文件
+func (mw *mergeWriter) append(record *data.LogRecord) (*data.LogRecordPos, error) {
+	encRecord, size := data.EncodeLogRecord(record)
+	if mw.activeFile == nil || mw.activeFile.WriteOff+size > mw.fileSize {
+		if err := mw.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	offset := mw.activeFile.WriteOff
+	if err := mw.activeFile.Write(encRecord); err != nil {
+		return nil, err
+	}
+	mw.written += size
+	return &data.LogRecordPos{Fid: mw.activeFile.FileID, Offset: offset, Size: uint32(size)}, nil
+}
+
+func (mw *mergeWriter) rotate() error {
+	if mw.nextFileID >= mw.maxFileID {
+		return ErrMergeFileIDExhausted
+	}
+	if mw.activeFile != nil {
+		if err := mw.activeFile.Sync(); err != nil {
 			return err
 		}
-		// 拿到实际的索引
-		pos := data.DecodeLogRecordPos(record.Value)
-		db.index.Put(record.Key, pos)
-		offset += size
 	}
+	file, err := data.OpenDataFile(mw.dirPath, mw.nextFileID)
+	if err != nil {
+		return err
+	}
+	mw.nextFileID++
+	mw.activeFile = file
+	mw.files = append(mw.files, file)
 	return nil
+}
+
+func (mw *mergeWriter) sync() error {
+	if mw.activeFile == nil {
+		return nil
+	}
+	return mw.activeFile.Sync()
+}
+
+func (mw *mergeWriter) close() {
+	for _, file := range mw.files {
+		_ = file.Close()
+	}
+}
+
+// rateLimiter 限制 merge 的读写速率
+type rateLimiter struct {
+	bytesPerSecond int64
+	start          time.Time
+	bytes          int64
+}
+
+// newRateLimiter 创建速率限制器，bytesPerSecond 不大于 0 时不限制
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{bytesPerSecond: bytesPerSecond, start: time.Now()}
+}
+
+// wait 记录读写了 n 个字节，超过速率上限时等待，ctx 取消时提前返回
+func (rl *rateLimiter) wait(ctx context.Context, n int64) error {
+	if rl == nil {
+		return nil
+	}
+	rl.bytes += n
+	expected := time.Duration(float64(rl.bytes) / float64(rl.bytesPerSecond) * float64(time.Second))
+	delay := expected - time.Since(rl.start)
+	// 等待时间太短时累积到下一次，避免频繁地休眠
+	if delay < 10*time.Millisecond {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// fileGeneration 某一时刻可以读取的全部数据文件，包括活跃文件，发布之后不再修改
+// 读取和迭代器持有文件集合的引用，文件切换或者 merge 安装时发布新的集合，
+// merge 替换的文件在旧的集合引用全部归零时才会关闭并删除
+type fileGeneration struct {
+	files    map[uint32]*data.DataFile // 数据文件
+	index    index.Indexer             // 索引，只读模式下重新加载时会替换
+	refs     atomic.Int64              // 引用计数，当前集合由数据库持有一个引用
+	obsolete []*data.DataFile          // 被下一个集合替换的文件
+	next     *fileGeneration           // 下一个集合，被替换的集合持有它的引用
+	drained  chan struct{}             // 引用全部释放之后关闭，关闭数据库时等待
+}
 
+func newFileGeneration(files map[uint32]*data.DataFile) *fileGeneration {
+	gen := &fileGeneration{files: files, drained: make(chan struct{})}
+	gen.refs.Store(1)
+	return gen
+}
+
+// swapGeneration 根据当前的数据文件发布新的文件集合，需要持有写锁
+// 返回被替换的集合，调用方设置需要删除的文件之后释放其引用
+func (db *DB) swapGeneration() *fileGeneration {
+	files := make(map[uint32]*data.DataFile, len(db.oldFile)+1)
+	for fileID, file := range db.oldFile {
+		files[fileID] = file
+	}
+	if db.activeFile != nil {
+		files[db.activeFile.FileID] = db.activeFile
+	}
+	gen := newFileGeneration(files)
+	gen.index = db.index
+	old := db.generation.Load()
+	if old != nil {
+		// 旧的集合持有新集合的引用，保证新集合中记录的被替换文件在旧集合释放之前不会被删除
+		old.next = gen
+		gen.refs.Add(1)
+	}
+	db.generation.Store(gen)
+	return old
+}
+
+// acquireGeneration 获取当前文件集合的引用，不需要持有锁
+// 数据库关闭并且引用全部释放之后返回 nil
+func (db *DB) acquireGeneration() *fileGeneration {
+	for {
+		gen := db.generation.Load()
+		for refs := gen.refs.Load(); refs > 0; refs = gen.refs.Load() {
+			if gen.refs.CompareAndSwap(refs, refs+1) {
+				return gen
+			}
+		}
+		if db.closed.Load() {
+			return nil
+		}
+		// 集合已经被替换并且引用归零，重新获取当前的集合
+	}
+}
+
+// releaseGeneration 释放文件集合的引用，最后一个引用释放时删除被替换的文件
+func (db *DB) releaseGeneration(gen *fileGeneration) {
+	for gen != nil && gen.refs.Add(-1) == 0 {
+		for _, file := range gen.obsolete {
+			_ = file.Close()
+			// 只读模式下由写入进程负责删除
+			if !db.readOnly {
+				_ = db.removeDataFile(file.FileID)
+			}
+		}
+		gen.obsolete = nil
+		close(gen.drained)
+		gen = gen.next
+	}
 }
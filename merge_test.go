@@ -0,0 +1,462 @@
+package bitcask
+
+import (
+	"bitcask/data"
+	"bitcask/fio"
+	"bitcask/utils"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openMergeTestDB opens a DB with small data files so that the data spans several files.
+func openMergeTestDB(t *testing.T, indexType IndexerType) (*DB, DBConfig) {
+	cfg := DefaultConfig
+	dir, err := os.MkdirTemp("", "bitcask-test-merge")
+	assert.Nil(t, err)
+	cfg.DirPath = dir
+	cfg.DataFileSize = 32 * 1024
+	cfg.IndexType = indexType
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	return db, cfg
+}
+
+// TestDB_Merge_Online verifies that merged files are installed without reopening the DB.
+func TestDB_Merge_Online(t *testing.T) {
+	for _, indexType := range []IndexerType{Btree, ART, BPTree, Sharded, Hash, Arena} {
+		db, cfg := openMergeTestDB(t, indexType)
+
+		for i := 0; i < 2000; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+		}
+		values := make(map[int][]byte)
+		for i := 0; i < 1000; i++ {
+			values[i] = utils.GetTestValue(64)
+			assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+		}
+		for i := 500; i < 1000; i++ {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		}
+		oldFileIDs := make([]uint32, 0, len(db.oldFile))
+		for fileID := range db.oldFile {
+			oldFileIDs = append(oldFileIDs, fileID)
+		}
+		oldFileIDs = append(oldFileIDs, db.activeFile.FileID)
+
+		assert.Nil(t, db.Merge())
+		// merge 目录已经被安装到数据目录中
+		_, err := os.Stat(db.getMergePath())
+		assert.True(t, os.IsNotExist(err))
+		for _, fileID := range oldFileIDs {
+			_, err := os.Stat(data.GetDataFileName(cfg.DirPath, fileID))
+			assert.True(t, os.IsNotExist(err))
+		}
+		assert.Equal(t, int64(0), db.Stat().ReclaimableSize)
+
+		for i := 0; i < 2000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			if i >= 500 && i < 1000 {
+				assert.Equal(t, ErrKeyNotFound, err)
+				continue
+			}
+			assert.Nil(t, err)
+			if i < 500 {
+				assert.Equal(t, values[i], val)
+			}
+		}
+
+		// 重启之后数据仍然正确
+		assert.Nil(t, db.Put(utils.GetTestKey(1), values[0]))
+		assert.Nil(t, db.Close())
+		db, err = Open(cfg)
+		assert.Nil(t, err)
+		assert.Equal(t, 1500, len(listKeys(t, db)))
+		val, err := db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, values[0], val)
+		_, err = db.Get(utils.GetTestKey(600))
+		assert.Equal(t, ErrKeyNotFound, err)
+		destroyDB(db)
+	}
+}
+
+// TestDB_Merge_SmallerDataFileSize verifies that a merge still succeeds after DataFileSize is lowered,
+// when the live data of one old file needs several new files.
+func TestDB_Merge_SmallerDataFileSize(t *testing.T) {
+	db, cfg := openMergeTestDB(t, Btree)
+	values := make(map[string][]byte)
+	for i := 0; i < 2000; i++ {
+		key := utils.GetTestKey(i)
+		values[string(key)] = utils.GetTestValue(64)
+		assert.Nil(t, db.Put(key, values[string(key)]))
+	}
+	assert.Nil(t, db.Close())
+
+	cfg.DataFileSize = 4 * 1024
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	mergeFiles := len(db.oldFile) + 1
+	assert.Nil(t, db.Merge())
+	assert.True(t, len(db.oldFile) > mergeFiles)
+	checkTestValues(t, db, values)
+
+	assert.Nil(t, db.Close())
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	checkTestValues(t, db, values)
+}
+
+// TestDB_Merge_IteratorKeepsOldFiles verifies that files replaced by a merge
+// stay readable for iterators created before the merge.
+func TestDB_Merge_IteratorKeepsOldFiles(t *testing.T) {
+	db, _ := openMergeTestDB(t, Btree)
+	defer destroyDB(db)
+
+	values := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		key := utils.GetTestKey(i % 500)
+		values[string(key)] = utils.GetTestValue(64)
+		assert.Nil(t, db.Put(key, values[string(key)]))
+	}
+	firstFile := data.GetDataFileName(db.cfg.DirPath, 0)
+
+	iter := db.NewIterator(DefaultIteratorConfig)
+	assert.Nil(t, db.Merge())
+	_, err := os.Stat(firstFile)
+	assert.Nil(t, err)
+
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		val, err := iter.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, values[string(iter.Key())], val)
+		count++
+	}
+	assert.Equal(t, 500, count)
+	iter.Close()
+
+	_, err = os.Stat(firstFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// TestDB_Merge_ConcurrentWrites verifies that writes during a merge take precedence over merged data.
+func TestDB_Merge_ConcurrentWrites(t *testing.T) {
+	db, cfg := openMergeTestDB(t, Btree)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	latest := make([][]byte, 5000)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5000; i++ {
+			latest[i] = utils.GetTestValue(64)
+			assert.Nil(t, db.Put(utils.GetTestKey(i), latest[i]))
+		}
+	}()
+	assert.Nil(t, db.Merge())
+	wg.Wait()
+
+	for i := 0; i < 5000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, latest[i], val)
+	}
+	assert.Nil(t, db.Close())
+	var err error
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	for i := 0; i < 5000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, latest[i], val)
+	}
+}
+
+// TestDB_Merge_ConcurrentReads verifies that lock-free reads keep working
+// while files are rotated and replaced by a merge.
+func TestDB_Merge_ConcurrentReads(t *testing.T) {
+	db, _ := openMergeTestDB(t, Btree)
+	defer destroyDB(db)
+	values := make([][]byte, 2000)
+	for i := range values {
+		values[i] = utils.GetTestValue(64)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := r; ; i += 7 {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				val, err := db.Get(utils.GetTestKey(i % len(values)))
+				assert.Nil(t, err)
+				assert.Equal(t, values[i%len(values)], val)
+			}
+		}(r)
+	}
+	// 写入新的 key 触发文件切换，已有 key 的值保持不变
+	for i := len(values); i < 4000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Merge())
+	close(stop)
+	wg.Wait()
+}
+
+// TestDB_Merge_CrashAfterManifest verifies that a merge whose manifest has been
+// written is completed by the next Open.
+func TestDB_Merge_CrashAfterManifest(t *testing.T) {
+	for _, indexType := range []IndexerType{Btree, BPTree} {
+		db, cfg := openMergeTestDB(t, indexType)
+		values := make(map[string][]byte)
+		for i := 0; i < 2000; i++ {
+			key := utils.GetTestKey(i % 800)
+			values[string(key)] = utils.GetTestValue(64)
+			assert.Nil(t, db.Put(key, values[string(key)]))
+		}
+
+		mergeFiles, baseFileID, nonMergeFileID, err := db.prepareMerge(context.Background())
+		assert.Nil(t, err)
+		result, err := db.writeMergeFiles(context.Background(), DefaultMergeOptions, mergeFiles, baseFileID, nonMergeFileID)
+		assert.Nil(t, err)
+		// 写入 manifest 之后，移动文件之前崩溃
+		assert.Nil(t, data.WriteManifest(cfg.DirPath, result.manifest))
+		result.close()
+		// Close 会等待正在进行的 merge，模拟崩溃时直接结束 merge
+		db.finishMerge()
+		assert.Nil(t, db.Close())
+
+		db, err = Open(cfg)
+		assert.Nil(t, err)
+		assert.Equal(t, result.manifest.Generation, db.manifest.Generation)
+		_, err = os.Stat(db.getMergePath())
+		assert.True(t, os.IsNotExist(err))
+		for _, file := range mergeFiles {
+			_, err := os.Stat(data.GetDataFileName(cfg.DirPath, file.FileID))
+			assert.True(t, os.IsNotExist(err))
+		}
+		assert.Equal(t, 800, len(listKeys(t, db)))
+		for key, value := range values {
+			val, err := db.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, value, val)
+		}
+		destroyDB(db)
+	}
+}
+
+// TestDB_Merge_InstallReopenFails verifies that merge files are closed when reopening one of them fails.
+func TestDB_Merge_InstallReopenFails(t *testing.T) {
+	db, _ := openMergeTestDB(t, Btree)
+	defer destroyDB(db)
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+
+	mergeFiles, baseFileID, nonMergeFileID, err := db.prepareMerge(context.Background())
+	assert.Nil(t, err)
+	result, err := db.writeMergeFiles(context.Background(), DefaultMergeOptions, mergeFiles, baseFileID, nonMergeFileID)
+	assert.Nil(t, err)
+	assert.True(t, len(result.files) > 1)
+	// 最后一个 merge 文件没有被移动，只读的 fileCache 重新打开时失败
+	last := result.files[len(result.files)-1]
+	assert.Nil(t, os.Remove(data.GetDataFileName(result.mergePath, last.FileID)))
+	fileCache := db.fileCache
+	db.fileCache = fio.NewReadOnlyFileCache(0)
+	err = db.installMergeFiles(result)
+	assert.True(t, os.IsNotExist(err))
+	// 已经重新打开的文件和没有重新打开的 merge 文件都被关闭
+	assert.Equal(t, 0, db.fileCache.Len())
+	_, err = last.IoManager.Read(make([]byte, 1), 0)
+	assert.ErrorIs(t, err, os.ErrClosed)
+	db.fileCache = fileCache
+	db.finishMerge()
+}
+
+// TestDB_Merge_CrashBeforeManifest verifies that an unfinished merge is discarded.
+func TestDB_Merge_CrashBeforeManifest(t *testing.T) {
+	db, cfg := openMergeTestDB(t, Btree)
+	values := make(map[string][]byte)
+	for i := 0; i < 2000; i++ {
+		key := utils.GetTestKey(i % 800)
+		values[string(key)] = utils.GetTestValue(64)
+		assert.Nil(t, db.Put(key, values[string(key)]))
+	}
+
+	mergeFiles, baseFileID, nonMergeFileID, err := db.prepareMerge(context.Background())
+	assert.Nil(t, err)
+	result, err := db.writeMergeFiles(context.Background(), DefaultMergeOptions, mergeFiles, baseFileID, nonMergeFileID)
+	assert.Nil(t, err)
+	result.close()
+	db.finishMerge()
+	assert.Nil(t, db.Close())
+
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.Equal(t, uint64(0), db.manifest.Generation)
+	_, err = os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	for _, file := range mergeFiles {
+		_, err := os.Stat(data.GetDataFileName(cfg.DirPath, file.FileID))
+		assert.Nil(t, err)
+	}
+	for key, value := range values {
+		val, err := db.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+}
+
+// TestDB_MergeWithOptions_Cancel verifies that a cancelled merge removes the merge directory
+// and leaves the database untouched.
+func TestDB_MergeWithOptions_Cancel(t *testing.T) {
+	db, _ := openMergeTestDB(t, Btree)
+	defer destroyDB(db)
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i%800), utils.GetTestValue(64)))
+	}
+	numFiles := len(db.oldFile) + 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var reports []MergeProgress
+	err := db.MergeWithOptions(ctx, MergeOptions{
+		Progress: func(progress MergeProgress) {
+			reports = append(reports, progress)
+			cancel()
+		},
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, len(reports))
+	assert.Equal(t, 1, reports[0].FilesDone)
+	assert.Equal(t, numFiles, reports[0].FilesTotal)
+	assert.Greater(t, reports[0].BytesRead, int64(0))
+	_, err = os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, uint64(0), db.manifest.Generation)
+	assert.Equal(t, 800, len(listKeys(t, db)))
+
+	// 取消之后可以再次 merge
+	var last MergeProgress
+	err = db.MergeWithOptions(context.Background(), MergeOptions{
+		Progress: func(progress MergeProgress) {
+			last = progress
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, last.FilesTotal, last.FilesDone)
+	assert.Equal(t, int64(800), last.KeysRewritten)
+	assert.Greater(t, last.BytesWritten, int64(0))
+	assert.Equal(t, 800, len(listKeys(t, db)))
+}
+
+// TestDB_MergeWithOptions_ProgressWithinFile verifies that progress is reported while a large file is merged.
+func TestDB_MergeWithOptions_ProgressWithinFile(t *testing.T) {
+	cfg := DefaultConfig
+	dir, err := os.MkdirTemp("", "bitcask-merge-progress")
+	assert.Nil(t, err)
+	cfg.DirPath = dir
+	cfg.IndexType = Btree
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	for i := 0; i < 10000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i%5000), utils.GetTestValue(1024)))
+	}
+	assert.Equal(t, 0, len(db.oldFile))
+
+	var reports []MergeProgress
+	err = db.MergeWithOptions(context.Background(), MergeOptions{
+		Progress: func(progress MergeProgress) {
+			reports = append(reports, progress)
+		},
+	})
+	assert.Nil(t, err)
+	// 唯一的文件处理完成之前至少报告两次
+	assert.GreaterOrEqual(t, len(reports), 4)
+	assert.Equal(t, 0, reports[0].FilesDone)
+	assert.GreaterOrEqual(t, reports[0].BytesRead, int64(mergeProgressBytes))
+	for i := 1; i < len(reports); i++ {
+		assert.GreaterOrEqual(t, reports[i].BytesRead, reports[i-1].BytesRead)
+		assert.GreaterOrEqual(t, reports[i].BytesWritten, reports[i-1].BytesWritten)
+	}
+	last := reports[len(reports)-1]
+	assert.Equal(t, 1, last.FilesDone)
+	assert.Equal(t, int64(5000), last.KeysRewritten)
+	assert.Equal(t, 5000, len(listKeys(t, db)))
+}
+
+// TestDB_MergeWithOptions_RateLimit verifies that the merge respects the byte rate limit.
+func TestDB_MergeWithOptions_RateLimit(t *testing.T) {
+	db, _ := openMergeTestDB(t, Btree)
+	defer destroyDB(db)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+
+	var last MergeProgress
+	start := time.Now()
+	err := db.MergeWithOptions(context.Background(), MergeOptions{
+		BytesPerSecond: 512 * 1024,
+		Progress: func(progress MergeProgress) {
+			last = progress
+		},
+	})
+	assert.Nil(t, err)
+	expected := time.Duration(float64(last.BytesRead+last.BytesWritten) / (512 * 1024) * float64(time.Second))
+	assert.GreaterOrEqual(t, time.Since(start), expected*8/10)
+}
+
+// TestDB_Merge_Close verifies that Close waits for a running merge.
+func TestDB_Merge_Close(t *testing.T) {
+	db, cfg := openMergeTestDB(t, Btree)
+	defer destroyDB(db)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i%500), utils.GetTestValue(64)))
+	}
+
+	started := make(chan struct{})
+	merged := make(chan error, 1)
+	go func() {
+		var once sync.Once
+		merged <- db.MergeWithOptions(context.Background(), MergeOptions{
+			BytesPerSecond: 256 * 1024,
+			Progress: func(MergeProgress) {
+				once.Do(func() { close(started) })
+			},
+		})
+	}()
+	<-started
+	assert.Nil(t, db.Close())
+	select {
+	case err := <-merged:
+		assert.Nil(t, err)
+	default:
+		t.Fatal("Close returned before the merge finished")
+	}
+
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, len(listKeys(t, db)))
+	assert.Equal(t, int64(0), db.Stat().ReclaimableSize)
+	assert.Nil(t, db.Close())
+}
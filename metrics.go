@@ -0,0 +1,226 @@
+package bitcask
+
+import (
+	"bitcask/data"
+	"bitcask/index"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets 延迟直方图的桶上界，单位为秒，从 10µs 到约 10s
+var latencyBuckets = []float64{
+	0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005,
+	0.001, 0.0025, 0.005, 0.01, 0.025, 0.05,
+	0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+// histogram 并发安全的延迟直方图
+// 总数量由每个桶的数量相加得到，不单独计数，导出的累计值总是单调的
+type histogram struct {
+	counts []atomic.Uint64 // 每个桶中的数量，最后一个为 +Inf
+	sum    atomic.Int64    // 纳秒
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]atomic.Uint64, len(latencyBuckets)+1)}
+}
+
+// observeSince 记录从 start 开始到现在的耗时
+func (h *histogram) observeSince(start time.Time) {
+	h.observe(time.Since(start))
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := 0
+	for ; i < len(latencyBuckets); i++ {
+		if seconds <= latencyBuckets[i] {
+			break
+		}
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// snapshot 返回直方图的快照，桶中的数量为累计值，Count 为包括 +Inf 桶在内的累计值
+func (h *histogram) snapshot() Histogram {
+	res := Histogram{
+		Buckets: latencyBuckets,
+		Counts:  make([]uint64, len(latencyBuckets)),
+		Sum:     time.Duration(h.sum.Load()).Seconds(),
+	}
+	var cumulative uint64
+	for i := range h.counts {
+		cumulative += h.counts[i].Load()
+		if i < len(latencyBuckets) {
+			res.Counts[i] = cumulative
+		}
+	}
+	res.Count = cumulative
+	return res
+}
+
+// metrics 存储引擎运行时采集的指标
+type metrics struct {
+	getLatency    *histogram
+	putLatency    *histogram
+	deleteLatency *histogram
+	commitLatency *histogram
+	mergeLatency  *histogram
+	syncLatency   *histogram
+
+	bytesWritten     atomic.Int64
+	bytesSynced      atomic.Int64
+	fileRotations    atomic.Int64
+	crcErrors        atomic.Int64
+	iteratorsCreated atomic.Int64
+	iteratorsOpen    atomic.Int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		getLatency:    newHistogram(),
+		putLatency:    newHistogram(),
+		deleteLatency: newHistogram(),
+		commitLatency: newHistogram(),
+		mergeLatency:  newHistogram(),
+		syncLatency:   newHistogram(),
+	}
+}
+
+// observeReadError 统计读取数据时的 CRC 校验错误
+func (m *metrics) observeReadError(err error) {
+	if errors.Is(err, data.ErrInvalidCRC) {
+		m.crcErrors.Add(1)
+	}
+}
+
+// Histogram 延迟直方图快照
+type Histogram struct {
+	Buckets []float64 // 桶的上界，单位为秒
+	Counts  []uint64  // 耗时不大于对应上界的累计数量
+	Count   uint64    // 总数量
+	Sum     float64   // 总耗时，单位为秒
+}
+
+// Metrics 存储引擎运行指标
+type Metrics struct {
+	GetLatency    Histogram // Get 耗时
+	PutLatency    Histogram // Put 耗时
+	DeleteLatency Histogram // Delete 耗时
+	CommitLatency Histogram // WriteBatch.Commit 耗时
+	MergeLatency  Histogram // Merge 耗时
+	SyncLatency   Histogram // 活跃文件 fsync 耗时
+
+	BytesWritten  int64 // 写入数据文件的字节数
+	BytesSynced   int64 // 已经 fsync 持久化的字节数
+	FileRotations int64 // 活跃文件写满后切换的次数
+	CRCErrors     int64 // 读取数据时 CRC 校验失败的次数
+
+	IndexKeys        int64 // 索引中 key 的数量
+	IndexMemoryBytes int64 // 索引估算的内存占用，磁盘索引为 0
+	DataFiles        int64 // 数据文件数量
+	OpenDataFiles    int64 // 当前打开了文件描述符的数据文件数量
+	ReclaimableBytes int64 // 可以被 merge 回收的数据量
+
+	IteratorsCreated int64 // 创建过的迭代器数量
+	IteratorsOpen    int64 // 当前没有关闭的迭代器数量
+}
+
+// Metrics 返回存储引擎的运行指标
+func (db *DB) Metrics() *Metrics {
+	m := &Metrics{
+		GetLatency:       db.metrics.getLatency.snapshot(),
+		PutLatency:       db.metrics.putLatency.snapshot(),
+		DeleteLatency:    db.metrics.deleteLatency.snapshot(),
+		CommitLatency:    db.metrics.commitLatency.snapshot(),
+		MergeLatency:     db.metrics.mergeLatency.snapshot(),
+		SyncLatency:      db.metrics.syncLatency.snapshot(),
+		BytesWritten:     db.metrics.bytesWritten.Load(),
+		BytesSynced:      db.metrics.bytesSynced.Load(),
+		FileRotations:    db.metrics.fileRotations.Load(),
+		CRCErrors:        db.metrics.crcErrors.Load(),
+		IteratorsCreated: db.metrics.iteratorsCreated.Load(),
+		IteratorsOpen:    db.metrics.iteratorsOpen.Load(),
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	// 关闭之后只返回累计的指标
+	if db.closed.Load() {
+		return m
+	}
+	if size, err := db.index.Size(); err == nil {
+		m.IndexKeys = int64(size)
+	}
+	if sizer, ok := db.index.(index.MemorySizer); ok {
+		m.IndexMemoryBytes = sizer.MemoryUsage()
+	}
+	m.DataFiles = int64(len(db.oldFile))
+	if db.activeFile != nil {
+		m.DataFiles++
+	}
+	m.OpenDataFiles = int64(db.fileCache.Len())
+	m.ReclaimableBytes = db.deadBytes.total()
+	return m
+}
+
+// WritePrometheus 以 Prometheus 文本格式输出指标
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	writeHeader := func(name, help, kind string) {
+		_, _ = fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	writeValue := func(name, help, kind string, value int64) {
+		writeHeader(name, help, kind)
+		_, _ = fmt.Fprintf(bw, "%s %d\n", name, value)
+	}
+	writeHistogram := func(name, labels string, h Histogram) {
+		for i, bound := range h.Buckets {
+			_, _ = fmt.Fprintf(bw, "%s_bucket{%sle=\"%s\"} %d\n", name, labels, formatFloat(bound), h.Counts[i])
+		}
+		_, _ = fmt.Fprintf(bw, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.Count)
+		if len(labels) > 0 {
+			labels = "{" + labels[:len(labels)-1] + "}"
+		}
+		_, _ = fmt.Fprintf(bw, "%s_sum%s %s\n", name, labels, formatFloat(h.Sum))
+		_, _ = fmt.Fprintf(bw, "%s_count%s %d\n", name, labels, h.Count)
+	}
+
+	writeHeader("bitcask_operation_duration_seconds", "Latency of database operations.", "histogram")
+	for _, op := range []struct {
+		name string
+		h    Histogram
+	}{
+		{"get", m.GetLatency},
+		{"put", m.PutLatency},
+		{"delete", m.DeleteLatency},
+		{"commit", m.CommitLatency},
+		{"merge", m.MergeLatency},
+	} {
+		writeHistogram("bitcask_operation_duration_seconds", "op=\""+op.name+"\",", op.h)
+	}
+	writeHeader("bitcask_fsync_duration_seconds", "Latency of fsync on the active data file.", "histogram")
+	writeHistogram("bitcask_fsync_duration_seconds", "", m.SyncLatency)
+
+	writeValue("bitcask_bytes_written_total", "Bytes appended to data files.", "counter", m.BytesWritten)
+	writeValue("bitcask_bytes_synced_total", "Bytes made durable by fsync.", "counter", m.BytesSynced)
+	writeValue("bitcask_file_rotations_total", "Number of active data file rotations.", "counter", m.FileRotations)
+	writeValue("bitcask_crc_errors_total", "Number of records that failed the CRC check.", "counter", m.CRCErrors)
+	writeValue("bitcask_index_keys", "Number of keys in the index.", "gauge", m.IndexKeys)
+	writeValue("bitcask_index_memory_bytes", "Estimated memory used by the index.", "gauge", m.IndexMemoryBytes)
+	writeValue("bitcask_data_files", "Number of data files.", "gauge", m.DataFiles)
+	writeValue("bitcask_open_data_files", "Number of data files with an open file descriptor.", "gauge", m.OpenDataFiles)
+	writeValue("bitcask_reclaimable_bytes", "Bytes that can be reclaimed by a merge.", "gauge", m.ReclaimableBytes)
+	writeValue("bitcask_iterators_created_total", "Number of iterators created.", "counter", m.IteratorsCreated)
+	writeValue("bitcask_iterators_open", "Number of iterators not yet closed.", "gauge", m.IteratorsOpen)
+	return bw.Flush()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
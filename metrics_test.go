@@ -0,0 +1,144 @@
+package bitcask
+
+import (
+	"bitcask/data"
+	"bitcask/utils"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestDB_Metrics verifies the counters and histograms collected by the DB.
+func TestDB_Metrics(t *testing.T) {
+	db, _ := openMergeTestDB(t, Btree)
+	defer destroyDB(db)
+
+	var written int64
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+		written += int64(getIndexPos(t, db, utils.GetTestKey(i)).Size)
+	}
+	for i := 0; i < 10; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.Delete(utils.GetTestKey(0)))
+	assert.Nil(t, db.Sync())
+
+	iter := db.NewIterator(DefaultIteratorConfig)
+	m := db.Metrics()
+	assert.Equal(t, uint64(1000), m.PutLatency.Count)
+	assert.Equal(t, uint64(10), m.GetLatency.Count)
+	assert.Equal(t, uint64(1), m.DeleteLatency.Count)
+	assert.LessOrEqual(t, m.PutLatency.Counts[len(m.PutLatency.Counts)-1], m.PutLatency.Count)
+	assert.Greater(t, m.BytesWritten, written)
+	assert.Equal(t, m.BytesWritten, m.BytesSynced)
+	assert.Greater(t, m.FileRotations, int64(0))
+	assert.Equal(t, m.FileRotations+1, m.DataFiles)
+	assert.Equal(t, int64(999), m.IndexKeys)
+	assert.Greater(t, m.IndexMemoryBytes, int64(0))
+	assert.Equal(t, db.Stat().ReclaimableSize, m.ReclaimableBytes)
+	assert.Equal(t, int64(1), m.IteratorsCreated)
+	assert.Equal(t, int64(1), m.IteratorsOpen)
+	iter.Close()
+	assert.Equal(t, int64(0), db.Metrics().IteratorsOpen)
+
+	assert.Nil(t, db.Merge())
+	assert.Equal(t, uint64(1), db.Metrics().MergeLatency.Count)
+}
+
+// TestDB_Metrics_CRCErrors verifies that corrupted records are counted.
+func TestDB_Metrics_CRCErrors(t *testing.T) {
+	cfg := DefaultConfig
+	dir, err := os.MkdirTemp("", "bitcask-test-metrics")
+	assert.Nil(t, err)
+	cfg.DirPath = dir
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	assert.Nil(t, db.Put([]byte("key"), []byte("value")))
+	pos := getIndexPos(t, db, []byte("key"))
+	file, err := os.OpenFile(data.GetDataFileName(dir, pos.Fid), os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	// 修改 value 的最后一个字节
+	_, err = file.WriteAt([]byte{'x'}, pos.Offset+int64(pos.Size)-1)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	_, err = db.Get([]byte("key"))
+	assert.ErrorIs(t, err, data.ErrInvalidCRC)
+	assert.Equal(t, int64(1), db.Metrics().CRCErrors)
+}
+
+// TestMetrics_WritePrometheus verifies the Prometheus text output.
+func TestMetrics_WritePrometheus(t *testing.T) {
+	cfg := DefaultConfig
+	dir, err := os.MkdirTemp("", "bitcask-test-metrics")
+	assert.Nil(t, err)
+	cfg.DirPath = dir
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	assert.Nil(t, db.Put([]byte("key"), []byte("value")))
+	_, err = db.Get([]byte("key"))
+	assert.Nil(t, err)
+
+	var buf bytes.Buffer
+	assert.Nil(t, db.Metrics().WritePrometheus(&buf))
+	out := buf.String()
+	assert.Contains(t, out, "# TYPE bitcask_operation_duration_seconds histogram\n")
+	assert.Contains(t, out, "bitcask_operation_duration_seconds_bucket{op=\"get\",le=\"+Inf\"} 1\n")
+	assert.Contains(t, out, "bitcask_operation_duration_seconds_count{op=\"put\"} 1\n")
+	assert.Contains(t, out, "bitcask_fsync_duration_seconds_count 0\n")
+	assert.Contains(t, out, "bitcask_index_keys 1\n")
+	assert.Contains(t, out, "# TYPE bitcask_bytes_written_total counter\n")
+	// 每一行都是注释或者 "名称 值" 的形式
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		assert.Equal(t, 2, len(strings.Fields(line)), line)
+	}
+}
+
+// TestHistogram_Snapshot 并发记录时快照中的累计数量单调递增，总数量包括 +Inf 桶
+func TestHistogram_Snapshot(t *testing.T) {
+	h := newHistogram()
+	h.observe(time.Microsecond)
+	h.observe(time.Millisecond)
+	h.observe(time.Minute)
+	res := h.snapshot()
+	assert.Equal(t, uint64(3), res.Count)
+	assert.Equal(t, uint64(1), res.Counts[0])
+	assert.Equal(t, uint64(2), res.Counts[len(res.Counts)-1])
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			h.observe(time.Duration(i%20) * time.Second)
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		res := h.snapshot()
+		for j := 1; j < len(res.Counts); j++ {
+			assert.LessOrEqual(t, res.Counts[j-1], res.Counts[j])
+		}
+		assert.LessOrEqual(t, res.Counts[len(res.Counts)-1], res.Count)
+	}
+	close(stop)
+	wg.Wait()
+}
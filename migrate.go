@@ -0,0 +1,67 @@
+package bitcask
+
+import (
+	"bitcask/data"
+	"bitcask/index"
+	"os"
+)
+
+// MigrateIndex 把 cfg.DirPath 数据目录的索引切换为 newType，切换为 b+树索引时根据 hint 文件和数据文件构建索引文件
+// 使用 cfg 中的其他配置项打开数据库，其中的 IndexType 和 IndexFactory 会被忽略，索引在返回之前构建完成
+// 目录不能被其他进程以写入模式打开；直接使用新的索引类型调用 Open 也会完成切换
+func MigrateIndex(cfg DBConfig, newType IndexerType) error {
+	if _, err := os.Stat(cfg.DirPath); err != nil {
+		return err
+	}
+	cfg.IndexType = newType
+	cfg.IndexFactory = nil
+	cfg.BackgroundLoad = false
+	db, err := Open(cfg)
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+// checkIndexType 打开索引之前检查数据目录记录的索引类型，需要切换索引类型时删除失效的 b+树索引文件
+// 之后打开的 b+树索引没有检查点，会从 hint 文件和数据文件中重新构建
+func (db *DB) checkIndexType() error {
+	name, ok := db.indexTypeName()
+	if !ok {
+		return nil
+	}
+	recorded, err := data.ReadIndexType(db.cfg.DirPath)
+	if err != nil {
+		return err
+	}
+	// 旧版本的数据目录没有记录索引类型，b+树索引通过检查点判断是否需要重新构建
+	if recorded == "" || recorded == name {
+		return nil
+	}
+	bptreeName, _ := index.TypeName(BPTree)
+	if recorded == bptreeName || name == bptreeName {
+		return index.RemoveBPlusTree(db.cfg.DirPath)
+	}
+	return nil
+}
+
+// saveIndexType 索引构建完成之后记录数据目录使用的索引类型
+func (db *DB) saveIndexType() error {
+	name, ok := db.indexTypeName()
+	if !ok {
+		return nil
+	}
+	recorded, err := data.ReadIndexType(db.cfg.DirPath)
+	if err != nil || recorded == name {
+		return err
+	}
+	return data.WriteIndexType(db.cfg.DirPath, name)
+}
+
+// indexTypeName 内置索引类型的名称，使用 IndexFactory 时无法判断索引是否和之前的一致，不做检查
+func (db *DB) indexTypeName() (string, bool) {
+	if db.cfg.IndexFactory != nil {
+		return "", false
+	}
+	return index.TypeName(db.cfg.IndexType)
+}
@@ -0,0 +1,97 @@
+package bitcask
+
+import (
+	"bitcask/data"
+	"bitcask/index"
+	"bitcask/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestDB_SwitchIndexType 使用不同的索引类型打开同一个数据目录
+func TestDB_SwitchIndexType(t *testing.T) {
+	db, cfg := openMergeTestDB(t, BPTree)
+	dir := cfg.DirPath
+	defer func() { destroyDB(db) }()
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	assert.Nil(t, db.Close())
+
+	// b+树索引切换为内存索引，之后删除的 key 在 b+树索引文件中仍然存在
+	cfg.IndexType = ART
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, len(listKeys(t, db)))
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	name, err := data.ReadIndexType(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, "art", name)
+	_, err = os.Stat(filepath.Join(dir, "bptree-index"))
+	assert.True(t, os.IsNotExist(err))
+
+	// 切换回 b+树索引时重新构建
+	cfg.IndexType = BPTree
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, 400, len(listKeys(t, db)))
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	for i := 100; i < 500; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	name, err = data.ReadIndexType(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, "bptree", name)
+
+	// 旧版本的数据目录没有记录索引类型
+	assert.Nil(t, db.Close())
+	assert.Nil(t, os.Remove(filepath.Join(dir, data.IndexTypeFileName)))
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, 400, len(listKeys(t, db)))
+	name, err = data.ReadIndexType(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, "bptree", name)
+}
+
+func TestMigrateIndex(t *testing.T) {
+	cfg := DefaultConfig
+	dir, err := os.MkdirTemp("", "bitcask-test-migrate-index")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	cfg.DirPath = dir
+	cfg.IndexType = Btree
+	db, err := Open(cfg)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	assert.Nil(t, db.Close())
+
+	// 迁移时使用传入的配置项，而不是默认配置
+	cfg.DataFileSize = 32 * 1024
+	cfg.BackgroundLoad = true
+	assert.Nil(t, MigrateIndex(cfg, BPTree))
+	// 迁移之后的 b+树索引已经构建完成，正常关闭时记录了检查点
+	tree, err := index.NewBPlusTree(dir, false)
+	assert.Nil(t, err)
+	size, err := tree.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, 100, size)
+	checkpoint, err := tree.Checkpoint()
+	assert.Nil(t, err)
+	assert.True(t, checkpoint.Clean)
+	assert.Nil(t, tree.Close())
+
+	assert.Equal(t, index.ErrUnsupportedIndexType, MigrateIndex(cfg, 100))
+	cfg.DirPath = filepath.Join(dir, "not-exist")
+	assert.True(t, os.IsNotExist(MigrateIndex(cfg, BPTree)))
+}
@@ -0,0 +1,186 @@
+package bitcask
+
+import (
+	"bitcask/data"
+	"bitcask/fio"
+	"errors"
+	"os"
+)
+
+// OpenReadOnly 以只读模式打开数据库，可以和写入进程同时访问同一个数据目录
+// 只读模式不会创建或删除任何文件，也不会安装没有完成的 merge，所有写入操作返回 ErrReadOnly
+// 写入进程之后追加的数据需要调用 Refresh 读取
+func OpenReadOnly(cfg DBConfig) (*DB, error) {
+	if err := checkConfig(cfg); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(cfg.DirPath); err != nil {
+		return nil, err
+	}
+	// b+树索引文件被写入进程占用，只读模式从数据文件构建内存索引
+	if cfg.IndexType == BPTree {
+		cfg.IndexType = Btree
+	}
+	db := &DB{
+		cfg:       cfg,
+		mu:        new(rwLock),
+		oldFile:   make(map[uint32]*data.DataFile),
+		fileCache: fio.NewReadOnlyFileCache(cfg.MaxOpenFiles),
+		metrics:   newMetrics(),
+		readOnly:  true,
+	}
+	if err := db.reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Refresh 读取写入进程在上一次 Refresh 之后追加到活跃文件和新数据文件中的数据
+// 写入进程安装了新的 merge 结果时重新加载全部数据文件和索引
+// 只对以只读模式打开的数据库有效，写入进程打开的数据库总是最新的
+func (db *DB) Refresh() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed.Load() {
+		return ErrDBClosed
+	}
+	if !db.readOnly {
+		return nil
+	}
+	manifest, err := db.readManifest()
+	if err != nil {
+		return err
+	}
+	if manifest.Generation != db.manifest.Generation {
+		return db.reload()
+	}
+	fileIDs, err := db.listDataFileIDs()
+	if err != nil {
+		return err
+	}
+
+	// 打开写入进程新切换出来的数据文件
+	var newFiles []*data.DataFile
+	for _, fid := range fileIDs {
+		fileID := uint32(fid)
+		if !manifest.IsLive(fileID) || (db.activeFile != nil && fileID <= db.activeFile.FileID) {
+			continue
+		}
+		file, err := data.OpenCachedDataFile(db.cfg.DirPath, fileID, db.fileCache)
+		if err != nil {
+			for _, file := range newFiles {
+				_ = file.Close()
+			}
+			return err
+		}
+		newFiles = append(newFiles, file)
+	}
+	var files []*data.DataFile
+	if db.activeFile != nil {
+		files = append(files, db.activeFile)
+	}
+	files = append(files, newFiles...)
+	if len(files) == 0 {
+		return nil
+	}
+	// 先发布新的文件集合，再让索引指向新文件中的数据
+	if len(newFiles) > 0 {
+		last := newFiles[len(newFiles)-1]
+		if err := last.Pin(); err != nil {
+			return err
+		}
+		for _, file := range files[:len(files)-1] {
+			file.Unpin()
+			db.oldFile[file.FileID] = file
+		}
+		db.activeFile = last
+		db.releaseGeneration(db.swapGeneration())
+	}
+
+	for _, file := range files {
+		offset, err := db.loadIndexFromFile(file, file.WriteOff)
+		file.WriteOff = offset
+		if err != nil && !db.isIncompleteTail(file, err) {
+			return err
+		}
+	}
+	return db.loadDeadBytes()
+}
+
+// reload 重新加载 manifest、全部数据文件和索引，需要持有写锁
+// 新的索引和文件集合加载完成之后一起发布，之前打开的文件在没有读取使用之后关闭
+func (db *DB) reload() error {
+	manifest, err := db.readManifest()
+	if err != nil {
+		return err
+	}
+	prevIndex, prevOldFile, prevActiveFile, prevManifest := db.index, db.oldFile, db.activeFile, db.manifest
+	prevTxnRecords := db.txnRecords
+	if db.index, err = db.newIndexer(false); err != nil {
+		db.index = prevIndex
+		return err
+	}
+	db.oldFile = make(map[uint32]*data.DataFile)
+	db.activeFile = nil
+	db.manifest = manifest
+
+	err = db.loadDataFiles()
+	if err == nil {
+		err = db.loadIndexFromHintFile()
+	}
+	if err == nil {
+		err = db.loadIndexFromFiles()
+	}
+	// 加载期间写入进程安装了 merge，需要的文件可能已经被删除
+	if current, readErr := db.readManifest(); readErr != nil {
+		err = readErr
+	} else if current.Generation != manifest.Generation {
+		err = ErrMergeIsProgress
+	}
+	if err != nil {
+		for _, file := range db.allDataFiles() {
+			_ = file.Close()
+		}
+		db.index, db.oldFile, db.activeFile, db.manifest = prevIndex, prevOldFile, prevActiveFile, prevManifest
+		db.txnRecords = prevTxnRecords
+		return err
+	}
+
+	var obsolete []*data.DataFile
+	for _, file := range prevOldFile {
+		obsolete = append(obsolete, file)
+	}
+	if prevActiveFile != nil {
+		obsolete = append(obsolete, prevActiveFile)
+	}
+	if old := db.swapGeneration(); old != nil {
+		old.obsolete = obsolete
+		db.releaseGeneration(old)
+	}
+	return db.loadDeadBytes()
+}
+
+// readManifest 读取数据目录中的 manifest，不会修改数据目录
+// 写入进程已经提交但还没有安装完 merge 结果时返回 ErrMergeIsProgress
+func (db *DB) readManifest() (*data.Manifest, error) {
+	manifest, err := data.ReadManifest(db.cfg.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		if manifest, err = db.legacyManifest(); err != nil {
+			return nil, err
+		}
+	}
+	mergeManifest, err := data.ReadManifest(db.getMergePath())
+	if err == nil && mergeManifest != nil && mergeManifest.Generation == manifest.Generation {
+		return nil, ErrMergeIsProgress
+	}
+	return manifest, nil
+}
+
+// isIncompleteTail 判断读取错误是否来自写入进程正在写入的记录
+// 只读模式下最新的数据文件末尾可能只写入了一部分，下一次 Refresh 时重新读取
+func (db *DB) isIncompleteTail(file *data.DataFile, err error) bool {
+	return db.readOnly && file == db.activeFile && errors.Is(err, data.ErrInvalidCRC)
+}
@@ -0,0 +1,130 @@
+package bitcask
+
+import (
+	"bitcask/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func listDir(t *testing.T, dirPath string) []string {
+	entries, err := os.ReadDir(dirPath)
+	assert.Nil(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	db, cfg := openMergeTestDB(t, DefaultConfig.IndexType)
+	defer destroyDB(db)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	assert.Nil(t, db.Delete(utils.GetTestKey(0)))
+	files := listDir(t, cfg.DirPath)
+
+	// b+树索引文件被写入进程占用，只读模式使用内存索引
+	reader, err := OpenReadOnly(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, 999, len(listKeys(t, reader)))
+	for i := 1; i < 1000; i++ {
+		val, err := reader.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		expected, _ := db.Get(utils.GetTestKey(i))
+		assert.Equal(t, expected, val)
+	}
+	_, err = reader.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	assert.Equal(t, ErrReadOnly, reader.Put([]byte("key"), []byte("value")))
+	assert.Equal(t, ErrReadOnly, reader.Delete(utils.GetTestKey(1)))
+	assert.Equal(t, ErrReadOnly, reader.Sync())
+	assert.Equal(t, ErrReadOnly, reader.Merge())
+	wb := reader.NewWriteBatch(DefaultWriteBatchConfig)
+	assert.Nil(t, wb.Put([]byte("key"), []byte("value")))
+	assert.Equal(t, ErrReadOnly, wb.Commit())
+	assert.Nil(t, reader.Refresh())
+
+	// 关闭之后不会修改数据目录
+	assert.Nil(t, reader.Close())
+	assert.Equal(t, files, listDir(t, cfg.DirPath))
+
+	// 不会创建数据目录
+	cfg.DirPath = filepath.Join(cfg.DirPath, "not-exist")
+	_, err = OpenReadOnly(cfg)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(cfg.DirPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDB_Refresh(t *testing.T) {
+	for _, indexType := range []IndexerType{Btree, BPTree} {
+		db, cfg := openMergeTestDB(t, indexType)
+
+		// 空的数据目录
+		reader, err := OpenReadOnly(cfg)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(listKeys(t, reader)))
+
+		values := make(map[string][]byte)
+		check := func() {
+			assert.Nil(t, reader.Refresh())
+			assert.Equal(t, len(values), len(listKeys(t, reader)))
+			for key, value := range values {
+				val, err := reader.Get([]byte(key))
+				assert.Nil(t, err)
+				assert.Equal(t, value, val)
+			}
+		}
+		put := func(from, to int) {
+			for i := from; i < to; i++ {
+				key := utils.GetTestKey(i)
+				values[string(key)] = utils.GetTestValue(64)
+				assert.Nil(t, db.Put(key, values[string(key)]))
+			}
+		}
+
+		// 追加到活跃文件和切换出来的新文件
+		put(0, 100)
+		check()
+		put(50, 1000)
+		for i := 0; i < 10; i++ {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+			delete(values, string(utils.GetTestKey(i)))
+		}
+		wb := db.NewWriteBatch(DefaultWriteBatchConfig)
+		for i := 1000; i < 1100; i++ {
+			key := utils.GetTestKey(i)
+			values[string(key)] = utils.GetTestValue(64)
+			assert.Nil(t, wb.Put(key, values[string(key)]))
+		}
+		assert.Nil(t, wb.Commit())
+		check()
+		assert.Equal(t, db.Stat().DataFileNum, reader.Stat().DataFileNum)
+
+		// merge 之后旧文件已经被删除，打开的文件仍然可以读取，Refresh 之后读取 merge 后的文件
+		iter := reader.NewIterator(DefaultIteratorConfig)
+		assert.Nil(t, db.Merge())
+		val, err := reader.Get(utils.GetTestKey(500))
+		assert.Nil(t, err)
+		assert.Equal(t, values[string(utils.GetTestKey(500))], val)
+		put(1100, 1200)
+		check()
+		assert.Equal(t, int64(0), reader.Stat().ReclaimableSize)
+		var count int
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			_, err := iter.Value()
+			assert.Nil(t, err)
+			count++
+		}
+		assert.Equal(t, 1090, count)
+		iter.Close()
+
+		assert.Nil(t, reader.Close())
+		destroyDB(db)
+	}
+}
@@ -0,0 +1,187 @@
+package bitcask
+
+import (
+	"bitcask/data"
+	"bitcask/index"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// snapshotBatchSize 从快照中加载时每次更新到索引中的 key 数量
+const snapshotBatchSize = 1024
+
+// SaveIndexSnapshot 把内存索引保存为快照，重新打开时只需要重放快照之后写入的数据
+// Close 时会自动保存；保存期间会阻塞写入，可以定期调用以减少崩溃之后重放的数据量。b+树索引不需要快照
+func (db *DB) SaveIndexSnapshot() error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := db.WaitReady(context.Background()); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed.Load() {
+		return ErrDBClosed
+	}
+	return db.saveIndexSnapshot()
+}
+
+// saveIndexSnapshot 持久化活跃文件，之后把索引和活跃文件的写入位置写入快照，需要持有锁
+func (db *DB) saveIndexSnapshot() error {
+	// 后台加载没有完成时索引不完整
+	if db.isBPTreeIndex() || db.readOnly || db.activeFile == nil || db.loadingIndex() != nil {
+		return nil
+	}
+	db.waitIndexUpdates()
+	if err := db.syncActiveFile(); err != nil {
+		return err
+	}
+	sw, err := data.NewSnapshotWriter(db.cfg.DirPath, &data.IndexSnapshot{
+		Fid:        db.activeFile.FileID,
+		Offset:     db.activeFile.WriteOff,
+		SeqNo:      atomic.LoadUint64(&db.seqNo),
+		Generation: db.manifest.Generation,
+	})
+	if err != nil {
+		return err
+	}
+	iterator, err := db.index.Iterator(false)
+	if err != nil {
+		sw.Abort()
+		return err
+	}
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if err := sw.Add(iterator.Key(), iterator.Value()); err != nil {
+			sw.Abort()
+			return err
+		}
+	}
+	return sw.Close()
+}
+
+// loadIndexFromSnapshot 从快照中加载索引，之后重放快照之后写入的数据
+// 快照不存在时返回 false；快照损坏或者和数据文件不一致时返回错误，需要重新创建索引并读取全部数据文件
+func (db *DB) loadIndexFromSnapshot() (bool, error) {
+	sr, err := data.OpenSnapshotReader(db.cfg.DirPath)
+	if err != nil || sr == nil {
+		return false, err
+	}
+	defer sr.Close()
+	snapshot := sr.Snapshot
+	if err := db.checkSnapshot(snapshot); err != nil {
+		return false, err
+	}
+	for eof := false; !eof; {
+		var keys [][]byte
+		var positions []*data.LogRecordPos
+		for len(keys) < snapshotBatchSize {
+			key, pos, err := sr.Next()
+			if err == io.EOF {
+				eof = true
+				break
+			}
+			if err != nil {
+				return false, err
+			}
+			keys = append(keys, key)
+			positions = append(positions, pos)
+		}
+		if err := db.putSnapshotKeys(keys, positions); err != nil {
+			return false, err
+		}
+	}
+	db.seqNo = snapshot.SeqNo
+
+	db.txnRecords = make(map[uint64][]*data.TransactionRecord)
+	loads := db.fileLoadsFrom(snapshot.Fid, snapshot.Offset)
+	err = db.loadIndexFromFileLoads(loads, func(load fileLoad, end int64, err error) error {
+		if err != nil && !db.isIncompleteTail(load.dataFile, err) {
+			return err
+		}
+		if load.dataFile == db.activeFile && db.loadingIndex() == nil {
+			db.activeFile.WriteOff = end
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	db.txnRecords = nil
+	return true, nil
+}
+
+// putSnapshotKeys 把快照中的一批 key 更新到索引中，跳过后台加载期间写入过的 key
+func (db *DB) putSnapshotKeys(keys [][]byte, positions []*data.LogRecordPos) error {
+	unlock, err := db.lockForLoad()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = index.Batch(db.index, func(w index.BatchWriter) error {
+		for i, key := range keys {
+			if db.isWritten(key) {
+				continue
+			}
+			if err := w.Put(key, positions[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrIndexUpdateFailed, err)
+	}
+	return nil
+}
+
+// checkSnapshot 快照是否覆盖当前的数据文件，merge 之后或者数据文件丢失了快照中的数据时快照失效
+func (db *DB) checkSnapshot(snapshot *data.IndexSnapshot) error {
+	if snapshot.Generation != db.manifest.Generation || snapshot.Fid < db.manifest.NonMergeFileID {
+		return data.ErrInvalidIndexSnapshot
+	}
+	for _, load := range db.indexFiles() {
+		if load.dataFile.FileID == snapshot.Fid && snapshot.Offset >= 0 && snapshot.Offset <= load.size {
+			return nil
+		}
+	}
+	return data.ErrInvalidIndexSnapshot
+}
+
+// loadIndex 加载内存索引，优先使用快照，快照不可用时读取 hint 文件和全部数据文件
+func (db *DB) loadIndex() error {
+	if !db.readOnly {
+		ok, err := db.loadIndexFromSnapshot()
+		if ok {
+			return nil
+		}
+		if err != nil {
+			// 快照只用来加快打开的速度，失效时丢弃已经加载的数据
+			if errors.Is(err, ErrIndexUpdateFailed) || err == ErrDBClosed {
+				return err
+			}
+			unlock, err := db.lockForLoad()
+			if err != nil {
+				return err
+			}
+			err = db.resetIndex()
+			unlock()
+			if err != nil {
+				return err
+			}
+			_ = os.Remove(filepath.Join(db.cfg.DirPath, data.IndexSnapshotFileName))
+		}
+	}
+	//从hint文件中加载索引（如果有的话）
+	if err := db.loadIndexFromHintFile(); err != nil {
+		return err
+	}
+	//从数据文件中加载索引
+	return db.loadIndexFromFiles()
+}
@@ -0,0 +1,152 @@
+package bitcask
+
+import (
+	"bitcask/data"
+	"bitcask/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// corruptDataFile 修改数据文件中 offset 处的数据，读取这部分数据时会校验失败
+func corruptDataFile(t *testing.T, dir string, fileID uint32, offset int64) {
+	file, err := os.OpenFile(data.GetDataFileName(dir, fileID), os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.WriteAt([]byte("corrupted"), offset)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+}
+
+// removeIndexSnapshot 删除关闭时保存的索引快照，之后打开时读取 hint 文件和数据文件
+func removeIndexSnapshot(t *testing.T, dir string) {
+	assert.Nil(t, os.Remove(filepath.Join(dir, data.IndexSnapshotFileName)))
+}
+
+func checkTestValues(t *testing.T, db *DB, values map[string][]byte) {
+	assert.Equal(t, len(values), len(listKeys(t, db)))
+	for key, value := range values {
+		val, err := db.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+}
+
+// TestDB_IndexSnapshot 关闭时保存索引快照，打开时只重放快照之后写入的数据
+func TestDB_IndexSnapshot(t *testing.T) {
+	for _, indexType := range []IndexerType{Btree, ART, Sharded, Hash, Arena} {
+		db, cfg := openMergeTestDB(t, indexType)
+		values := make(map[string][]byte)
+		for i := 0; i < 1000; i++ {
+			key := utils.GetTestKey(i)
+			values[string(key)] = utils.GetTestValue(64)
+			assert.Nil(t, db.Put(key, values[string(key)]))
+		}
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+			delete(values, string(utils.GetTestKey(i)))
+		}
+		commitTestBatch(t, db, utils.GetTestKey(2000))
+		values[string(utils.GetTestKey(2000))] = nil
+		// 写入之后删除的数据
+		activeFileID, offset := db.activeFile.FileID, db.activeFile.WriteOff
+		assert.Nil(t, db.Put(utils.GetTestKey(3000), utils.GetTestValue(64)))
+		assert.Nil(t, db.Delete(utils.GetTestKey(3000)))
+		assert.Equal(t, activeFileID, db.activeFile.FileID)
+		assert.Nil(t, db.Close())
+		_, err := os.Stat(filepath.Join(cfg.DirPath, data.IndexSnapshotFileName))
+		assert.Nil(t, err)
+
+		// 活跃文件中快照之前的数据损坏了，从快照打开时不会读取到
+		corruptDataFile(t, cfg.DirPath, activeFileID, offset+10)
+		db, err = Open(cfg)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(1), db.seqNo)
+		value, err := db.Get(utils.GetTestKey(2000))
+		assert.Nil(t, err)
+		values[string(utils.GetTestKey(2000))] = value
+		checkTestValues(t, db, values)
+
+		// 快照之后继续写入，崩溃之后从快照的位置开始重放
+		for i := 1000; i < 1500; i++ {
+			key := utils.GetTestKey(i)
+			values[string(key)] = utils.GetTestValue(64)
+			assert.Nil(t, db.Put(key, values[string(key)]))
+		}
+		assert.Nil(t, db.Delete(utils.GetTestKey(500)))
+		delete(values, string(utils.GetTestKey(500)))
+		commitTestBatch(t, db, utils.GetTestKey(2001))
+		assert.True(t, db.activeFile.FileID > activeFileID)
+		crashDB(db)
+
+		db, err = Open(cfg)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(2), db.seqNo)
+		value, err = db.Get(utils.GetTestKey(2001))
+		assert.Nil(t, err)
+		values[string(utils.GetTestKey(2001))] = value
+		checkTestValues(t, db, values)
+		destroyDB(db)
+	}
+}
+
+// TestDB_IndexSnapshot_Fallback 快照损坏或者失效时读取全部数据文件
+func TestDB_IndexSnapshot_Fallback(t *testing.T) {
+	db, cfg := openMergeTestDB(t, Btree)
+	defer func() { destroyDB(db) }()
+	values := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		key := utils.GetTestKey(i)
+		values[string(key)] = utils.GetTestValue(64)
+		assert.Nil(t, db.Put(key, values[string(key)]))
+	}
+	assert.Nil(t, db.Close())
+	snapshotPath := filepath.Join(cfg.DirPath, data.IndexSnapshotFileName)
+
+	// 快照损坏
+	content, err := os.ReadFile(snapshotPath)
+	assert.Nil(t, err)
+	content[len(content)/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(snapshotPath, content, 0644))
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	checkTestValues(t, db, values)
+	assert.Nil(t, db.Close())
+
+	// 快照被截断
+	content, err = os.ReadFile(snapshotPath)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(snapshotPath, content[:len(content)/2], 0644))
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	checkTestValues(t, db, values)
+
+	// merge 之后快照中的位置失效
+	assert.Nil(t, db.SaveIndexSnapshot())
+	copyFile(t, snapshotPath, snapshotPath+".bak")
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		delete(values, string(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	crashDB(db)
+	assert.Nil(t, os.Rename(snapshotPath+".bak", snapshotPath))
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	checkTestValues(t, db, values)
+	assert.Nil(t, db.Close())
+
+	// 数据文件丢失了快照中的数据
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	activePath := data.GetDataFileName(cfg.DirPath, db.activeFile.FileID)
+	syncedSize := db.activeFile.WriteOff
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	assert.Nil(t, db.Close())
+	assert.Nil(t, os.Truncate(activePath, syncedSize))
+	db, err = Open(cfg)
+	assert.Nil(t, err)
+	checkTestValues(t, db, values)
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"io/fs"
+	"os"
 	"path/filepath"
 )
 
@@ -19,3 +20,13 @@ func DirSize(dirPath string) (int64, error) {
 	})
 	return size, err
 }
+
+// SyncDir 持久化目录，保证目录中文件的创建、重命名和删除操作落盘
+func SyncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}